@@ -1,7 +1,9 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
@@ -50,11 +52,21 @@ type ApiServer struct {
 	stats               atomic.Value
 	miners              map[string]*Entry
 	minersMu            sync.RWMutex
-	rpc                 *rpc.RPCClient
+	upstreams           *rpc.Pool
 	statsIntv           time.Duration
 	settings            map[string]interface{}
 }
 
+// Signed settings messages are accepted within this time of their timestamp
+const settingsMessageTTL = 10 * time.Minute
+
+type minerSettingsRequest struct {
+	Threshold int64  `json:"threshold"`
+	Address   string `json:"address"`
+	Timestamp int64  `json:"timestamp"`
+	Signature string `json:"signature"`
+}
+
 type Entry struct {
 	stats     map[string]interface{}
 	updatedAt int64
@@ -63,9 +75,11 @@ type Entry struct {
 func NewApiServer(cfg *ApiConfig, settings map[string]interface{}, backend *storage.RedisClient) *ApiServer {
 	rpcDaemon := settings["BlockUnlocker"].(map[string]interface{})["Daemon"].(string)
 	rpcTimeout := settings["BlockUnlocker"].(map[string]interface{})["Timeout"].(string)
-	rpc := rpc.NewRPCClient("BlockUnlocker", rpcDaemon, rpcTimeout)
-	block, err := rpc.GetBlockByHeight(0)
-	if err != nil || block == nil {
+	rpcAuth := settings["BlockUnlocker"].(map[string]interface{})["Auth"].(rpc.Auth)
+	rpcUpstream := settings["BlockUnlocker"].(map[string]interface{})["Upstream"].([]rpc.Upstream)
+	upstreams := rpc.NewUpstreamPool("Api", rpc.UpstreamList(rpcUpstream, "BlockUnlocker", rpcDaemon, rpcTimeout, rpcAuth), false)
+	block, err := getGenesisBlock(upstreams)
+	if err != nil {
 		log.Fatalf("Error while retrieving genesis block from node: %v", err)
 	}
 	hashrateWindow := util.MustParseDuration(cfg.HashrateWindow)
@@ -77,11 +91,28 @@ func NewApiServer(cfg *ApiConfig, settings map[string]interface{}, backend *stor
 		hashrateWindow:      hashrateWindow,
 		hashrateLargeWindow: hashrateLargeWindow,
 		miners:              make(map[string]*Entry),
-		rpc:                 rpc,
+		upstreams:           upstreams,
 		settings:            settings,
 	}
 }
 
+// Any upstream will do, fail only if none of them replies
+func getGenesisBlock(upstreams *rpc.Pool) (*rpc.GetBlockReply, error) {
+	var err error
+	for _, client := range upstreams.Clients() {
+		var block *rpc.GetBlockReply
+		block, err = client.GetBlockByHeight(context.Background(), 0)
+		if err == nil && block != nil {
+			return block, nil
+		}
+		if err == nil {
+			err = errors.New("no genesis block")
+		}
+		log.Printf("Failed to get genesis block from %s: %v", client.Name, err)
+	}
+	return nil, err
+}
+
 func (s *ApiServer) Start() {
 	if s.config.PurgeOnly {
 		log.Printf("Starting API in purge-only mode")
@@ -260,6 +291,7 @@ func (s *ApiServer) listen() {
 	r.HandleFunc("/api/payments", s.PaymentsIndex)
 	r.HandleFunc("/api/settings", s.Settings)
 	r.HandleFunc("/api/accounts/{login:0x[0-9a-fA-F]{40}}", s.AccountIndex)
+	r.HandleFunc("/api/accounts/{login:0x[0-9a-fA-F]{40}}/settings", s.MinerSettingsIndex)
 	r.NotFoundHandler = http.HandlerFunc(notFound)
 	err := http.ListenAndServe(s.config.Listen, r)
 	if err != nil {
@@ -464,6 +496,12 @@ func (s *ApiServer) AccountIndex(w http.ResponseWriter, r *http.Request) {
 		stats["pageSize"] = s.config.Payments
 		stats["minerCharts"], err = s.backend.GetMinerCharts(s.config.MinerChartsNum, login)
 		stats["paymentCharts"], err = s.backend.GetPaymentCharts(login)
+		shares, err := s.backend.GetShareCounts("login", login)
+		if err != nil {
+			log.Printf("Failed to fetch share ratio from backend: %v", err)
+		} else {
+			stats["shareRatio"] = map[string]interface{}{"valid": shares.Valid, "invalid": shares.Invalid, "invalidRatio": shares.InvalidRatio()}
+		}
 		reply = &Entry{stats: stats, updatedAt: now}
 		s.miners[login] = reply
 	}
@@ -475,6 +513,116 @@ func (s *ApiServer) AccountIndex(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Text miner signs with personal_sign, timestamp is in seconds
+func minerSettingsMessage(login string, req *minerSettingsRequest) string {
+	return fmt.Sprintf("Payout settings of %s\nThreshold: %d\nAddress: %s\nTimestamp: %d", login, req.Threshold, req.Address, req.Timestamp)
+}
+
+func (s *ApiServer) payoutsSetting(name string) int64 {
+	value, _ := s.settings["Payouts"].(map[string]interface{})[name].(int64)
+	return value
+}
+
+func (s *ApiServer) checkMinerSettings(req *minerSettingsRequest) error {
+	if len(req.Address) > 0 && !util.IsValidHexAddress(req.Address) {
+		return errors.New("invalid payout address")
+	}
+	min, max := s.payoutsSetting("MinThreshold"), s.payoutsSetting("MaxThreshold")
+	if req.Threshold < 0 || req.Threshold > 0 && req.Threshold < min {
+		return fmt.Errorf("threshold must be at least %v Shannon, or 0 for pool default", min)
+	}
+	if max > 0 && req.Threshold > max {
+		return fmt.Errorf("threshold must be at most %v Shannon", max)
+	}
+	age := time.Since(time.Unix(req.Timestamp, 0))
+	if age > settingsMessageTTL || age < -settingsMessageTTL {
+		return errors.New("message timestamp is too far from now")
+	}
+	return nil
+}
+
+// Miner proves control of login by signing new settings with it
+func (s *ApiServer) MinerSettingsIndex(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	login := strings.ToLower(mux.Vars(r)["login"])
+	reply := func(status int, v interface{}) {
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(v); err != nil {
+			log.Println("Error serializing API response: ", err)
+		}
+	}
+	fail := func(status int, err error) {
+		reply(status, map[string]string{"error": err.Error()})
+	}
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusOK)
+		return
+	case http.MethodGet, http.MethodPost:
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	exist, err := s.backend.IsMinerExists(login)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to fetch miner from backend: %v", err)
+		return
+	}
+	if !exist {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	current, err := s.backend.GetMinerSettings(login)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to fetch miner settings from backend: %v", err)
+		return
+	}
+	if r.Method == http.MethodGet {
+		reply(http.StatusOK, current)
+		return
+	}
+
+	var req minerSettingsRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&req); err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+	if err := s.checkMinerSettings(&req); err != nil {
+		fail(http.StatusBadRequest, err)
+		return
+	}
+	signer, err := util.RecoverPersonalSigner(minerSettingsMessage(login, &req), req.Signature)
+	if err != nil || signer != login {
+		fail(http.StatusUnauthorized, errors.New("message is not signed by miner address"))
+		return
+	}
+	// Replay of older message
+	if req.Timestamp <= current.Timestamp {
+		fail(http.StatusConflict, errors.New("settings were changed by newer message"))
+		return
+	}
+
+	settings := &storage.MinerSettings{Threshold: req.Threshold, Address: strings.ToLower(req.Address), Timestamp: req.Timestamp}
+	if err := s.backend.SetMinerSettings(login, settings); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		log.Printf("Failed to save miner settings: %v", err)
+		return
+	}
+	log.Printf("Miner %s set payout threshold %v Shannon, address %q", login, settings.Threshold, settings.Address)
+	s.minersMu.Lock()
+	delete(s.miners, login)
+	s.minersMu.Unlock()
+	reply(http.StatusOK, settings)
+}
+
 func (s *ApiServer) Settings(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -492,6 +640,8 @@ func (s *ApiServer) Settings(w http.ResponseWriter, r *http.Request) {
 	reply["Stratum"] = s.settings["Proxy"].(map[string]interface{})["Stratum"].(map[string]interface{})["Enabled"]
 	reply["StratumPool"] = s.settings["Proxy"].(map[string]interface{})["Stratum"].(map[string]interface{})["Listen"]
 	reply["PayoutThreshold"] = s.settings["Payouts"].(map[string]interface{})["Threshold"]
+	reply["PayoutMinThreshold"] = s.settings["Payouts"].(map[string]interface{})["MinThreshold"]
+	reply["PayoutMaxThreshold"] = s.settings["Payouts"].(map[string]interface{})["MaxThreshold"]
 	reply["PayoutInterval"] = s.settings["Payouts"].(map[string]interface{})["Interval"]
 	reply["GenesisHash"] = s.genesisHash
 
@@ -0,0 +1,80 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/gorilla/mux"
+
+	"github.com/cyberpoolorg/etc-stratum/storage"
+)
+
+func TestMinerSettings(t *testing.T) {
+	backend := storage.NewRedisClient(&storage.Config{Endpoint: "127.0.0.1:6379", PoolSize: 10}, "api-test")
+	if _, err := backend.Check(); err != nil {
+		t.Skipf("Redis is not available: %v", err)
+	}
+	reset := func() {
+		for _, key := range backend.Client().Keys("api-test:*").Val() {
+			backend.Client().Del(key)
+		}
+	}
+	reset()
+	defer reset()
+	s := &ApiServer{
+		backend:  backend,
+		miners:   make(map[string]*Entry),
+		settings: map[string]interface{}{"Payouts": map[string]interface{}{"MinThreshold": int64(100), "MaxThreshold": int64(10000)}},
+	}
+
+	key, _ := crypto.GenerateKey()
+	login := hexutil.Encode(crypto.PubkeyToAddress(key.PublicKey).Bytes())
+	backend.Client().HIncrBy("api-test:miners:"+login, "balance", 1)
+	post := func(req *minerSettingsRequest, signer func(string) string) int {
+		req.Signature = signer(minerSettingsMessage(login, req))
+		body, _ := json.Marshal(req)
+		r := mux.SetURLVars(httptest.NewRequest("POST", "/api/accounts/"+login+"/settings", bytes.NewReader(body)), map[string]string{"login": login})
+		w := httptest.NewRecorder()
+		s.MinerSettingsIndex(w, r)
+		return w.Code
+	}
+	sign := func(message string) string {
+		sig, _ := crypto.Sign(accounts.TextHash([]byte(message)), key)
+		sig[64] += 27
+		return hexutil.Encode(sig)
+	}
+	other, _ := crypto.GenerateKey()
+	forge := func(message string) string {
+		sig, _ := crypto.Sign(accounts.TextHash([]byte(message)), other)
+		return hexutil.Encode(sig)
+	}
+
+	now := time.Now().Unix()
+	req := &minerSettingsRequest{Threshold: 5000, Address: "0x00000000000000000000000000000000000000B1", Timestamp: now}
+	if code := post(req, forge); code != http.StatusUnauthorized {
+		t.Errorf("Must reject message signed by other key, got %v", code)
+	}
+	if code := post(&minerSettingsRequest{Threshold: 50, Timestamp: now}, sign); code != http.StatusBadRequest {
+		t.Errorf("Must reject threshold below pool limit, got %v", code)
+	}
+	if code := post(&minerSettingsRequest{Timestamp: now - 3600}, sign); code != http.StatusBadRequest {
+		t.Errorf("Must reject expired message, got %v", code)
+	}
+	if code := post(req, sign); code != http.StatusOK {
+		t.Fatalf("Must accept signed settings, got %v", code)
+	}
+	settings, _ := backend.GetMinerSettings(login)
+	if settings.Threshold != 5000 || settings.Address != "0x00000000000000000000000000000000000000b1" || settings.Timestamp != now {
+		t.Errorf("Unexpected settings %+v", settings)
+	}
+	if code := post(req, sign); code != http.StatusConflict {
+		t.Errorf("Must reject replayed message, got %v", code)
+	}
+}
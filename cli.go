@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/cyberpoolorg/etc-stratum/payouts"
+	"github.com/cyberpoolorg/etc-stratum/proxy"
+	"github.com/cyberpoolorg/etc-stratum/storage"
+)
+
+type command struct {
+	usage string
+	run   func(args []string) error
+}
+
+var commands = map[string]command{
+	"sessions":  {"sessions [-login ADDR] [-ip IP]", runSessions},
+	"reconnect": {"reconnect -host HOST -port PORT [-wait SEC] [-login ADDR] [-ip IP] [-batch N] [-interval DURATION]", runReconnect},
+	"message":   {"message -text TEXT [-login ADDR] [-ip IP]", runMessage},
+	"blacklist": {"blacklist [-add ADDR | -remove ADDR]", listCommand("blacklist")},
+	"whitelist": {"whitelist [-add IP|CIDR | -remove IP|CIDR]", listCommand("whitelist")},
+	"bans":      {"bans [-unban IP]", runBans},
+	"shares":    {"shares -ip IP | -login ADDR", runShares},
+	"audit":     {"audit", runAudit},
+	"dryrun":    {"dryrun", runDryRun},
+}
+
+func runCommand(args []string) {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "Unknown command %q, available commands:\n", args[0])
+		for _, c := range commands {
+			fmt.Fprintf(os.Stderr, "\t%s\n", c.usage)
+		}
+		os.Exit(2)
+	}
+	if err := cmd.run(args[1:]); err != nil {
+		log.Fatalf("Command %s failed: %v", args[0], err)
+	}
+}
+
+func runSessions(args []string) error {
+	fs := flag.NewFlagSet("sessions", flag.ExitOnError)
+	login := fs.String("login", "", "list sessions of this login")
+	ip := fs.String("ip", "", "list sessions from this IP")
+	fs.Parse(args)
+	query := url.Values{}
+	if len(*login) > 0 {
+		query.Set("login", *login)
+	}
+	if len(*ip) > 0 {
+		query.Set("ip", *ip)
+	}
+	return adminRequest("GET", proxyAdminUrl("/admin/sessions?"+query.Encode()), cfg.Proxy.Admin.Token, nil)
+}
+
+func runReconnect(args []string) error {
+	var c proxy.AdminCommand
+	fs := flag.NewFlagSet("reconnect", flag.ExitOnError)
+	fs.StringVar(&c.Host, "host", "", "host miners should reconnect to")
+	fs.IntVar(&c.Port, "port", 0, "port miners should reconnect to")
+	fs.IntVar(&c.Wait, "wait", 0, "seconds miners should wait before reconnecting")
+	fs.StringVar(&c.Login, "login", "", "only sessions of this login")
+	fs.StringVar(&c.IP, "ip", "", "only sessions from this IP")
+	fs.IntVar(&c.BatchSize, "batch", 0, "close unsupported sessions in batches of this size")
+	fs.StringVar(&c.BatchInterval, "interval", "", "pause between closed batches")
+	fs.Parse(args)
+	return adminRequest("POST", proxyAdminUrl("/admin/reconnect"), cfg.Proxy.Admin.Token, &c)
+}
+
+func runMessage(args []string) error {
+	var c proxy.AdminCommand
+	fs := flag.NewFlagSet("message", flag.ExitOnError)
+	fs.StringVar(&c.Message, "text", "", "message to show to miners")
+	fs.StringVar(&c.Login, "login", "", "only sessions of this login")
+	fs.StringVar(&c.IP, "ip", "", "only sessions from this IP")
+	fs.Parse(args)
+	return adminRequest("POST", proxyAdminUrl("/admin/message"), cfg.Proxy.Admin.Token, &c)
+}
+
+func listCommand(name string) func(args []string) error {
+	return func(args []string) error {
+		fs := flag.NewFlagSet(name, flag.ExitOnError)
+		add := fs.String("add", "", "add entry to "+name)
+		remove := fs.String("remove", "", "remove entry from "+name)
+		fs.Parse(args)
+		endpoint := proxyAdminUrl("/admin/lists/" + name)
+		switch {
+		case len(*add) > 0:
+			return adminRequest("POST", endpoint, cfg.Proxy.Admin.Token, &proxy.AdminCommand{Entry: *add})
+		case len(*remove) > 0:
+			return adminRequest("DELETE", endpoint+"?entry="+url.QueryEscape(*remove), cfg.Proxy.Admin.Token, nil)
+		}
+		return adminRequest("GET", endpoint, cfg.Proxy.Admin.Token, nil)
+	}
+}
+
+func runBans(args []string) error {
+	fs := flag.NewFlagSet("bans", flag.ExitOnError)
+	unban := fs.String("unban", "", "lift ban of this IP on all instances")
+	fs.Parse(args)
+	if len(*unban) > 0 {
+		return adminRequest("DELETE", proxyAdminUrl("/admin/bans?ip="+url.QueryEscape(*unban)), cfg.Proxy.Admin.Token, nil)
+	}
+	return adminRequest("GET", proxyAdminUrl("/admin/bans"), cfg.Proxy.Admin.Token, nil)
+}
+
+func runShares(args []string) error {
+	fs := flag.NewFlagSet("shares", flag.ExitOnError)
+	ip := fs.String("ip", "", "invalid share ratio of this IP")
+	login := fs.String("login", "", "invalid share ratio of this login")
+	fs.Parse(args)
+	query := url.Values{}
+	if len(*ip) > 0 {
+		query.Set("ip", *ip)
+	}
+	if len(*login) > 0 {
+		query.Set("login", *login)
+	}
+	return adminRequest("GET", proxyAdminUrl("/admin/shares?"+query.Encode()), cfg.Proxy.Admin.Token, nil)
+}
+
+func runAudit(args []string) error {
+	return adminRequest("GET", proxyAdminUrl("/admin/audit"), cfg.Proxy.Admin.Token, nil)
+}
+
+// Runs locally against redis and nodes of payouts config, no running instance is needed
+func runDryRun(args []string) error {
+	backend := storage.NewRedisClient(&cfg.Redis, cfg.Coin)
+	report, err := payouts.DryRun(context.Background(), &cfg.Payouts, backend)
+	if err != nil {
+		return err
+	}
+	data, _ := json.MarshalIndent(report, "", "  ")
+	fmt.Println(string(data))
+	return nil
+}
+
+func proxyAdminUrl(path string) string {
+	return "http://" + localAddr(cfg.Proxy.Admin.Listen) + path
+}
+
+// Reach wildcard listeners through loopback
+func localAddr(listen string) string {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return listen
+	}
+	if len(host) == 0 || host == "0.0.0.0" || host == "::" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+func adminRequest(method, endpoint, token string, body interface{}) error {
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	reply, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(reply))
+	}
+	fmt.Println(string(bytes.TrimSpace(reply)))
+	return nil
+}
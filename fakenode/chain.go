@@ -0,0 +1,257 @@
+package fakenode
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+type Block struct {
+	Number     int64
+	Hash       string
+	ParentHash string
+	Nonce      string
+	MixDigest  string
+	Miner      string
+	Difficulty int64
+	Timestamp  int64
+	Uncles     []*Block
+	Txs        []*Tx
+}
+
+type Tx struct {
+	Hash     string
+	From     string
+	To       string
+	Value    *big.Int
+	Nonce    uint64
+	Gas      int64
+	GasPrice *big.Int
+	GasUsed  int64
+	// Mined with status 0
+	Failed bool
+	block  *Block
+}
+
+// Hash depends on fork counter so blocks mined after reorg differ from dropped ones
+func (n *Node) blockHash(b *Block) string {
+	buf := make([]byte, 16)
+	binary.BigEndian.PutUint64(buf, uint64(b.Number))
+	binary.BigEndian.PutUint64(buf[8:], uint64(n.forks))
+	data := append(common.FromHex(b.ParentHash), buf...)
+	data = append(data, []byte(b.Nonce+b.Miner)...)
+	return crypto.Keccak256Hash(data).Hex()
+}
+
+// Must be called with lock held
+func (n *Node) head() *Block {
+	return n.chain[len(n.chain)-1]
+}
+
+// Must be called with lock held
+func (n *Node) seal(b *Block) *Block {
+	parent := n.head()
+	b.Number = parent.Number + 1
+	b.ParentHash = parent.Hash
+	if len(b.Miner) == 0 {
+		b.Miner = n.Coinbase
+	}
+	if len(b.Nonce) == 0 {
+		b.Nonce = fmt.Sprintf("0x%016x", b.Number)
+	}
+	if b.Difficulty == 0 {
+		b.Difficulty = n.Difficulty
+	}
+	b.Timestamp = parent.Timestamp + 13
+	b.Hash = n.blockHash(b)
+
+	// Block takes all pending transactions unless they were given explicitly
+	if b.Txs == nil {
+		b.Txs, n.pending = n.pending, nil
+	}
+	for _, tx := range b.Txs {
+		n.addTx(tx)
+		tx.block = b
+		if tx.GasUsed == 0 {
+			tx.GasUsed = 21000
+		}
+		fee := new(big.Int).Mul(big.NewInt(tx.GasUsed), tx.GasPrice)
+		n.addBalance(tx.From, new(big.Int).Neg(fee))
+		if !tx.Failed {
+			n.addBalance(tx.From, new(big.Int).Neg(tx.Value))
+			n.addBalance(tx.To, tx.Value)
+		}
+	}
+	n.chain = append(n.chain, b)
+	n.blocks[b.Hash] = b
+	for _, uncle := range b.Uncles {
+		n.blocks[uncle.Hash] = uncle
+	}
+	return b
+}
+
+// Must be called with lock held
+func (n *Node) addTx(tx *Tx) {
+	if len(tx.Hash) == 0 {
+		n.txCount++
+		tx.Hash = n.blockHash(&Block{Number: n.txCount, Nonce: "tx", Miner: tx.From})
+	}
+	if tx.Value == nil {
+		tx.Value = new(big.Int)
+	}
+	if tx.GasPrice == nil {
+		tx.GasPrice = new(big.Int).Set(n.gasPrice)
+	}
+	n.txs[tx.Hash] = tx
+}
+
+// Must be called with lock held
+func (n *Node) addBalance(addr string, v *big.Int) {
+	addr = normalize(addr)
+	x, ok := n.balances[addr]
+	if !ok {
+		x = new(big.Int)
+		n.balances[addr] = x
+	}
+	x.Add(x, v)
+}
+
+// Mines count empty blocks, pending transactions go into the first one
+func (n *Node) Mine(count int) []*Block {
+	n.Lock()
+	defer n.Unlock()
+	var blocks []*Block
+	for i := 0; i < count; i++ {
+		blocks = append(blocks, n.seal(&Block{}))
+	}
+	return blocks
+}
+
+// Appends scripted block to canonical chain, number, parent and hash are filled in
+func (n *Node) MineBlock(b *Block) *Block {
+	n.Lock()
+	defer n.Unlock()
+	return n.seal(b)
+}
+
+// Drops depth blocks from the head and mines count new ones instead.
+// Transactions of dropped blocks return to the pool, dropped blocks stay known by hash.
+func (n *Node) Reorg(depth, count int) []*Block {
+	n.Lock()
+	defer n.Unlock()
+
+	if depth >= len(n.chain) {
+		depth = len(n.chain) - 1
+	}
+	cut := len(n.chain) - depth
+	dropped := append([]*Block(nil), n.chain[cut:]...)
+	n.chain = n.chain[:cut]
+	var txs []*Tx
+	for _, b := range dropped {
+		for _, tx := range b.Txs {
+			tx.block = nil
+			n.addBalance(tx.From, new(big.Int).Mul(big.NewInt(tx.GasUsed), tx.GasPrice))
+			if !tx.Failed {
+				n.addBalance(tx.From, tx.Value)
+				n.addBalance(tx.To, new(big.Int).Neg(tx.Value))
+			}
+			txs = append(txs, tx)
+		}
+	}
+	n.pending = append(txs, n.pending...)
+	n.forks++
+	for i := 0; i < count; i++ {
+		n.seal(&Block{})
+	}
+	return dropped
+}
+
+// Side block at height of the chain, suitable for uncle or orphan scenarios
+func (n *Node) SideBlock(number int64, nonce string) *Block {
+	n.Lock()
+	defer n.Unlock()
+	n.forks++
+	b := &Block{
+		Number:     number,
+		ParentHash: n.chain[number-1].Hash,
+		Nonce:      nonce,
+		Miner:      n.Coinbase,
+		Difficulty: n.Difficulty,
+		Timestamp:  n.chain[number-1].Timestamp + 13,
+	}
+	b.Hash = n.blockHash(b)
+	n.blocks[b.Hash] = b
+	return b
+}
+
+func (n *Node) Head() *Block {
+	n.Lock()
+	defer n.Unlock()
+	return n.head()
+}
+
+func (n *Node) BlockByNumber(number int64) *Block {
+	n.Lock()
+	defer n.Unlock()
+	if number < 0 || number >= int64(len(n.chain)) {
+		return nil
+	}
+	return n.chain[number]
+}
+
+func (n *Node) SetBalance(addr string, wei *big.Int) {
+	n.Lock()
+	defer n.Unlock()
+	n.balances[normalize(addr)] = new(big.Int).Set(wei)
+}
+
+// Makes address a contract
+func (n *Node) SetCode(addr, code string) {
+	n.Lock()
+	defer n.Unlock()
+	n.codes[normalize(addr)] = code
+}
+
+func (n *Node) Balance(addr string) *big.Int {
+	n.Lock()
+	defer n.Unlock()
+	if x, ok := n.balances[normalize(addr)]; ok {
+		return new(big.Int).Set(x)
+	}
+	return new(big.Int)
+}
+
+// Transactions sent to node and not mined yet
+func (n *Node) Pending() []*Tx {
+	n.Lock()
+	defer n.Unlock()
+	return append([]*Tx(nil), n.pending...)
+}
+
+// Evicts pending transactions as if node restarted, their nonces are free again
+func (n *Node) DropPending() []*Tx {
+	n.Lock()
+	defer n.Unlock()
+	dropped := n.pending
+	n.pending = nil
+	for _, tx := range dropped {
+		delete(n.txs, tx.Hash)
+		n.nonces[tx.From]--
+	}
+	return dropped
+}
+
+// Canonical block including transaction, nil while it is pending
+func (n *Node) TxBlock(hash string) *Block {
+	n.Lock()
+	defer n.Unlock()
+	tx, ok := n.txs[strings.ToLower(hash)]
+	if !ok || !n.canonical(tx.block) {
+		return nil
+	}
+	return tx.block
+}
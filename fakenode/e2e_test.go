@@ -0,0 +1,221 @@
+package fakenode_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/cyberpoolorg/etc-stratum/fakenode"
+	"github.com/cyberpoolorg/etc-stratum/payouts"
+	"github.com/cyberpoolorg/etc-stratum/policy"
+	"github.com/cyberpoolorg/etc-stratum/proxy"
+	"github.com/cyberpoolorg/etc-stratum/rpc"
+	"github.com/cyberpoolorg/etc-stratum/storage"
+)
+
+const (
+	e2ePrefix = "e2e"
+	poolAddr  = "0x00000000000000000000000000000000000000aa"
+	minerAddr = "0x00000000000000000000000000000000000000bb"
+)
+
+func newBackend(t *testing.T) *storage.RedisClient {
+	backend := storage.NewRedisClient(&storage.Config{Endpoint: "127.0.0.1:6379", PoolSize: 10}, e2ePrefix)
+	if _, err := backend.Check(); err != nil {
+		t.Skipf("Redis is not available: %v", err)
+	}
+	reset := func() {
+		for _, key := range backend.Client().Keys(e2ePrefix + ":*").Val() {
+			backend.Client().Del(key)
+		}
+	}
+	reset()
+	t.Cleanup(reset)
+	return backend
+}
+
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func call(url, method string, params interface{}, reply interface{}) error {
+	data, _ := json.Marshal(map[string]interface{}{"jsonrpc": "2.0", "id": 1, "method": method, "params": params})
+	resp, err := http.Post(url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var rpcResp struct {
+		Result json.RawMessage
+		Error  *struct{ Message string }
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&rpcResp); err != nil {
+		return err
+	}
+	if rpcResp.Error != nil {
+		return fmt.Errorf("%s: %s", method, rpcResp.Error.Message)
+	}
+	return json.Unmarshal(rpcResp.Result, reply)
+}
+
+// Miner submits a share and a block through HTTP proxy, block is unlocked and paid out
+// Proxy admin reports payouts with read-only processor, nothing is signed or sent
+func TestAdminPayoutsDryRun(t *testing.T) {
+	node := fakenode.New(4, poolAddr)
+	defer node.Close()
+	node.SetBalance(poolAddr, big.NewInt(1e18))
+	cfg := newStratumProxy(t, node, func(cfg *proxy.Config) {
+		cfg.Payouts = payouts.PayoutsConfig{
+			Address:   poolAddr,
+			Upstream:  []rpc.Upstream{{Name: "fake", Url: node.URL, Timeout: "5s"}},
+			AutoGas:   true,
+			Threshold: 500,
+		}
+	})
+	backend := newBackend(t)
+	backend.Client().HIncrBy(e2ePrefix+":miners:"+minerAddr, "balance", 1000)
+
+	var resp *http.Response
+	var err error
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		req, _ := http.NewRequest("GET", "http://"+cfg.Proxy.Admin.Listen+"/admin/payouts/dryrun", nil)
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+		if resp, err = http.DefaultClient.Do(req); err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var report payouts.DryRunReport
+	json.NewDecoder(resp.Body).Decode(&report)
+	if resp.StatusCode != http.StatusOK || len(report.Payouts) != 1 || report.Payouts[0].Login != minerAddr || report.Total != 1000 {
+		t.Fatalf("Must report planned payout, got %v %+v", resp.Status, report)
+	}
+	if balance, _ := backend.GetBalance(minerAddr); balance != 1000 || len(node.Pending()) != 0 || node.Calls("eth_sign") != 0 {
+		t.Error("Dry run must not sign, queue or send payments")
+	}
+}
+
+func TestShareToPayout(t *testing.T) {
+	backend := newBackend(t)
+	node := fakenode.New(4, poolAddr)
+	defer node.Close()
+	node.Mine(20)
+
+	upstream := []rpc.Upstream{{Name: "fake", Url: node.URL, Timeout: "5s"}}
+	network := "classic"
+	cfg := &proxy.Config{
+		Name:                  "e2e",
+		Network:               network,
+		Upstream:              upstream,
+		UpstreamCheckInterval: "1h",
+		Proxy: proxy.Proxy{
+			Enabled:              true,
+			Listen:               freeAddr(t),
+			LimitHeadersSize:     1024,
+			LimitBodySize:        256,
+			BlockRefreshInterval: "1h",
+			StateUpdateInterval:  "1h",
+			HashrateExpiration:   "3h",
+			Difficulty:           1,
+			Policy: policy.Config{
+				Workers:         1,
+				ResetInterval:   "1h",
+				RefreshInterval: "1h",
+				Limits:          policy.Limits{Grace: "1m"},
+				Banning:         policy.Banning{CheckThreshold: 30, InvalidPercent: 30},
+			},
+		},
+	}
+	s := proxy.NewProxy(cfg, backend)
+	go s.Start()
+
+	url := "http://" + cfg.Proxy.Listen + "/" + minerAddr + "/rig1"
+	var work []string
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := call(url, "eth_getWork", []string{}, &work)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Proxy is not serving work: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	height := uint64(node.Head().Number + 1)
+
+	var accepted bool
+	nonce, mixDigest := fakenode.Solve(height, work[0], 1, 4)
+	if err := call(url, "eth_submitWork", []string{nonce, work[0], mixDigest}, &accepted); err != nil || !accepted {
+		t.Fatalf("Share must be accepted: %v", err)
+	}
+	if node.Head().Number != int64(height)-1 {
+		t.Fatal("Share must not be submitted to node")
+	}
+	nonce, mixDigest = fakenode.Solve(height, work[0], 4, 0)
+	if err := call(url, "eth_submitWork", []string{nonce, work[0], mixDigest}, &accepted); err != nil || !accepted {
+		t.Fatalf("Block must be accepted: %v", err)
+	}
+	block := node.BlockByNumber(int64(height))
+	if block == nil || block.Nonce != nonce {
+		t.Fatal("Block must be submitted to node")
+	}
+	candidates, err := backend.GetCandidates(int64(height) + 1)
+	if err != nil || len(candidates) != 1 {
+		t.Fatalf("Expected one block candidate, got %v: %v", len(candidates), err)
+	}
+
+	node.Mine(60)
+	unlocker := payouts.NewBlockUnlocker(&payouts.UnlockerConfig{
+		Enabled:       true,
+		PoolFee:       1.0,
+		Depth:         32,
+		ImmatureDepth: 16,
+		Interval:      "1h",
+		Upstream:      upstream,
+	}, backend, &network)
+	unlocker.Start()
+
+	balance, err := backend.GetBalance(minerAddr)
+	if err != nil || balance != 4950000000 {
+		t.Fatalf("Miner must be credited 4.95 ETC, got %v Shannon: %v", balance, err)
+	}
+
+	node.SetBalance(poolAddr, new(big.Int).Mul(big.NewInt(100), big.NewInt(1e18)))
+	node.UnlockAccount(poolAddr)
+	node.SetAutoMine(true)
+	payer := payouts.NewPayoutsProcessor(&payouts.PayoutsConfig{
+		Enabled:      true,
+		RequirePeers: 1,
+		Interval:     "1h",
+		Address:      poolAddr,
+		AutoGas:      true,
+		Threshold:    1,
+		Upstream:     upstream,
+	}, backend)
+	payer.Start()
+
+	paid := new(big.Int).Mul(big.NewInt(balance), big.NewInt(1e9))
+	if node.Balance(minerAddr).Cmp(paid) != 0 {
+		t.Errorf("Miner must receive %v Wei, got %v", paid, node.Balance(minerAddr))
+	}
+	if balance, _ := backend.GetBalance(minerAddr); balance != 0 {
+		t.Errorf("Balance must be paid out, left %v", strconv.FormatInt(balance, 10))
+	}
+}
@@ -0,0 +1,645 @@
+// Package fakenode runs in-process JSON-RPC server imitating core-geth for tests.
+// Chain is scripted by tests: blocks, uncles, reorgs and failures of particular methods.
+package fakenode
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+const defaultGasPrice = 1000000000
+
+type Node struct {
+	sync.Mutex
+	URL        string
+	Coinbase   string
+	Difficulty int64
+	ChainId    int64
+
+	srv      *httptest.Server
+	chain    []*Block
+	blocks   map[string]*Block
+	pending  []*Tx
+	txs      map[string]*Tx
+	balances map[string]*big.Int
+	nonces   map[string]uint64
+	codes    map[string]string
+	unlocked map[string]bool
+	failures map[string][]Failure
+	calls    map[string]int
+	peers    int64
+	syncing  bool
+	autoMine bool
+	gasPrice *big.Int
+	forks    int64
+	txCount  int64
+}
+
+// Injected failure, applied to next calls of a method
+type Failure struct {
+	// Reply with this HTTP status and no JSON
+	Status int
+	// Reply with JSON-RPC error
+	Code    int
+	Message string
+	// Hold reply, e.g. longer than client timeout
+	Delay time.Duration
+	// Close connection without reply
+	Drop bool
+}
+
+type request struct {
+	Id     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// Starts node with genesis block, coinbase receives mined blocks and submitted work
+func New(difficulty int64, coinbase string) *Node {
+	n := &Node{
+		Coinbase:   normalize(coinbase),
+		Difficulty: difficulty,
+		ChainId:    61,
+		blocks:     make(map[string]*Block),
+		txs:        make(map[string]*Tx),
+		balances:   make(map[string]*big.Int),
+		nonces:     make(map[string]uint64),
+		codes:      make(map[string]string),
+		unlocked:   make(map[string]bool),
+		failures:   make(map[string][]Failure),
+		calls:      make(map[string]int),
+		peers:      25,
+		gasPrice:   big.NewInt(defaultGasPrice),
+	}
+	genesis := &Block{Nonce: "0x0000000000000042", Difficulty: difficulty, Timestamp: 1000000000}
+	genesis.Hash = n.blockHash(genesis)
+	n.chain = []*Block{genesis}
+	n.blocks[genesis.Hash] = genesis
+	n.srv = httptest.NewServer(n)
+	n.URL = n.srv.URL
+	return n
+}
+
+func (n *Node) Close() {
+	n.srv.Close()
+}
+
+// Fails next times calls of method, "*" matches any method
+func (n *Node) Fail(method string, times int, f Failure) {
+	n.Lock()
+	defer n.Unlock()
+	for i := 0; i < times; i++ {
+		n.failures[method] = append(n.failures[method], f)
+	}
+}
+
+// Number of calls of method received, including failed ones
+func (n *Node) Calls(method string) int {
+	n.Lock()
+	defer n.Unlock()
+	return n.calls[method]
+}
+
+func (n *Node) SetPeers(peers int64) {
+	n.Lock()
+	n.peers = peers
+	n.Unlock()
+}
+
+func (n *Node) SetSyncing(syncing bool) {
+	n.Lock()
+	n.syncing = syncing
+	n.Unlock()
+}
+
+// Mine a block right after every sent transaction
+func (n *Node) SetAutoMine(autoMine bool) {
+	n.Lock()
+	n.autoMine = autoMine
+	n.Unlock()
+}
+
+func (n *Node) SetGasPrice(wei *big.Int) {
+	n.Lock()
+	n.gasPrice = new(big.Int).Set(wei)
+	n.Unlock()
+}
+
+// Allows eth_sign and eth_sendTransaction from address
+func (n *Node) UnlockAccount(addr string) {
+	n.Lock()
+	n.unlocked[normalize(addr)] = true
+	n.Unlock()
+}
+
+func (n *Node) takeFailure(method string) *Failure {
+	n.calls[method]++
+	for _, key := range []string{method, "*"} {
+		if list := n.failures[key]; len(list) > 0 {
+			n.failures[key] = list[1:]
+			return &list[0]
+		}
+	}
+	return nil
+}
+
+func (n *Node) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return
+	}
+	batch := len(body) > 0 && bytes.TrimSpace(body)[0] == '['
+	var reqs []request
+	if batch {
+		err = json.Unmarshal(body, &reqs)
+	} else {
+		var req request
+		err = json.Unmarshal(body, &req)
+		reqs = append(reqs, req)
+	}
+	if err != nil {
+		http.Error(w, "malformed request", http.StatusBadRequest)
+		return
+	}
+
+	n.Lock()
+	failures := make([]*Failure, len(reqs))
+	for i, req := range reqs {
+		failures[i] = n.takeFailure(req.Method)
+	}
+	n.Unlock()
+
+	// Transport failures apply to whole HTTP request
+	for _, f := range failures {
+		if f == nil {
+			continue
+		}
+		time.Sleep(f.Delay)
+		if f.Drop {
+			if hj, ok := w.(http.Hijacker); ok {
+				conn, _, _ := hj.Hijack()
+				conn.Close()
+			}
+			return
+		}
+		if f.Status != 0 {
+			http.Error(w, http.StatusText(f.Status), f.Status)
+			return
+		}
+	}
+
+	replies := make([]map[string]interface{}, len(reqs))
+	for i, req := range reqs {
+		reply := map[string]interface{}{"jsonrpc": "2.0", "id": req.Id}
+		var result interface{}
+		var rpcErr *rpcError
+		if f := failures[i]; f != nil && f.Code != 0 {
+			rpcErr = &rpcError{f.Code, f.Message}
+		} else {
+			result, rpcErr = n.dispatch(req.Method, req.Params)
+		}
+		if rpcErr != nil {
+			reply["error"] = rpcErr
+		} else {
+			reply["result"] = result
+		}
+		replies[i] = reply
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if batch {
+		json.NewEncoder(w).Encode(replies)
+	} else {
+		json.NewEncoder(w).Encode(replies[0])
+	}
+}
+
+func (n *Node) dispatch(method string, raw json.RawMessage) (interface{}, *rpcError) {
+	var params []interface{}
+	if len(raw) > 0 && string(raw) != "null" {
+		if err := json.Unmarshal(raw, &params); err != nil {
+			return nil, &rpcError{-32602, "invalid params: " + err.Error()}
+		}
+	}
+	str := func(i int) string {
+		if i < len(params) {
+			s, _ := params[i].(string)
+			return s
+		}
+		return ""
+	}
+	flag := func(i int) bool {
+		if i < len(params) {
+			b, _ := params[i].(bool)
+			return b
+		}
+		return false
+	}
+
+	n.Lock()
+	defer n.Unlock()
+
+	switch method {
+	case "eth_getWork":
+		return n.getWork(), nil
+	case "eth_submitWork":
+		return n.submitWork(str(0), str(1), str(2)), nil
+	case "eth_submitHashrate":
+		return true, nil
+	case "eth_blockNumber":
+		return hexInt(n.head().Number), nil
+	case "eth_syncing":
+		if n.syncing {
+			return map[string]string{"currentBlock": hexInt(n.head().Number), "highestBlock": hexInt(n.head().Number + 100)}, nil
+		}
+		return false, nil
+	case "net_peerCount":
+		return hexInt(n.peers), nil
+	case "eth_gasPrice":
+		return hexBig(n.gasPrice), nil
+	case "eth_getBlockByNumber":
+		if str(0) == "pending" {
+			return n.pendingJSON(), nil
+		}
+		b := n.blockByTag(str(0))
+		if b == nil {
+			return nil, nil
+		}
+		return n.blockJSON(b, flag(1)), nil
+	case "eth_getBlockByHash":
+		b, ok := n.blocks[strings.ToLower(str(0))]
+		if !ok {
+			return nil, nil
+		}
+		return n.blockJSON(b, flag(1)), nil
+	case "eth_getUncleByBlockNumberAndIndex":
+		b := n.blockByTag(str(0))
+		index, err := parseHex(str(1))
+		if b == nil || err != nil || index >= int64(len(b.Uncles)) {
+			return nil, nil
+		}
+		return n.blockJSON(b.Uncles[index], false), nil
+	case "eth_getTransactionByHash":
+		tx, ok := n.txs[strings.ToLower(str(0))]
+		if !ok {
+			return nil, nil
+		}
+		return n.txJSON(tx), nil
+	case "eth_getTransactionReceipt":
+		tx, ok := n.txs[strings.ToLower(str(0))]
+		if !ok || !n.canonical(tx.block) {
+			return nil, nil
+		}
+		status := "0x1"
+		if tx.Failed {
+			status = "0x0"
+		}
+		return map[string]interface{}{
+			"transactionHash":   tx.Hash,
+			"blockHash":         tx.block.Hash,
+			"blockNumber":       hexInt(tx.block.Number),
+			"gasUsed":           hexInt(tx.GasUsed),
+			"effectiveGasPrice": hexBig(tx.GasPrice),
+			"status":            status,
+		}, nil
+	case "eth_getBalance":
+		if x, ok := n.balances[normalize(str(0))]; ok {
+			return hexBig(x), nil
+		}
+		return "0x0", nil
+	case "eth_getCode":
+		if code, ok := n.codes[normalize(str(0))]; ok {
+			return code, nil
+		}
+		return "0x", nil
+	case "eth_sign":
+		if !n.unlocked[normalize(str(0))] {
+			return nil, &rpcError{-32000, "authentication needed: password or unlock"}
+		}
+		return "0x" + strings.Repeat("ab", 65), nil
+	case "eth_sendTransaction":
+		if len(params) == 0 {
+			return nil, &rpcError{-32602, "missing value for required argument 0"}
+		}
+		args, _ := params[0].(map[string]interface{})
+		return n.sendTransaction(args)
+	case "eth_sendRawTransaction":
+		return n.sendRawTransaction(str(0))
+	case "eth_getTransactionCount":
+		from := normalize(str(0))
+		nonce := n.nonces[from]
+		if str(1) != "pending" {
+			for _, tx := range n.pending {
+				if tx.From == from {
+					nonce--
+				}
+			}
+		}
+		return hexInt(int64(nonce)), nil
+	case "eth_chainId":
+		return hexInt(n.ChainId), nil
+	}
+	return nil, &rpcError{-32601, fmt.Sprintf("the method %s does not exist/is not available", method)}
+}
+
+// Must be called with lock held
+func (n *Node) canonical(b *Block) bool {
+	return b != nil && b.Number < int64(len(n.chain)) && n.chain[b.Number] == b
+}
+
+// Must be called with lock held
+func (n *Node) blockByTag(tag string) *Block {
+	switch tag {
+	case "latest", "":
+		return n.head()
+	case "earliest":
+		return n.chain[0]
+	}
+	number, err := parseHex(tag)
+	if err != nil || number >= int64(len(n.chain)) {
+		return nil
+	}
+	return n.chain[number]
+}
+
+// Must be called with lock held
+func (n *Node) workHeader() string {
+	head := n.head()
+	return n.blockHash(&Block{Number: head.Number + 1, ParentHash: head.Hash, Nonce: "work"})
+}
+
+// Must be called with lock held
+func (n *Node) getWork() []string {
+	target := new(big.Int).Div(new(big.Int).Lsh(big.NewInt(1), 256), big.NewInt(n.Difficulty))
+	return []string{
+		n.workHeader(),
+		"0x" + strings.Repeat("0", 64),
+		fmt.Sprintf("0x%064x", target),
+		hexInt(n.head().Number + 1),
+	}
+}
+
+// Accepts any solution of current work, sealed block is mined by coinbase
+func (n *Node) submitWork(nonce, header, mixDigest string) bool {
+	if !strings.EqualFold(header, n.workHeader()) {
+		return false
+	}
+	n.seal(&Block{Nonce: strings.ToLower(nonce), MixDigest: strings.ToLower(mixDigest)})
+	return true
+}
+
+// Must be called with lock held
+func (n *Node) sendTransaction(args map[string]interface{}) (interface{}, *rpcError) {
+	get := func(key string) string {
+		s, _ := args[key].(string)
+		return s
+	}
+	from := normalize(get("from"))
+	if !n.unlocked[from] {
+		return nil, &rpcError{-32000, "authentication needed: password or unlock"}
+	}
+	value, err := parseBig(get("value"))
+	if err != nil {
+		return nil, &rpcError{-32602, "invalid value"}
+	}
+	gas := int64(21000)
+	if s := get("gas"); len(s) > 0 {
+		if gas, err = parseHex(s); err != nil {
+			return nil, &rpcError{-32602, "invalid gas"}
+		}
+	}
+	gasPrice := new(big.Int).Set(n.gasPrice)
+	if s := get("gasPrice"); len(s) > 0 {
+		if gasPrice, err = parseBig(s); err != nil {
+			return nil, &rpcError{-32602, "invalid gasPrice"}
+		}
+	}
+	nonce := n.nonces[from]
+	var replaced *Tx
+	if s := get("nonce"); len(s) > 0 {
+		x, err := parseHex(s)
+		if err != nil {
+			return nil, &rpcError{-32602, "invalid nonce"}
+		}
+		nonce = uint64(x)
+		var e *rpcError
+		if replaced, e = n.checkNonce(from, nonce, gasPrice); e != nil {
+			return nil, e
+		}
+	}
+	cost := new(big.Int).Mul(big.NewInt(gas), gasPrice)
+	cost.Add(cost, value)
+	balance, ok := n.balances[from]
+	if !ok || balance.Cmp(cost) < 0 {
+		return nil, &rpcError{-32000, "insufficient funds for gas * price + value"}
+	}
+
+	tx := &Tx{
+		From:     from,
+		To:       normalize(get("to")),
+		Value:    value,
+		Nonce:    nonce,
+		Gas:      gas,
+		GasPrice: gasPrice,
+	}
+	return n.acceptTx(tx, replaced), nil
+}
+
+// Unlike real node transactions with future nonce are rejected instead of queued
+func (n *Node) sendRawTransaction(data string) (interface{}, *rpcError) {
+	raw := new(types.Transaction)
+	if err := raw.UnmarshalBinary(common.FromHex(data)); err != nil {
+		return nil, &rpcError{-32000, "rlp: " + err.Error()}
+	}
+	if !raw.Protected() || raw.ChainId().Int64() != n.ChainId {
+		return nil, &rpcError{-32000, "invalid sender"}
+	}
+	sender, err := types.Sender(types.NewEIP155Signer(big.NewInt(n.ChainId)), raw)
+	if err != nil {
+		return nil, &rpcError{-32000, "invalid sender"}
+	}
+	if _, ok := n.txs[raw.Hash().Hex()]; ok {
+		return nil, &rpcError{-32000, "already known"}
+	}
+	from := normalize(sender.Hex())
+	replaced, e := n.checkNonce(from, raw.Nonce(), raw.GasPrice())
+	if e != nil {
+		return nil, e
+	}
+	balance, ok := n.balances[from]
+	if !ok || balance.Cmp(raw.Cost()) < 0 {
+		return nil, &rpcError{-32000, "insufficient funds for gas * price + value"}
+	}
+	var to string
+	if raw.To() != nil {
+		to = normalize(raw.To().Hex())
+	}
+	tx := &Tx{
+		Hash:     raw.Hash().Hex(),
+		From:     from,
+		To:       to,
+		Value:    raw.Value(),
+		Nonce:    raw.Nonce(),
+		Gas:      int64(raw.Gas()),
+		GasPrice: raw.GasPrice(),
+	}
+	return n.acceptTx(tx, replaced), nil
+}
+
+// Pending transaction with the same nonce is replaced if gas price is at least 10% higher
+// Must be called with lock held
+func (n *Node) checkNonce(from string, nonce uint64, gasPrice *big.Int) (*Tx, *rpcError) {
+	if nonce > n.nonces[from] {
+		return nil, &rpcError{-32000, "nonce too high"}
+	}
+	if nonce == n.nonces[from] {
+		return nil, nil
+	}
+	for _, tx := range n.pending {
+		if tx.From != from || tx.Nonce != nonce {
+			continue
+		}
+		min := new(big.Int).Div(new(big.Int).Mul(tx.GasPrice, big.NewInt(110)), big.NewInt(100))
+		if gasPrice.Cmp(min) < 0 {
+			return nil, &rpcError{-32000, "replacement transaction underpriced"}
+		}
+		return tx, nil
+	}
+	return nil, &rpcError{-32000, "nonce too low"}
+}
+
+// Must be called with lock held
+func (n *Node) acceptTx(tx *Tx, replaced *Tx) string {
+	n.addTx(tx)
+	if replaced != nil {
+		delete(n.txs, replaced.Hash)
+		for i, pending := range n.pending {
+			if pending == replaced {
+				n.pending[i] = tx
+			}
+		}
+	} else {
+		n.nonces[tx.From]++
+		n.pending = append(n.pending, tx)
+	}
+	if n.autoMine {
+		n.seal(&Block{})
+	}
+	return tx.Hash
+}
+
+// Must be called with lock held
+func (n *Node) pendingJSON() map[string]interface{} {
+	head := n.head()
+	return map[string]interface{}{
+		"number":       hexInt(head.Number + 1),
+		"parentHash":   head.Hash,
+		"difficulty":   hexInt(n.Difficulty),
+		"timestamp":    hexInt(head.Timestamp + 13),
+		"transactions": []string{},
+		"uncles":       []string{},
+	}
+}
+
+// Must be called with lock held
+func (n *Node) blockJSON(b *Block, full bool) map[string]interface{} {
+	var gasUsed int64
+	txs := make([]interface{}, len(b.Txs))
+	for i, tx := range b.Txs {
+		gasUsed += tx.GasUsed
+		if full {
+			txs[i] = n.txJSON(tx)
+		} else {
+			txs[i] = tx.Hash
+		}
+	}
+	uncles := make([]string, len(b.Uncles))
+	for i, uncle := range b.Uncles {
+		uncles[i] = uncle.Hash
+	}
+	mixDigest := b.MixDigest
+	if len(mixDigest) == 0 {
+		mixDigest = "0x" + strings.Repeat("0", 64)
+	}
+	return map[string]interface{}{
+		"number":       hexInt(b.Number),
+		"hash":         b.Hash,
+		"parentHash":   b.ParentHash,
+		"nonce":        b.Nonce,
+		"mixHash":      mixDigest,
+		"miner":        b.Miner,
+		"difficulty":   hexInt(b.Difficulty),
+		"gasLimit":     "0x7a1200",
+		"gasUsed":      hexInt(gasUsed),
+		"timestamp":    hexInt(b.Timestamp),
+		"transactions": txs,
+		"uncles":       uncles,
+	}
+}
+
+// Must be called with lock held
+func (n *Node) txJSON(tx *Tx) map[string]interface{} {
+	reply := map[string]interface{}{
+		"hash":        tx.Hash,
+		"from":        tx.From,
+		"to":          tx.To,
+		"value":       hexBig(tx.Value),
+		"nonce":       hexInt(int64(tx.Nonce)),
+		"gas":         hexInt(tx.Gas),
+		"gasPrice":    hexBig(tx.GasPrice),
+		"blockHash":   nil,
+		"blockNumber": nil,
+	}
+	if n.canonical(tx.block) {
+		reply["blockHash"] = tx.block.Hash
+		reply["blockNumber"] = hexInt(tx.block.Number)
+	}
+	return reply
+}
+
+func normalize(addr string) string {
+	return strings.ToLower(addr)
+}
+
+func hexInt(x int64) string {
+	return fmt.Sprintf("0x%x", x)
+}
+
+func hexBig(x *big.Int) string {
+	return fmt.Sprintf("0x%x", x)
+}
+
+func parseHex(s string) (int64, error) {
+	x, err := parseBig(s)
+	if err != nil {
+		return 0, err
+	}
+	return x.Int64(), nil
+}
+
+func parseBig(s string) (*big.Int, error) {
+	if s == "" || s == "0x" {
+		return new(big.Int), nil
+	}
+	x, ok := new(big.Int).SetString(strings.TrimPrefix(s, "0x"), 16)
+	if !ok {
+		return nil, fmt.Errorf("invalid hex number %q", s)
+	}
+	return x, nil
+}
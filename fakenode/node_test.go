@@ -0,0 +1,133 @@
+package fakenode
+
+import (
+	"context"
+	"math/big"
+	"net/http"
+	"testing"
+
+	"github.com/cyberpoolorg/etc-stratum/rpc"
+)
+
+const coinbase = "0x0000000000000000000000000000000000000001"
+
+func TestChain(t *testing.T) {
+	n := New(1000, coinbase)
+	defer n.Close()
+	r := rpc.NewRPCClient("test", n.URL, "5s", nil)
+	ctx := context.Background()
+
+	n.Mine(10)
+	work, err := r.GetWork(ctx)
+	if err != nil || len(work) != 4 || work[3] != "0xb" {
+		t.Fatalf("Unexpected work %v: %v", work, err)
+	}
+	ok, err := r.SubmitBlock(ctx, []string{"0x00000000000000ff", work[0], "0x" + work[0][4:] + "00"})
+	if err != nil || !ok {
+		t.Fatalf("Work must be accepted: %v", err)
+	}
+	block, _ := r.GetBlockByHeight(ctx, 11)
+	if block == nil || block.Nonce != "0x00000000000000ff" || block.Miner != coinbase {
+		t.Fatalf("Must mine submitted work, got %+v", block)
+	}
+	if ok, _ := r.SubmitBlock(ctx, []string{"0x1", work[0], work[0]}); ok {
+		t.Error("Must reject stale work")
+	}
+
+	uncle := n.SideBlock(11, "0x00000000000000fe")
+	n.MineBlock(&Block{Uncles: []*Block{uncle}})
+	reply, _ := r.GetUncleByBlockNumberAndIndex(ctx, 12, 0)
+	if reply == nil || reply.Hash != uncle.Hash || reply.Nonce != uncle.Nonce {
+		t.Errorf("Must return uncle, got %+v", reply)
+	}
+
+	dropped := n.Reorg(2, 3)
+	if len(dropped) != 2 || n.Head().Number != 13 {
+		t.Fatalf("Unexpected chain after reorg, head %v", n.Head().Number)
+	}
+	block, _ = r.GetBlockByHeight(ctx, 11)
+	if block.Hash == dropped[0].Hash {
+		t.Error("Reorg must replace blocks")
+	}
+	block, _ = r.GetBlockByHash(ctx, dropped[0].Hash)
+	if block == nil {
+		t.Error("Dropped blocks must stay known by hash")
+	}
+}
+
+func TestTransactions(t *testing.T) {
+	n := New(1000, coinbase)
+	defer n.Close()
+	r := rpc.NewRPCClient("test", n.URL, "5s", nil)
+	ctx := context.Background()
+	from, to := "0x00000000000000000000000000000000000000aa", "0x00000000000000000000000000000000000000bb"
+
+	if _, err := r.SendTransaction(ctx, from, to, "", "", "0x1", "", true); !rpc.IsRPCError(err) {
+		t.Errorf("Locked account must be rejected, got %v", err)
+	}
+	n.UnlockAccount(from)
+	if _, err := r.SendTransaction(ctx, from, to, "", "", "0x1", "", true); !rpc.IsRPCError(err) {
+		t.Errorf("Must reject tx without funds, got %v", err)
+	}
+
+	n.SetBalance(from, big.NewInt(1e18))
+	hash, err := r.SendTransaction(ctx, from, to, "", "", "0x100", "", true)
+	if err != nil {
+		t.Fatalf("Tx must be sent: %v", err)
+	}
+	if receipt, _ := r.GetTxReceipt(ctx, hash); receipt != nil {
+		t.Error("Pending tx must have no receipt")
+	}
+	n.Mine(1)
+	receipt, _ := r.GetTxReceipt(ctx, hash)
+	if receipt == nil || !receipt.Confirmed() || !receipt.Successful() {
+		t.Fatalf("Mined tx must have receipt, got %+v", receipt)
+	}
+	if n.Balance(to).Int64() != 0x100 {
+		t.Errorf("Value must be transferred, got %v", n.Balance(to))
+	}
+
+	n.Reorg(1, 0)
+	if receipt, _ := r.GetTxReceipt(ctx, hash); receipt != nil || len(n.Pending()) != 1 {
+		t.Error("Reorged tx must return to pending")
+	}
+	if n.Balance(to).Sign() != 0 || n.Balance(from).Cmp(big.NewInt(1e18)) != 0 {
+		t.Error("Reorg must revert balances")
+	}
+}
+
+func TestFailures(t *testing.T) {
+	n := New(1000, coinbase)
+	defer n.Close()
+	r := rpc.NewRPCClient("test", n.URL, "5s", nil)
+	ctx := context.Background()
+
+	n.Fail("net_peerCount", 1, Failure{Status: http.StatusBadGateway})
+	if _, err := r.GetPeerCount(ctx); err != nil {
+		t.Errorf("Transport failure must be retried: %v", err)
+	}
+	if n.Calls("net_peerCount") != 2 {
+		t.Errorf("Expected 2 calls, got %v", n.Calls("net_peerCount"))
+	}
+
+	n.Fail("eth_getBalance", 1, Failure{Code: -32000, Message: "boom"})
+	if _, err := r.GetBalance(ctx, coinbase); !rpc.IsRPCError(err) {
+		t.Errorf("Must reply with RPC error, got %v", err)
+	}
+
+	n.Fail("*", 1, Failure{Drop: true})
+	if _, err := r.SubmitBlock(ctx, []string{"0x1", "0x2", "0x3"}); !rpc.IsTemporary(err) {
+		t.Errorf("Dropped connection must be temporary error, got %v", err)
+	}
+
+	n.Mine(3)
+	blocks := make([]*rpc.GetBlockReply, 2)
+	batch := []rpc.BatchElem{rpc.BlockByHeightRequest(1, &blocks[0]), rpc.BlockByHeightRequest(3, &blocks[1])}
+	n.Fail("eth_getBlockByNumber", 1, Failure{Code: -32000, Message: "missing trie node"})
+	if err := r.BatchCall(ctx, batch); err != nil {
+		t.Fatalf("Batch failed: %v", err)
+	}
+	if batch[0].Error == nil || blocks[1] == nil || blocks[1].Number != "0x3" {
+		t.Error("Failure must apply to single batch element")
+	}
+}
@@ -0,0 +1,50 @@
+package fakenode
+
+import (
+	"fmt"
+	"math/big"
+	"strconv"
+	"sync"
+
+	"github.com/cyberpoolorg/go-etchash"
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var (
+	hasherOnce sync.Once
+	hasher     *etchash.Etchash
+	// Same activation as classic network in proxy
+	ecip1099FBlock uint64 = 11700000
+	maxUint256            = new(big.Int).Lsh(big.NewInt(1), 256)
+)
+
+// Finds valid nonce and mix digest for work at height. Result must meet difficulty,
+// when maxDifficulty is set it must not meet that one, e.g. share which is not a block.
+func Solve(height uint64, header string, difficulty, maxDifficulty int64) (string, string) {
+	return SolvePrefix(height, header, "", difficulty, maxDifficulty)
+}
+
+// Same as Solve with nonce starting with hex prefix, e.g. extranonce of NiceHash session
+func SolvePrefix(height uint64, header, prefix string, difficulty, maxDifficulty int64) (string, string) {
+	hasherOnce.Do(func() {
+		hasher = etchash.New(&ecip1099FBlock, nil)
+	})
+	target := new(big.Int).Div(maxUint256, big.NewInt(difficulty))
+	var limit *big.Int
+	if maxDifficulty > 0 {
+		limit = new(big.Int).Div(maxUint256, big.NewInt(maxDifficulty))
+	}
+	hash := common.HexToHash(header)
+	var start uint64
+	if len(prefix) > 0 {
+		start, _ = strconv.ParseUint(prefix, 16, 64)
+		start <<= 64 - 4*uint(len(prefix))
+	}
+	for nonce := start; ; nonce++ {
+		mixDigest, result := hasher.Compute(height, hash, nonce)
+		x := result.Big()
+		if x.Cmp(target) <= 0 && (limit == nil || x.Cmp(limit) > 0) {
+			return fmt.Sprintf("0x%016x", nonce), mixDigest.Hex()
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package fakenode_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cyberpoolorg/etc-stratum/fakenode"
+	"github.com/cyberpoolorg/etc-stratum/policy"
+	"github.com/cyberpoolorg/etc-stratum/proxy"
+	"github.com/cyberpoolorg/etc-stratum/rpc"
+)
+
+const adminToken = "secret"
+
+type stratumMessage struct {
+	Id     json.RawMessage
+	Method string
+	Params json.RawMessage
+	Result json.RawMessage
+	Error  *struct{ Message string }
+}
+
+type stratumClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newStratumProxy(t *testing.T, node *fakenode.Node, setup ...func(*proxy.Config)) *proxy.Config {
+	cfg := &proxy.Config{
+		Name:                  "e2e",
+		Network:               "classic",
+		Upstream:              []rpc.Upstream{{Name: "fake", Url: node.URL, Timeout: "5s"}},
+		UpstreamCheckInterval: "1h",
+		Proxy: proxy.Proxy{
+			Enabled:              true,
+			BlockRefreshInterval: "1h",
+			StateUpdateInterval:  "1h",
+			HashrateExpiration:   "3h",
+			Difficulty:           1,
+			Stratum:              proxy.Stratum{Enabled: true, Listen: freeAddr(t), Timeout: "1m", MaxConn: 16, ResumeTimeout: "5m"},
+			Admin:                proxy.Admin{Enabled: true, Listen: freeAddr(t), Token: adminToken},
+			Policy: policy.Config{
+				Workers:         1,
+				ResetInterval:   "1h",
+				RefreshInterval: "1h",
+				Limits:          policy.Limits{Grace: "1m"},
+				Banning:         policy.Banning{CheckThreshold: 30, InvalidPercent: 30},
+			},
+		},
+	}
+	for _, f := range setup {
+		f(cfg)
+	}
+	proxy.NewProxy(cfg, newBackend(t))
+	return cfg
+}
+
+func dialStratum(t *testing.T, addr string) *stratumClient {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			t.Cleanup(func() { conn.Close() })
+			return &stratumClient{t: t, conn: conn, reader: bufio.NewReader(conn)}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Stratum is not listening: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (c *stratumClient) send(id int, method string, params interface{}) {
+	data, _ := json.Marshal(map[string]interface{}{"id": id, "method": method, "params": params})
+	if _, err := c.conn.Write(append(data, '\n')); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// Reads until reply to id or notification with method arrives
+func (c *stratumClient) expect(id int, method string) *stratumMessage {
+	c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for {
+		line, err := c.reader.ReadBytes('\n')
+		if err != nil {
+			c.t.Fatalf("Expected %v %q: %v", id, method, err)
+		}
+		var msg stratumMessage
+		if err := json.Unmarshal(line, &msg); err != nil {
+			c.t.Fatal(err)
+		}
+		if len(method) > 0 && msg.Method == method {
+			return &msg
+		}
+		if len(method) == 0 && len(msg.Method) == 0 && string(msg.Id) == strconv.Itoa(id) {
+			return &msg
+		}
+	}
+}
+
+func (c *stratumClient) call(id int, method string, params interface{}, reply interface{}) {
+	c.send(id, method, params)
+	msg := c.expect(id, "")
+	if msg.Error != nil {
+		c.t.Fatalf("%s failed: %s", method, msg.Error.Message)
+	}
+	if err := json.Unmarshal(msg.Result, reply); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func adminPost(t *testing.T, cfg *proxy.Config, path string, cmd *proxy.AdminCommand) {
+	data, _ := json.Marshal(cmd)
+	req, _ := http.NewRequest("POST", "http://"+cfg.Proxy.Admin.Listen+path, bytes.NewReader(data))
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Admin %s failed with %v", path, resp.Status)
+	}
+}
+
+// Miner subscribing with EthereumStratum mines and receives client.* notifications
+func TestNiceHashSession(t *testing.T) {
+	node := fakenode.New(4, poolAddr)
+	defer node.Close()
+	node.Mine(20)
+	cfg := newStratumProxy(t, node)
+	c := dialStratum(t, cfg.Proxy.Stratum.Listen)
+
+	_, extranonce := c.subscribe()
+	if len(extranonce) != 4 {
+		t.Fatalf("Unexpected extranonce %v", extranonce)
+	}
+	var authorized bool
+	c.call(2, "mining.authorize", []string{minerAddr + ".rig1", "x"}, &authorized)
+	if !authorized {
+		t.Fatal("Miner must be authorized")
+	}
+	c.expect(0, "mining.set_difficulty")
+	var job []interface{}
+	json.Unmarshal(c.expect(0, "mining.notify").Params, &job)
+	if len(job) != 4 {
+		t.Fatalf("Unexpected job %v", job)
+	}
+
+	header := job[0].(string)
+	nonce, _ := fakenode.SolvePrefix(uint64(node.Head().Number+1), "0x"+header, extranonce, 1, 4)
+	var accepted bool
+	c.call(3, "mining.submit", []string{minerAddr + ".rig1", header, strings.TrimPrefix(nonce, "0x"+extranonce)}, &accepted)
+	if !accepted {
+		t.Fatal("Share must be accepted")
+	}
+
+	adminPost(t, cfg, "/admin/message", &proxy.AdminCommand{Message: "Maintenance"})
+	var message []string
+	json.Unmarshal(c.expect(0, "client.show_message").Params, &message)
+	if len(message) != 1 || message[0] != "Maintenance" {
+		t.Errorf("Unexpected message %v", message)
+	}
+	adminPost(t, cfg, "/admin/reconnect", &proxy.AdminCommand{Host: "eu2.example.org", Port: 8008})
+	var reconnect []interface{}
+	json.Unmarshal(c.expect(0, "client.reconnect").Params, &reconnect)
+	if len(reconnect) != 3 || reconnect[0] != "eu2.example.org" {
+		t.Errorf("Unexpected reconnect %v", reconnect)
+	}
+}
+
+func (c *stratumClient) subscribe(params ...string) (string, string) {
+	var reply []json.RawMessage
+	c.call(1, "mining.subscribe", append([]string{"test/1.0", "EthereumStratum/1.0.0"}, params...), &reply)
+	var notify []string
+	var extranonce string
+	if len(reply) != 2 || json.Unmarshal(reply[0], &notify) != nil || len(notify) != 3 || json.Unmarshal(reply[1], &extranonce) != nil {
+		c.t.Fatalf("Unexpected subscribe reply %s", reply)
+	}
+	return notify[1], extranonce
+}
+
+// Reconnecting miner presents session ID and continues with its extranonce and counters
+func TestResumeSession(t *testing.T) {
+	node := fakenode.New(4, poolAddr)
+	defer node.Close()
+	node.Mine(20)
+	cfg := newStratumProxy(t, node)
+	c := dialStratum(t, cfg.Proxy.Stratum.Listen)
+
+	id, extranonce := c.subscribe()
+	var ok bool
+	c.call(2, "mining.authorize", []string{minerAddr + ".rig1", "x"}, &ok)
+	var job []interface{}
+	json.Unmarshal(c.expect(0, "mining.notify").Params, &job)
+	header := job[0].(string)
+	nonce, _ := fakenode.SolvePrefix(uint64(node.Head().Number+1), "0x"+header, extranonce, 1, 4)
+	c.call(3, "mining.submit", []string{minerAddr + ".rig1", header, strings.TrimPrefix(nonce, "0x"+extranonce)}, &ok)
+	if !ok {
+		t.Fatal("Share must be accepted")
+	}
+	c.conn.Close()
+
+	// Session is saved once proxy notices disconnect
+	var resumedID, resumedExtranonce string
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c = dialStratum(t, cfg.Proxy.Stratum.Listen)
+		resumedID, resumedExtranonce = c.subscribe(id)
+		if resumedID == id || time.Now().After(deadline) {
+			break
+		}
+		c.conn.Close()
+		time.Sleep(50 * time.Millisecond)
+	}
+	if resumedID != id || resumedExtranonce != extranonce {
+		t.Fatalf("Session %v/%v must be resumed, got %v/%v", id, extranonce, resumedID, resumedExtranonce)
+	}
+	c.call(2, "mining.authorize", []string{minerAddr + ".rig1", "x"}, &ok)
+
+	req, _ := http.NewRequest("GET", "http://"+cfg.Proxy.Admin.Listen+"/admin/sessions?login="+minerAddr, nil)
+	req.Header.Set("Authorization", "Bearer "+adminToken)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var sessions struct {
+		List []struct {
+			Id          string
+			ValidShares int64
+		}
+	}
+	json.NewDecoder(resp.Body).Decode(&sessions)
+	if len(sessions.List) != 1 || sessions.List[0].Id != id || sessions.List[0].ValidShares != 1 {
+		t.Errorf("Resumed session must keep share counters, got %+v", sessions.List)
+	}
+}
@@ -76,6 +76,15 @@ func main() {
 	readConfig(&cfg)
 	rand.Seed(time.Now().UnixNano())
 
+	// etc-stratum config.json admin <command> [flags]
+	if len(os.Args) > 2 && os.Args[2] == "admin" {
+		if len(os.Args) < 4 {
+			log.Fatal("Admin command is required")
+		}
+		runCommand(os.Args[3:])
+		return
+	}
+
 	if cfg.Threads > 0 {
 		runtime.GOMAXPROCS(cfg.Threads)
 		log.Printf("Running with %v threads", cfg.Threads)
@@ -0,0 +1,162 @@
+package payouts
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+
+	"github.com/cyberpoolorg/etc-stratum/rpc"
+	"github.com/cyberpoolorg/etc-stratum/storage"
+	"github.com/cyberpoolorg/etc-stratum/util"
+)
+
+type PlannedPayout struct {
+	Login   string `json:"login"`
+	Address string `json:"address"`
+	// Shannon
+	Amount    int64 `json:"amount"`
+	Threshold int64 `json:"threshold"`
+}
+
+// Amounts of payouts are in Shannon, gas and balances in Wei
+type DryRunReport struct {
+	Payouts      []PlannedPayout `json:"payouts"`
+	Total        int64           `json:"total"`
+	Runs         int             `json:"runs"`
+	GasPrice     string          `json:"gasPrice"`
+	EstimatedFee string          `json:"estimatedFee"`
+	PoolBalance  string          `json:"poolBalance"`
+	Shortfall    string          `json:"shortfall"`
+	Problems     []string        `json:"problems"`
+}
+
+// Payouts next runs would send, nothing is locked, queued or sent
+func DryRun(ctx context.Context, cfg *PayoutsConfig, backend *storage.RedisClient) (*DryRunReport, error) {
+	u, err := NewDryRunProcessor(cfg, backend)
+	if err != nil {
+		return nil, err
+	}
+	return u.DryRun(ctx)
+}
+
+// Read-only processor, key of local signer is not loaded, so pool address must be set
+func NewDryRunProcessor(cfg *PayoutsConfig, backend *storage.RedisClient) (*PayoutsProcessor, error) {
+	if len(cfg.Address) == 0 {
+		return nil, errors.New("pool address must be set for dry run")
+	}
+	upstreams := rpc.UpstreamList(cfg.Upstream, "DryRun", cfg.Daemon, cfg.Timeout, cfg.Auth)
+	return &PayoutsProcessor{config: cfg, backend: backend, upstreams: rpc.NewUpstreamPool("DryRun", upstreams, false)}, nil
+}
+
+func (u *PayoutsProcessor) DryRun(ctx context.Context) (*DryRunReport, error) {
+	report := &DryRunReport{}
+	problem := func(format string, args ...interface{}) {
+		report.Problems = append(report.Problems, fmt.Sprintf(format, args...))
+	}
+	locked, err := u.backend.IsPayoutsLocked()
+	if err != nil {
+		return nil, err
+	}
+	permanent, err := u.backend.IsPayoutsLockPermanent()
+	if err != nil {
+		return nil, err
+	}
+	if len(u.backend.GetPendingPayments()) > 0 || permanent {
+		problem("Payouts are locked by previous version, resolve them with RESOLVE_PAYOUT=1")
+	} else if locked {
+		problem("Payouts are locked by running payouts, lock of a crashed run expires within %v", payoutsLockTTL)
+	}
+	active, err := u.backend.GetActivePayments()
+	if err != nil {
+		return nil, err
+	}
+	if len(active) > 0 {
+		problem("%v unfinished payments must be resolved before next payouts", len(active))
+	}
+
+	u.upstreams.Check()
+	client := u.rpc()
+	if peers, err := client.GetPeerCount(ctx); err != nil {
+		problem("Failed to get number of peers: %v", err)
+	} else if peers < u.config.RequirePeers {
+		problem("Node has %v peers, %v are required", peers, u.config.RequirePeers)
+	}
+
+	payees, err := u.backend.GetPayees()
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(payees)
+	for _, login := range payees {
+		amount, settings, due := u.duePayout(login)
+		if amount < 0 {
+			problem("Payee %s has negative balance %v Shannon", login, amount)
+		}
+		if !due {
+			continue
+		}
+		planned := PlannedPayout{Login: login, Address: login, Amount: amount, Threshold: u.config.MinerThreshold(settings.Threshold)}
+		if len(settings.Address) > 0 {
+			planned.Address = settings.Address
+		}
+		report.Payouts = append(report.Payouts, planned)
+		report.Total += amount
+
+		if strings.EqualFold(planned.Address, u.config.Address) {
+			problem("Payout address of %s is pool address", login)
+		}
+		if code, err := client.GetCode(ctx, planned.Address); err != nil {
+			problem("Failed to get code of %s: %v", planned.Address, err)
+		} else if len(code) > 0 {
+			problem("Payout address %s of %s is a contract, payout tx may fail", planned.Address, login)
+		}
+		if balance, err := client.GetBalance(ctx, planned.Address); err == nil && balance.Sign() == 0 {
+			if nonce, err := client.GetTransactionCount(ctx, planned.Address, "latest"); err == nil && nonce == 0 {
+				problem("Payout address %s of %s has zero balance and no transactions, check it is not mistyped", planned.Address, login)
+			}
+		}
+	}
+	report.Runs = len(report.Payouts)
+	if size := u.config.BatchSize; size > 0 {
+		report.Runs = (len(report.Payouts) + size - 1) / size
+	}
+
+	gasPrice, err := u.oracleGasPrice(ctx, client)
+	if err == nil && gasPrice == nil {
+		gasPrice = u.config.GasPriceWei()
+		if u.config.AutoGas || gasPrice.Sign() == 0 {
+			gasPrice, err = client.GetGasPrice(ctx)
+		}
+	}
+	if err != nil {
+		problem("Failed to get gas price: %v", err)
+		gasPrice = new(big.Int)
+	}
+	if ceiling := u.config.MaxGasPriceWei(); len(u.config.GasOracle.Mode) > 0 && ceiling.Sign() > 0 && gasPrice.Cmp(ceiling) > 0 {
+		problem("Gas price %v Wei is above max %v Wei, payouts would be delayed", gasPrice, ceiling)
+	}
+	fee := new(big.Int).SetUint64(u.config.GasLimit() * uint64(len(report.Payouts)))
+	fee.Mul(fee, gasPrice)
+	report.GasPrice = gasPrice.String()
+	report.EstimatedFee = fee.String()
+
+	need := new(big.Int).Mul(big.NewInt(report.Total), util.Shannon)
+	need.Add(need, fee)
+	report.Shortfall = "0"
+	if balance, err := client.GetBalance(ctx, u.config.Address); err != nil {
+		problem("Failed to get pool balance: %v", err)
+	} else {
+		report.PoolBalance = balance.String()
+		if shortfall := new(big.Int).Sub(need, balance); shortfall.Sign() > 0 {
+			report.Shortfall = shortfall.String()
+			problem("Pool balance is %s Wei short of payouts and fees", shortfall)
+		}
+	}
+	if len(report.Payouts) == 0 {
+		problem("No payees that have reached payout threshold")
+	}
+	return report, nil
+}
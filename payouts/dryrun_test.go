@@ -0,0 +1,47 @@
+package payouts
+
+import (
+	"context"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/cyberpoolorg/etc-stratum/fakenode"
+)
+
+func TestDryRun(t *testing.T) {
+	node := fakenode.New(1000, "0x0000000000000000000000000000000000000001")
+	defer node.Close()
+	u := newTestProcessor(t, node, &PayoutsConfig{Address: "0x00000000000000000000000000000000000000aa", AutoGas: true, RequirePeers: 1, Threshold: 500})
+	contract := "0x00000000000000000000000000000000000000c1"
+	node.SetCode(contract, "0x6080")
+	node.SetBalance(contract, big.NewInt(1))
+	node.SetBalance(u.config.Address, big.NewInt(1500*1e9))
+	for login, balance := range map[string]int64{contract: 1000, "0x00000000000000000000000000000000000000b1": 1000, "0x00000000000000000000000000000000000000b2": 100} {
+		u.backend.Client().HIncrBy("payouts-test:miners:"+login, "balance", balance)
+	}
+
+	report, err := DryRun(context.Background(), u.config, u.backend)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Payouts) != 2 || report.Total != 2000 || report.Payouts[0].Address != "0x00000000000000000000000000000000000000b1" {
+		t.Fatalf("Must plan payouts of payees above threshold, got %+v", report.Payouts)
+	}
+	// 2 txs of 21000 gas at 1 Gwei
+	if report.EstimatedFee != "42000000000000" || report.Shortfall != "42500000000000" {
+		t.Errorf("Unexpected fee %v and shortfall %v", report.EstimatedFee, report.Shortfall)
+	}
+	problems := strings.Join(report.Problems, "\n")
+	for _, s := range []string{"is a contract", "0x00000000000000000000000000000000000000b1 has zero balance", "short of payouts"} {
+		if !strings.Contains(problems, s) {
+			t.Errorf("Must report %q, got %v", s, report.Problems)
+		}
+	}
+
+	payments, _ := u.backend.GetActivePayments()
+	balance, _ := u.backend.GetBalance(contract)
+	if len(payments) != 0 || balance != 1000 || len(node.Pending()) != 0 || node.Calls("eth_sign") != 0 {
+		t.Error("Dry run must not sign, queue or send payments")
+	}
+}
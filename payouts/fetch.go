@@ -0,0 +1,122 @@
+package payouts
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/cyberpoolorg/etc-stratum/rpc"
+)
+
+const (
+	defaultBatchSize   = 64
+	defaultConcurrency = 4
+)
+
+type uncleRef struct {
+	height int64
+	index  int
+}
+
+// Splits requests into batches and runs them with bounded parallelism
+func (u *BlockUnlocker) runBatches(ctx context.Context, elems []rpc.BatchElem) error {
+	size := u.config.BatchSize
+	if size <= 0 {
+		size = defaultBatchSize
+	}
+	workers := u.config.Concurrency
+	if workers <= 0 {
+		workers = defaultConcurrency
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	sem := make(chan struct{}, workers)
+
+	for i := 0; i < len(elems); i += size {
+		end := i + size
+		if end > len(elems) {
+			end = len(elems)
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(batch []rpc.BatchElem) {
+			defer func() { <-sem; wg.Done() }()
+			err := u.rpc().BatchCall(ctx, batch)
+			if err == nil {
+				for _, elem := range batch {
+					if elem.Error != nil {
+						err = elem.Error
+						break
+					}
+				}
+			}
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(elems[i:end])
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func (u *BlockUnlocker) fetchBlocks(ctx context.Context, heights []int64) (map[int64]*rpc.GetBlockReply, error) {
+	blocks := make([]*rpc.GetBlockReply, len(heights))
+	elems := make([]rpc.BatchElem, len(heights))
+	for i, height := range heights {
+		elems[i] = rpc.BlockByHeightRequest(height, &blocks[i])
+	}
+	if err := u.runBatches(ctx, elems); err != nil {
+		return nil, fmt.Errorf("Error while retrieving blocks from node: %w", err)
+	}
+	result := make(map[int64]*rpc.GetBlockReply, len(heights))
+	for i, height := range heights {
+		if blocks[i] == nil {
+			return nil, fmt.Errorf("Error while retrieving block %v from node, wrong node height", height)
+		}
+		result[height] = blocks[i]
+	}
+	return result, nil
+}
+
+func (u *BlockUnlocker) fetchUncles(ctx context.Context, refs []uncleRef) (map[uncleRef]*rpc.GetBlockReply, error) {
+	uncles := make([]*rpc.GetBlockReply, len(refs))
+	elems := make([]rpc.BatchElem, len(refs))
+	for i, ref := range refs {
+		elems[i] = rpc.UncleByBlockNumberAndIndexRequest(ref.height, ref.index, &uncles[i])
+	}
+	if err := u.runBatches(ctx, elems); err != nil {
+		return nil, fmt.Errorf("Error while retrieving uncles from node: %w", err)
+	}
+	result := make(map[uncleRef]*rpc.GetBlockReply, len(refs))
+	for i, ref := range refs {
+		if uncles[i] == nil {
+			return nil, fmt.Errorf("Error while retrieving uncle of block %v from node", ref.height)
+		}
+		result[ref] = uncles[i]
+	}
+	return result, nil
+}
+
+func (u *BlockUnlocker) fetchReceipts(ctx context.Context, hashes []string) (map[string]*rpc.TxReceipt, error) {
+	receipts := make([]*rpc.TxReceipt, len(hashes))
+	elems := make([]rpc.BatchElem, len(hashes))
+	for i, hash := range hashes {
+		elems[i] = rpc.TxReceiptRequest(hash, &receipts[i])
+	}
+	if err := u.runBatches(ctx, elems); err != nil {
+		return nil, err
+	}
+	result := make(map[string]*rpc.TxReceipt, len(hashes))
+	for i, hash := range hashes {
+		if receipts[i] != nil {
+			result[hash] = receipts[i]
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,113 @@
+package payouts
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"sort"
+
+	"github.com/cyberpoolorg/etc-stratum/rpc"
+	"github.com/cyberpoolorg/etc-stratum/storage"
+	"github.com/cyberpoolorg/etc-stratum/util"
+)
+
+const (
+	defaultOracleBlocks     = 20
+	defaultOraclePercentile = 60
+)
+
+type GasOracleConfig struct {
+	// Empty leaves gas price to gasPrice or autoGas, "node" asks eth_gasPrice,
+	// "percentile" takes percentile of gas prices in last blocks
+	Mode        string `json:"mode"`
+	Blocks      int64  `json:"blocks"`
+	Percentile  int    `json:"percentile"`
+	MinGasPrice string `json:"minGasPrice"`
+}
+
+// Price for payout transactions of this run, nil if oracle is disabled.
+// Raised to the floor, but not capped, caller compares it with ceiling.
+func (u *PayoutsProcessor) oracleGasPrice(ctx context.Context, client *rpc.RPCClient) (*big.Int, error) {
+	cfg := u.config.GasOracle
+	var price *big.Int
+	var err error
+	switch cfg.Mode {
+	case "":
+		return nil, nil
+	case "node":
+		price, err = client.GetGasPrice(ctx)
+	case "percentile":
+		price, err = percentileGasPrice(ctx, client, cfg)
+	default:
+		return nil, fmt.Errorf("Unknown gas oracle mode %q", cfg.Mode)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if floor := util.String2Big(cfg.MinGasPrice); price.Cmp(floor) < 0 {
+		price = floor
+	}
+	return price, nil
+}
+
+// Falls back to eth_gasPrice if there were no transactions in these blocks
+func percentileGasPrice(ctx context.Context, client *rpc.RPCClient, cfg GasOracleConfig) (*big.Int, error) {
+	blocks := cfg.Blocks
+	if blocks <= 0 {
+		blocks = defaultOracleBlocks
+	}
+	percentile := cfg.Percentile
+	if percentile <= 0 || percentile > 100 {
+		percentile = defaultOraclePercentile
+	}
+	head, err := client.GetBlockNumber(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var batch []rpc.BatchElem
+	replies := make([]*rpc.GetBlockReply, blocks)
+	for i := int64(0); i < blocks && head-i >= 0; i++ {
+		batch = append(batch, rpc.BlockByHeightRequest(head-i, &replies[i]))
+	}
+	if err := client.BatchCall(ctx, batch); err != nil {
+		return nil, err
+	}
+
+	var prices []*big.Int
+	for i, block := range replies[:len(batch)] {
+		if batch[i].Error != nil {
+			return nil, batch[i].Error
+		}
+		if block == nil {
+			continue
+		}
+		for _, tx := range block.Transactions {
+			prices = append(prices, util.String2Big(tx.GasPrice))
+		}
+	}
+	if len(prices) == 0 {
+		return client.GetGasPrice(ctx)
+	}
+	sort.Slice(prices, func(i, j int) bool { return prices[i].Cmp(prices[j]) < 0 })
+	return prices[(len(prices)-1)*percentile/100], nil
+}
+
+// Records gas paid by mined transaction of payment, price is taken from receipt
+// if node reports it, otherwise from the transaction
+func (u *PayoutsProcessor) setFee(ctx context.Context, client *rpc.RPCClient, p *storage.Payment, receipt *rpc.TxReceipt) error {
+	price := util.String2Big(receipt.EffectiveGasPrice)
+	if price.Sign() == 0 {
+		tx, err := client.GetTransactionByHash(ctx, p.TxHash)
+		if err != nil {
+			return err
+		}
+		if tx == nil {
+			return fmt.Errorf("Mined tx %s is not found", p.TxHash)
+		}
+		price = util.String2Big(tx.GasPrice)
+	}
+	p.GasUsed = util.String2Big(receipt.GasUsed).Uint64()
+	fee := new(big.Int).Mul(new(big.Int).SetUint64(p.GasUsed), price)
+	p.Fee = fee.Div(fee, util.Shannon).Int64()
+	return nil
+}
@@ -0,0 +1,58 @@
+package payouts
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cyberpoolorg/etc-stratum/fakenode"
+)
+
+func TestGasOracle(t *testing.T) {
+	node := fakenode.New(1000, "0x0000000000000000000000000000000000000001")
+	defer node.Close()
+	u := newTestProcessor(t, node, &PayoutsConfig{
+		Address:      "0x00000000000000000000000000000000000000aa",
+		AutoGas:      true,
+		RequirePeers: 1,
+		GasOracle:    GasOracleConfig{Mode: "percentile", Blocks: 5, Percentile: 50},
+	})
+	u.txTimeout = defaultTxTimeout
+	ctx := context.Background()
+	for _, price := range []string{"0x77359400", "0x3b9aca00", "0xb2d05e00"} {
+		u.rpc().SendTransaction(ctx, u.config.Address, "0x00000000000000000000000000000000000000cc", "0x5208", price, "0x1", "", false)
+	}
+	node.Mine(1)
+	if price, _ := u.oracleGasPrice(ctx, u.rpc()); price == nil || price.Int64() != 2000000000 {
+		t.Fatalf("Must take median of recent gas prices, got %v", price)
+	}
+	u.config.GasOracle.MinGasPrice = "5000000000"
+	if price, _ := u.oracleGasPrice(ctx, u.rpc()); price == nil || price.Int64() != 5000000000 {
+		t.Fatalf("Must raise gas price to the floor, got %v", price)
+	}
+
+	login := "0x00000000000000000000000000000000000000b1"
+	u.backend.Client().HIncrBy("payouts-test:miners:"+login, "balance", 1000)
+	u.config.MaxGasPrice = "4000000000"
+	u.process()
+	if balance, _ := u.backend.GetBalance(login); balance != 1000 || len(node.Pending()) != 0 {
+		t.Fatalf("Must delay payouts while gas price is above max, balance %v", balance)
+	}
+
+	u.config.MaxGasPrice = "6000000000"
+	go func() {
+		for len(node.Pending()) == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		node.Mine(1)
+	}()
+	u.process()
+	for id := range u.backend.Client().HGetAllMap("payouts-test:payments:records").Val() {
+		if p, _ := u.backend.GetPayment(id); p.GasPrice != "5000000000" || p.GasUsed != 21000 || p.Fee != 105000 {
+			t.Errorf("Must pay at oracle price and record fee, got %+v", p)
+		}
+	}
+	if fees := u.backend.Client().HGet("payouts-test:finances", "fees").Val(); fees != "105000" {
+		t.Errorf("Must record fee paid at oracle price, got %v Shannon", fees)
+	}
+}
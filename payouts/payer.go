@@ -1,11 +1,13 @@
 package payouts
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math/big"
 	"os"
 	"strconv"
+	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common/hexutil"
@@ -15,20 +17,39 @@ import (
 	"github.com/cyberpoolorg/etc-stratum/util"
 )
 
-const txCheckInterval = 5 * time.Second
+const (
+	txCheckInterval  = 5 * time.Second
+	defaultTxTimeout = time.Hour
+	// Payout lock of a crashed run expires after this time
+	payoutsLockTTL = time.Minute
+)
 
 type PayoutsConfig struct {
-	Enabled      bool   `json:"enabled"`
-	RequirePeers int64  `json:"requirePeers"`
-	Interval     string `json:"interval"`
-	Daemon       string `json:"daemon"`
-	Timeout      string `json:"timeout"`
-	Address      string `json:"address"`
-	Gas          string `json:"gas"`
-	GasPrice     string `json:"gasPrice"`
-	AutoGas      bool   `json:"autoGas"`
-	Threshold int64 `json:"threshold"`
-	BgSave    bool  `json:"bgsave"`
+	Enabled      bool           `json:"enabled"`
+	RequirePeers int64          `json:"requirePeers"`
+	Interval     string         `json:"interval"`
+	Daemon       string         `json:"daemon"`
+	Timeout      string         `json:"timeout"`
+	Auth         rpc.Auth       `json:"auth"`
+	Upstream     []rpc.Upstream `json:"upstream"`
+	Address      string         `json:"address"`
+	Gas          string         `json:"gas"`
+	GasPrice     string         `json:"gasPrice"`
+	AutoGas      bool           `json:"autoGas"`
+	BatchSize    int            `json:"batchSize"`
+	TxTimeout    string         `json:"txTimeout"`
+	Signer       SignerConfig   `json:"signer"`
+	// Stuck tx is sent again with higher gas price after this time
+	ReplaceAfter   string `json:"replaceAfter"`
+	GasBumpPercent int64  `json:"gasBumpPercent"`
+	MaxGasPrice    string `json:"maxGasPrice"`
+	// Payouts are delayed while its price is above maxGasPrice
+	GasOracle GasOracleConfig `json:"gasOracle"`
+	Threshold int64           `json:"threshold"`
+	// Limits of threshold set by miner, zero is no limit
+	MinThreshold int64 `json:"minThreshold"`
+	MaxThreshold int64 `json:"maxThreshold"`
+	BgSave       bool  `json:"bgsave"`
 }
 
 func (self PayoutsConfig) GasHex() string {
@@ -41,20 +62,82 @@ func (self PayoutsConfig) GasPriceHex() string {
 	return hexutil.EncodeBig(x)
 }
 
+func (self PayoutsConfig) GasLimit() uint64 {
+	if x := util.String2Big(self.Gas); x.Sign() > 0 {
+		return x.Uint64()
+	}
+	return defaultGas
+}
+
+func (self PayoutsConfig) GasPriceWei() *big.Int {
+	return util.String2Big(self.GasPrice)
+}
+
+// Threshold chosen by miner within pool limits
+func (self PayoutsConfig) MinerThreshold(threshold int64) int64 {
+	if threshold <= 0 {
+		return self.Threshold
+	}
+	if threshold < self.MinThreshold {
+		return self.MinThreshold
+	}
+	if self.MaxThreshold > 0 && threshold > self.MaxThreshold {
+		return self.MaxThreshold
+	}
+	return threshold
+}
+
+func (self PayoutsConfig) MaxGasPriceWei() *big.Int {
+	return util.String2Big(self.MaxGasPrice)
+}
+
 type PayoutsProcessor struct {
-	config   *PayoutsConfig
-	backend  *storage.RedisClient
-	rpc      *rpc.RPCClient
-	halt     bool
-	lastFail error
+	config    *PayoutsConfig
+	backend   *storage.RedisClient
+	upstreams *rpc.Pool
+	signer    txSigner
+	txTimeout time.Duration
+	// Zero disables replacement of stuck transactions
+	replaceAfter time.Duration
+	lockOwner    string
+	lockTTL      time.Duration
+	lockLost     int32
+	halt         bool
+	lastFail     error
 }
 
 func NewPayoutsProcessor(cfg *PayoutsConfig, backend *storage.RedisClient) *PayoutsProcessor {
-	u := &PayoutsProcessor{config: cfg, backend: backend}
-	u.rpc = rpc.NewRPCClient("PayoutsProcessor", cfg.Daemon, cfg.Timeout)
+	u, err := newPayoutsProcessor(cfg, backend)
+	if err != nil {
+		log.Fatalf("Failed to set up payouts signer: %v", err)
+	}
 	return u
 }
 
+func newPayoutsProcessor(cfg *PayoutsConfig, backend *storage.RedisClient) (*PayoutsProcessor, error) {
+	u := &PayoutsProcessor{config: cfg, backend: backend, lockTTL: payoutsLockTTL}
+	u.lockOwner = fmt.Sprintf("%s:%v:%v", cfg.Address, os.Getpid(), time.Now().UnixNano())
+	upstreams := rpc.UpstreamList(cfg.Upstream, "PayoutsProcessor", cfg.Daemon, cfg.Timeout, cfg.Auth)
+	u.upstreams = rpc.NewUpstreamPool("PayoutsProcessor", upstreams, false)
+	signer, err := newSigner(cfg)
+	if err != nil {
+		return nil, err
+	}
+	u.signer = signer
+	u.txTimeout = defaultTxTimeout
+	if len(cfg.TxTimeout) > 0 {
+		u.txTimeout = util.MustParseDuration(cfg.TxTimeout)
+	}
+	if len(cfg.ReplaceAfter) > 0 {
+		u.replaceAfter = util.MustParseDuration(cfg.ReplaceAfter)
+	}
+	return u, nil
+}
+
+func (u *PayoutsProcessor) rpc() *rpc.RPCClient {
+	return u.upstreams.Client()
+}
+
 func (u *PayoutsProcessor) Start() {
 	log.Println("Starting payouts")
 
@@ -69,20 +152,22 @@ func (u *PayoutsProcessor) Start() {
 	timer := time.NewTimer(intv)
 	log.Printf("Set payouts interval to %v", intv)
 
+	// Left by versions without payment records, those can't be recovered automatically
 	payments := u.backend.GetPendingPayments()
 	if len(payments) > 0 {
-		log.Printf("Previous payout failed, you have to resolve it. List of failed payments:\n %v",
+		log.Printf("Previous payout failed, you have to resolve it with RESOLVE_PAYOUT=1. List of failed payments:\n %v",
 			formatPendingPayments(payments))
 		return
 	}
 
-	locked, err := u.backend.IsPayoutsLocked()
+	// Lock of a crashed run expires by itself, older versions locked payouts for good
+	permanent, err := u.backend.IsPayoutsLockPermanent()
 	if err != nil {
 		log.Println("Unable to start payouts:", err)
 		return
 	}
-	if locked {
-		log.Println("Unable to start payouts because they are locked")
+	if permanent {
+		log.Println("Unable to start payouts because they are locked by previous version, resolve them with RESOLVE_PAYOUT=1")
 		return
 	}
 
@@ -105,107 +190,147 @@ func (u *PayoutsProcessor) process() {
 		log.Println("Payments suspended due to last critical error:", u.lastFail)
 		return
 	}
+	// Only one process may send from pool address
+	locked, err := u.backend.LeasePayouts(u.lockOwner, u.lockTTL)
+	if err != nil || !locked {
+		log.Println("Skipping payouts, they are locked by another process:", err)
+		return
+	}
+	atomic.StoreInt32(&u.lockLost, 0)
+	stop := make(chan struct{})
+	go u.renewLock(stop)
+	defer func() {
+		close(stop)
+		if err := u.backend.ReleasePayouts(u.lockOwner); err != nil {
+			log.Println("Failed to unlock payouts:", err)
+		}
+	}()
+	u.upstreams.Check()
+	ctx := context.Background()
+	client := u.rpc()
+	if !u.recoverPayments(ctx, client) {
+		log.Println("Unfinished payments are not resolved yet, skipping payouts")
+		return
+	}
 	mustPay := 0
-	minersPaid := 0
-	totalAmount := big.NewInt(0)
 	payees, err := u.backend.GetPayees()
 	if err != nil {
 		log.Println("Error while retrieving payees from backend:", err)
 		return
 	}
 
+	var sent []*storage.Payment
+	var nonce uint64
+	var height int64
+	var gasPrice *big.Int
+	totalWei := new(big.Int)
 	for _, login := range payees {
-		amount, _ := u.backend.GetBalance(login)
-		amountInShannon := big.NewInt(amount)
-
-		amountInWei := new(big.Int).Mul(amountInShannon, util.Shannon)
-
-		if !u.reachedThreshold(amountInShannon) {
+		amount, settings, due := u.duePayout(login)
+		if !due {
 			continue
 		}
+		amountInWei := new(big.Int).Mul(big.NewInt(amount), util.Shannon)
 		mustPay++
-
-		if !u.checkPeers() {
-			break
+		// Rest is paid on next runs
+		if u.config.BatchSize > 0 && len(sent) >= u.config.BatchSize {
+			continue
 		}
 
-		if !u.isUnlockedAccount() {
-			break
+		if len(sent) == 0 {
+			if !u.checkPeers(ctx) {
+				break
+			}
+			if !u.isUnlockedAccount(ctx) {
+				break
+			}
+			if nonce, err = client.GetTransactionCount(ctx, u.config.Address, "pending"); err == nil {
+				height, err = client.GetBlockNumber(ctx)
+			}
+			if err != nil {
+				log.Println("Unable to get pool nonce:", err)
+				break
+			}
+			if gasPrice, err = u.oracleGasPrice(ctx, client); err != nil {
+				log.Println("Unable to get gas price:", err)
+				break
+			}
+			if ceiling := u.config.MaxGasPriceWei(); gasPrice != nil && ceiling.Sign() > 0 && gasPrice.Cmp(ceiling) > 0 {
+				log.Printf("Gas price %v Wei is above max %v Wei, payouts are delayed to next run", gasPrice, ceiling)
+				break
+			}
 		}
 
-		poolBalance, err := u.rpc.GetBalance(u.config.Address)
+		// Transactions of this batch are not mined yet
+		poolBalance, err := client.GetBalance(ctx, u.config.Address)
 		if err != nil {
-			u.halt = true
-			u.lastFail = err
+			log.Println("Unable to get pool balance:", err)
+			// Node outage, try again on next run
+			if !rpc.IsTemporary(err) {
+				u.halt = true
+				u.lastFail = err
+			}
 			break
 		}
-		if poolBalance.Cmp(amountInWei) < 0 {
+		totalWei.Add(totalWei, amountInWei)
+		if poolBalance.Cmp(totalWei) < 0 {
 			err := fmt.Errorf("Not enough balance for payment, need %s Wei, pool has %s Wei",
-				amountInWei.String(), poolBalance.String())
+				totalWei.String(), poolBalance.String())
 			u.halt = true
 			u.lastFail = err
 			break
 		}
 
-		err = u.backend.LockPayouts(login, amount)
-		if err != nil {
-			log.Printf("Failed to lock payment for %s: %v", login, err)
-			u.halt = true
-			u.lastFail = err
+		if atomic.LoadInt32(&u.lockLost) == 1 {
+			log.Println("Lost payouts lock, rest is paid on next runs")
 			break
 		}
-		log.Printf("Locked payment for %s, %v Shannon", login, amount)
-
-		err = u.backend.UpdateBalance(login, amount)
-		if err != nil {
-			log.Printf("Failed to update balance for %s, %v Shannon: %v", login, amount, err)
-			u.halt = true
-			u.lastFail = err
+		p := &storage.Payment{Login: login, Amount: amount, Address: settings.Address, State: storage.PaymentQueued, Nonce: nonce, Height: height}
+		if gasPrice != nil {
+			p.GasPrice = gasPrice.String()
+		}
+		if err := u.signer.sign(ctx, client, p); err != nil {
+			log.Printf("Failed to prepare payment to %s: %v", login, err)
 			break
 		}
-
-		value := hexutil.EncodeBig(amountInWei)
-		txHash, err := u.rpc.SendTransaction(u.config.Address, login, u.config.GasHex(), u.config.GasPriceHex(), value, u.config.AutoGas)
+		err = u.backend.QueuePayment(p)
 		if err != nil {
-			log.Printf("Failed to send payment to %s, %v Shannon: %v. Check outgoing tx for %s in block explorer and docs/PAYOUTS.md",
-				login, amount, err, login)
+			log.Printf("Failed to queue payment to %s, %v Shannon: %v", login, amount, err)
 			u.halt = true
 			u.lastFail = err
 			break
 		}
-
-		err = u.backend.WritePayment(login, txHash, amount)
+		log.Printf("Queued payment %s, %v Shannon, nonce %v", p.Id, amount, p.Nonce)
+
+		// Payments after a failed one are not sent, so there is no gap in nonces
+		txHash, err := u.signer.send(ctx, client, p)
+		if err != nil && rpc.IsRPCError(err) {
+			// Node rejected transaction, nothing was sent
+			log.Printf("Node rejected payment to %s, %v Shannon: %v. Rolling back", login, amount, err)
+			if err := u.backend.RollbackPayment(p, storage.PaymentRolledBack); err != nil {
+				log.Printf("Failed to roll back payment %s: %v", p.Id, err)
+				u.halt = true
+				u.lastFail = err
+			}
+			break
+		}
+		// Transaction may have been sent, recovery finds it by nonce on next run
 		if err != nil {
-			log.Printf("Failed to log payment data for %s, %v Shannon, tx: %s: %v", login, amount, txHash, err)
-			u.halt = true
-			u.lastFail = err
+			log.Printf("Failed to send payment %s: %v. Will be resolved on next run", p.Id, err)
 			break
 		}
 
-		minersPaid++
-		totalAmount.Add(totalAmount, big.NewInt(amount))
-		log.Printf("Paid %v Shannon to %v, TxHash: %v", amount, login, txHash)
-
-		for {
-			log.Printf("Waiting for tx confirmation: %v", txHash)
-			time.Sleep(txCheckInterval)
-			receipt, err := u.rpc.GetTxReceipt(txHash)
-			if err != nil {
-				log.Printf("Failed to get tx receipt for %v: %v", txHash, err)
-				continue
-			}
-			// Tx has been mined
-			if receipt != nil && receipt.Confirmed() {
-				if receipt.Successful() {
-					log.Printf("Payout tx successful for %s: %s", login, txHash)
-				} else {
-					log.Printf("Payout tx failed for %s: %s. Address contract throws on incoming tx.", login, txHash)
-				}
-				break
-			}
+		p.TxHash = txHash
+		p.State = storage.PaymentBroadcast
+		p.SentAt = util.MakeTimestamp()
+		if err := u.backend.UpdatePayment(p); err != nil {
+			log.Printf("Failed to save tx %s of payment %s: %v", txHash, p.Id, err)
 		}
+		log.Printf("Sent %v Shannon to %v, TxHash: %v", amount, login, txHash)
+		sent = append(sent, p)
+		nonce++
 	}
 
+	minersPaid, totalAmount := u.confirmPayments(ctx, client, sent)
 	if mustPay > 0 {
 		log.Printf("Paid total %v Shannon to %v of %v payees", totalAmount, minersPaid, mustPay)
 	} else {
@@ -217,8 +342,96 @@ func (u *PayoutsProcessor) process() {
 	}
 }
 
-func (self PayoutsProcessor) isUnlockedAccount() bool {
-	_, err := self.rpc.Sign(self.config.Address, "0x0")
+// Extends the lease while run is in progress, payments are not sent once it is lost
+func (u *PayoutsProcessor) renewLock(stop chan struct{}) {
+	ticker := time.NewTicker(u.lockTTL / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			locked, err := u.backend.LeasePayouts(u.lockOwner, u.lockTTL)
+			if err != nil || !locked {
+				log.Println("Failed to renew payouts lock:", err)
+				if !locked {
+					atomic.StoreInt32(&u.lockLost, 1)
+				}
+			}
+		}
+	}
+}
+
+// Polls receipts of all sent payments at once, stuck ones are replaced.
+// Payment not mined in time is left to recovery of next runs.
+func (u *PayoutsProcessor) confirmPayments(ctx context.Context, client *rpc.RPCClient, payments []*storage.Payment) (int, int64) {
+	var paid int
+	var total int64
+	for len(payments) > 0 {
+		log.Printf("Waiting for %v tx confirmations", len(payments))
+		time.Sleep(txCheckInterval)
+		var hashes []string
+		owners := make(map[int]int)
+		for i, p := range payments {
+			for _, hash := range p.Hashes() {
+				owners[len(hashes)] = i
+				hashes = append(hashes, hash)
+			}
+		}
+		receipts := make([]*rpc.TxReceipt, len(hashes))
+		batch := make([]rpc.BatchElem, len(hashes))
+		for i, hash := range hashes {
+			batch[i] = rpc.TxReceiptRequest(hash, &receipts[i])
+		}
+		// Unanswered receipts count as not mined, so payments still time out during node outage
+		batchErr := client.BatchCall(ctx, batch)
+		if batchErr != nil {
+			log.Println("Failed to get tx receipts:", batchErr)
+		}
+
+		mined := make(map[int]*rpc.TxReceipt)
+		for i, receipt := range receipts {
+			if batch[i].Error != nil {
+				log.Printf("Failed to get tx receipt for %v: %v", hashes[i], batch[i].Error)
+			} else if receipt != nil && receipt.Confirmed() {
+				payments[owners[i]].SetMined(hashes[i])
+				mined[owners[i]] = receipt
+			}
+		}
+
+		var waiting []*storage.Payment
+		for i, p := range payments {
+			if receipt, ok := mined[i]; ok {
+				if err := u.finishPayment(ctx, client, p, receipt); err != nil {
+					log.Printf("Failed to finish payment %s: %v", p.Id, err)
+					u.halt = true
+					u.lastFail = err
+					return paid, total
+				}
+				if receipt.Successful() {
+					paid++
+					total += p.Amount
+				}
+				continue
+			}
+			if time.Since(time.Unix(0, p.CreatedAt*int64(time.Millisecond))) > u.txTimeout {
+				log.Printf("Payment %s is not mined in %v, tx %s is left for next run", p.Id, u.txTimeout, p.TxHash)
+				continue
+			}
+			if batchErr == nil && u.stuck(p) {
+				if err := u.replacePayment(ctx, client, p); err != nil {
+					log.Printf("Failed to replace stuck tx %s of payment %s: %v", p.TxHash, p.Id, err)
+				}
+			}
+			waiting = append(waiting, p)
+		}
+		payments = waiting
+	}
+	return paid, total
+}
+
+func (self PayoutsProcessor) isUnlockedAccount(ctx context.Context) bool {
+	err := self.signer.check(ctx, self.rpc())
 	if err != nil {
 		log.Println("Unable to process payouts:", err)
 		return false
@@ -226,8 +439,8 @@ func (self PayoutsProcessor) isUnlockedAccount() bool {
 	return true
 }
 
-func (self PayoutsProcessor) checkPeers() bool {
-	n, err := self.rpc.GetPeerCount()
+func (self PayoutsProcessor) checkPeers(ctx context.Context) bool {
+	n, err := self.rpc().GetPeerCount(ctx)
 	if err != nil {
 		log.Println("Unable to start payouts, failed to retrieve number of peers from node:", err)
 		return false
@@ -239,8 +452,19 @@ func (self PayoutsProcessor) checkPeers() bool {
 	return true
 }
 
-func (self PayoutsProcessor) reachedThreshold(amount *big.Int) bool {
-	return big.NewInt(self.config.Threshold).Cmp(amount) < 0
+// Balance of payee and its settings, due if it reached threshold
+func (u *PayoutsProcessor) duePayout(login string) (int64, *storage.MinerSettings, bool) {
+	amount, _ := u.backend.GetBalance(login)
+	settings, err := u.backend.GetMinerSettings(login)
+	if err != nil {
+		log.Printf("Failed to get payout settings of %s: %v", login, err)
+		return amount, nil, false
+	}
+	return amount, settings, u.reachedThreshold(big.NewInt(amount), settings)
+}
+
+func (self PayoutsProcessor) reachedThreshold(amount *big.Int, settings *storage.MinerSettings) bool {
+	return big.NewInt(self.config.MinerThreshold(settings.Threshold)).Cmp(amount) < 0
 }
 
 func formatPendingPayments(list []*storage.PendingPayment) string {
@@ -274,14 +498,14 @@ func (self PayoutsProcessor) resolvePayouts() {
 			}
 			log.Printf("Credited %v Shannon back to %s", v.Amount, v.Address)
 		}
-		err := self.backend.UnlockPayouts()
-		if err != nil {
-			log.Println("Failed to unlock payouts:", err)
-			return
-		}
 	} else {
 		log.Println("No pending payments to resolve")
 	}
+	err := self.backend.UnlockPayouts()
+	if err != nil {
+		log.Println("Failed to unlock payouts:", err)
+		return
+	}
 
 	if self.config.BgSave {
 		self.bgSave()
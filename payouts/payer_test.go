@@ -0,0 +1,157 @@
+package payouts
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cyberpoolorg/etc-stratum/fakenode"
+	"github.com/cyberpoolorg/etc-stratum/storage"
+)
+
+func TestBatchPayouts(t *testing.T) {
+	node := fakenode.New(1000, "0x0000000000000000000000000000000000000001")
+	defer node.Close()
+	u := newTestProcessor(t, node, &PayoutsConfig{Address: "0x00000000000000000000000000000000000000aa", AutoGas: true, RequirePeers: 1, BatchSize: 2})
+	u.txTimeout = defaultTxTimeout
+	logins := []string{
+		"0x00000000000000000000000000000000000000b1",
+		"0x00000000000000000000000000000000000000b2",
+		"0x00000000000000000000000000000000000000b3",
+	}
+	for _, login := range logins {
+		u.backend.Client().HIncrBy("payouts-test:miners:"+login, "balance", 1000)
+	}
+
+	// Both transactions of the batch are sent before any of them is mined
+	go func() {
+		for len(node.Pending()) < 2 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		node.Mine(1)
+	}()
+	u.process()
+	block := node.BlockByNumber(1)
+	if block == nil || len(block.Txs) != 2 || block.Txs[0].Nonce != 0 || block.Txs[1].Nonce != 1 {
+		t.Fatalf("Batch must be mined in one block with sequential nonces, got %+v", block)
+	}
+	var paid int
+	for _, login := range logins {
+		if balance, _ := u.backend.GetBalance(login); balance == 0 {
+			paid++
+		}
+	}
+	if paid != 2 || u.halt {
+		t.Errorf("Must pay batch of 2 payees, paid %v: %v", paid, u.lastFail)
+	}
+
+	// Not mined in time, left to recovery of next run
+	u.txTimeout = 0
+	u.process()
+	payments, _ := u.backend.GetActivePayments()
+	if len(payments) != 1 || payments[0].State != storage.PaymentBroadcast {
+		t.Fatalf("Must leave unconfirmed payment active, got %+v", payments)
+	}
+	node.Mine(1)
+	if !u.recoverPayments(context.Background(), u.rpc()) {
+		t.Error("Payment must be confirmed on next run")
+	}
+}
+
+// Lock of a crashed run expires, restarted payouts do not need RESOLVE_PAYOUT=1
+func TestPayoutsLockAfterCrash(t *testing.T) {
+	node := fakenode.New(1000, "0x0000000000000000000000000000000000000001")
+	defer node.Close()
+	cfg := &PayoutsConfig{Address: "0x00000000000000000000000000000000000000aa", AutoGas: true, RequirePeers: 1, Interval: "1h"}
+	crashed := newTestProcessor(t, node, cfg)
+	u := newTestProcessor(t, node, cfg)
+	u.txTimeout = defaultTxTimeout
+	u.lockOwner = "restarted"
+	u.lockTTL = 300 * time.Millisecond
+	login := "0x00000000000000000000000000000000000000b1"
+	u.backend.Client().HIncrBy("payouts-test:miners:"+login, "balance", 1000)
+
+	// Crashed run never releases its lock
+	if locked, _ := crashed.backend.LeasePayouts("crashed", u.lockTTL); !locked {
+		t.Fatal("Must acquire payouts lock")
+	}
+	u.Start()
+	if balance, _ := u.backend.GetBalance(login); balance != 1000 {
+		t.Fatal("Must not pay while lock of crashed run is valid")
+	}
+
+	time.Sleep(2 * u.lockTTL)
+	// Lock is renewed while run waits for confirmations
+	var stolen bool
+	go func() {
+		for len(node.Pending()) == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(2 * u.lockTTL)
+		stolen, _ = crashed.backend.LeasePayouts("crashed", u.lockTTL)
+		node.Mine(1)
+	}()
+	u.process()
+	if balance, _ := u.backend.GetBalance(login); balance != 0 || stolen {
+		t.Errorf("Must pay once lock expires and hold it during run, balance %v, stolen %v", balance, stolen)
+	}
+	if locked, _ := u.backend.IsPayoutsLocked(); locked {
+		t.Error("Must release the lock after run")
+	}
+}
+
+func TestMinerSettingsPayouts(t *testing.T) {
+	node := fakenode.New(1000, "0x0000000000000000000000000000000000000001")
+	defer node.Close()
+	u := newTestProcessor(t, node, &PayoutsConfig{Address: "0x00000000000000000000000000000000000000aa", AutoGas: true, RequirePeers: 1, Threshold: 2000, MinThreshold: 100})
+	u.txTimeout = defaultTxTimeout
+	own := "0x00000000000000000000000000000000000000b1"
+	pool := "0x00000000000000000000000000000000000000b2"
+	wallet := "0x00000000000000000000000000000000000000c1"
+	u.backend.Client().HIncrBy("payouts-test:miners:"+own, "balance", 1000)
+	u.backend.Client().HIncrBy("payouts-test:miners:"+pool, "balance", 1000)
+	u.backend.SetMinerSettings(own, &storage.MinerSettings{Threshold: 500, Address: wallet, Timestamp: 1})
+
+	go func() {
+		for len(node.Pending()) == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+		node.Mine(1)
+	}()
+	u.process()
+	if balance, _ := u.backend.GetBalance(own); balance != 0 || node.Balance(wallet).Int64() != 1000*1e9 || node.Balance(own).Sign() != 0 {
+		t.Errorf("Must pay miner with own threshold to payout address, balance %v", balance)
+	}
+	if balance, _ := u.backend.GetBalance(pool); balance != 1000 {
+		t.Errorf("Must keep pool threshold for miner without settings, balance %v", balance)
+	}
+	if u.config.MinerThreshold(50) != 100 || u.config.MinerThreshold(0) != 2000 {
+		t.Error("Miner threshold must be within pool limits")
+	}
+}
+
+func TestPayoutsLock(t *testing.T) {
+	node := fakenode.New(1000, "0x0000000000000000000000000000000000000001")
+	defer node.Close()
+	u := newTestProcessor(t, node, &PayoutsConfig{Address: "0x00000000000000000000000000000000000000aa", AutoGas: true, RequirePeers: 1})
+	login := "0x00000000000000000000000000000000000000b1"
+	u.backend.Client().HIncrBy("payouts-test:miners:"+login, "balance", 1000)
+
+	u.backend.LockPayouts("other", 0)
+	u.process()
+	if balance, _ := u.backend.GetBalance(login); balance != 1000 || len(node.Pending()) != 0 {
+		t.Fatal("Must not pay while another process holds the lock")
+	}
+	u.backend.UnlockPayouts()
+
+	// Receipts are unavailable, payment is left to recovery once not mined in time
+	node.Fail("eth_getTransactionReceipt", 100, fakenode.Failure{Status: 502})
+	u.process()
+	payments, _ := u.backend.GetActivePayments()
+	if len(payments) != 1 || payments[0].State != storage.PaymentBroadcast {
+		t.Fatalf("Must leave unconfirmed payment active, got %+v", payments)
+	}
+	if locked, _ := u.backend.IsPayoutsLocked(); locked {
+		t.Error("Must release the lock after run")
+	}
+}
@@ -0,0 +1,161 @@
+package payouts
+
+import (
+	"context"
+	"log"
+	"strings"
+
+	"github.com/cyberpoolorg/etc-stratum/rpc"
+	"github.com/cyberpoolorg/etc-stratum/storage"
+	"github.com/cyberpoolorg/etc-stratum/util"
+)
+
+// Resolves payments left by crash or lost node reply. Every one is either
+// finished by its mined transaction or rolled back once its nonce is used by
+// other transaction. Returns false while some of them are still in tx pool.
+func (u *PayoutsProcessor) recoverPayments(ctx context.Context, client *rpc.RPCClient) bool {
+	payments, err := u.backend.GetActivePayments()
+	if err != nil {
+		log.Println("Failed to get unfinished payments:", err)
+		return false
+	}
+	resolved := true
+	for _, p := range payments {
+		done, err := u.recoverPayment(ctx, client, p)
+		if err != nil {
+			log.Printf("Failed to recover payment %s: %v", p.Id, err)
+			return false
+		}
+		resolved = resolved && done
+	}
+	return resolved
+}
+
+func (u *PayoutsProcessor) recoverPayment(ctx context.Context, client *rpc.RPCClient, p *storage.Payment) (bool, error) {
+	for _, hash := range p.Hashes() {
+		receipt, err := client.GetTxReceipt(ctx, hash)
+		if err != nil {
+			return false, err
+		}
+		if receipt != nil && receipt.Confirmed() {
+			p.SetMined(hash)
+			return true, u.finishPayment(ctx, client, p, receipt)
+		}
+	}
+	for _, hash := range p.Hashes() {
+		tx, err := client.GetTransactionByHash(ctx, hash)
+		if err != nil {
+			return false, err
+		}
+		if tx == nil {
+			continue
+		}
+		log.Printf("Payment %s is waiting in tx pool: %s", p.Id, hash)
+		if hash == p.TxHash && u.stuck(p) {
+			return false, u.replacePayment(ctx, client, p)
+		}
+		return false, nil
+	}
+
+	mined, err := client.GetTransactionCount(ctx, u.config.Address, "latest")
+	if err != nil {
+		return false, err
+	}
+	if mined > p.Nonce {
+		// Hash of mined tx may be unknown, e.g. node signed it or replaced it with lost reply,
+		// so look for it in blocks by nonce
+		tx, other, err := u.findTransaction(ctx, client, p)
+		if err != nil {
+			return false, err
+		}
+		if tx != nil {
+			receipt, err := client.GetTxReceipt(ctx, tx.Hash)
+			if err != nil {
+				return false, err
+			}
+			if receipt == nil || !receipt.Confirmed() {
+				return false, nil
+			}
+			log.Printf("Payment %s was mined as %s", p.Id, tx.Hash)
+			p.SetMined(tx.Hash)
+			return true, u.finishPayment(ctx, client, p, receipt)
+		}
+		if !other {
+			log.Printf("Nonce %v of payment %s is used but no transaction with it is found since block %v", p.Nonce, p.Id, p.Height)
+			return false, nil
+		}
+		log.Printf("Nonce %v of payment %s is used by other transaction, rolling back %v Shannon to %s", p.Nonce, p.Id, p.Amount, p.Login)
+		return true, u.backend.RollbackPayment(p, storage.PaymentRolledBack)
+	}
+	pending, err := client.GetTransactionCount(ctx, u.config.Address, "pending")
+	if err != nil {
+		return false, err
+	}
+	if pending > p.Nonce {
+		log.Printf("Nonce %v of payment %s is taken by transaction in tx pool, waiting", p.Nonce, p.Id)
+		return false, nil
+	}
+
+	// Nonce is free on this node, but the transaction may still be in tx pool of others and get mined,
+	// so it is sent again with the same nonce rather than rolled back
+	if len(p.RawTx) > 0 {
+		log.Printf("Sending payment %s again: %s", p.Id, p.TxHash)
+		if _, err := client.SendRawTransaction(ctx, p.RawTx); err != nil {
+			return false, err
+		}
+	} else {
+		log.Printf("Payment %s was not sent or lost by node, sending it again with nonce %v", p.Id, p.Nonce)
+		txHash, err := u.signer.send(ctx, client, p)
+		if err != nil {
+			return false, err
+		}
+		if txHash != p.TxHash {
+			if len(p.TxHash) > 0 {
+				p.Replaced = append(p.Replaced, p.TxHash)
+			}
+			p.TxHash = txHash
+		}
+	}
+	p.State = storage.PaymentBroadcast
+	p.SentAt = util.MakeTimestamp()
+	return false, u.backend.UpdatePayment(p)
+}
+
+// Mined transaction from pool address with nonce of payment, other is set if the nonce paid someone else
+func (u *PayoutsProcessor) findTransaction(ctx context.Context, client *rpc.RPCClient, p *storage.Payment) (tx *rpc.Tx, other bool, err error) {
+	head, err := client.GetBlockNumber(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	for height := p.Height; height <= head; height++ {
+		block, err := client.GetBlockByHeight(ctx, height)
+		if err != nil {
+			return nil, false, err
+		}
+		if block == nil {
+			continue
+		}
+		for _, tx := range block.Transactions {
+			if !strings.EqualFold(tx.From, u.config.Address) || util.String2Big(tx.Nonce).Uint64() != p.Nonce {
+				continue
+			}
+			if strings.EqualFold(tx.To, p.Recipient()) && util.String2Big(tx.Value).Cmp(paymentValue(p)) == 0 {
+				return &tx, false, nil
+			}
+			return nil, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+func (u *PayoutsProcessor) finishPayment(ctx context.Context, client *rpc.RPCClient, p *storage.Payment, receipt *rpc.TxReceipt) error {
+	if err := u.setFee(ctx, client, p, receipt); err != nil {
+		return err
+	}
+	if !receipt.Successful() {
+		log.Printf("Payout tx failed for %s: %s. Address contract throws on incoming tx, rolling back %v Shannon", p.Login, p.TxHash, p.Amount)
+		return u.backend.RollbackPayment(p, storage.PaymentFailed)
+	}
+	log.Printf("Payout tx successful for %s: %s, fee %v Shannon", p.Login, p.TxHash, p.Fee)
+	return u.backend.ConfirmPayment(p)
+}
@@ -0,0 +1,179 @@
+package payouts
+
+import (
+	"context"
+	"math/big"
+	"os"
+	"strconv"
+	"testing"
+
+	"github.com/cyberpoolorg/etc-stratum/fakenode"
+	"github.com/cyberpoolorg/etc-stratum/rpc"
+	"github.com/cyberpoolorg/etc-stratum/storage"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func newTestBackend(t *testing.T) *storage.RedisClient {
+	backend := storage.NewRedisClient(&storage.Config{Endpoint: "127.0.0.1:6379", PoolSize: 10}, "payouts-test")
+	if _, err := backend.Check(); err != nil {
+		t.Skipf("Redis is not available: %v", err)
+	}
+	reset := func() {
+		for _, key := range backend.Client().Keys("payouts-test:*").Val() {
+			backend.Client().Del(key)
+		}
+	}
+	reset()
+	t.Cleanup(reset)
+	return backend
+}
+
+func newTestProcessor(t *testing.T, node *fakenode.Node, cfg *PayoutsConfig) *PayoutsProcessor {
+	cfg.Upstream = []rpc.Upstream{{Name: "fake", Url: node.URL, Timeout: "5s"}}
+	signer, err := newSigner(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node.SetBalance(cfg.Address, new(big.Int).Mul(big.NewInt(100), big.NewInt(1e18)))
+	node.UnlockAccount(cfg.Address)
+	return &PayoutsProcessor{
+		config:    cfg,
+		backend:   newTestBackend(t),
+		upstreams: rpc.NewUpstreamPool("test", cfg.Upstream, false),
+		signer:    signer,
+		lockOwner: cfg.Address,
+		lockTTL:   payoutsLockTTL,
+	}
+}
+
+// Payment queued with nonce as processor does before sending it
+func queueTestPayment(t *testing.T, u *PayoutsProcessor, login string) *storage.Payment {
+	ctx := context.Background()
+	u.backend.Client().HIncrBy("payouts-test:miners:"+login, "balance", 1000)
+	nonce, _ := u.rpc().GetTransactionCount(ctx, u.config.Address, "pending")
+	height, _ := u.rpc().GetBlockNumber(ctx)
+	p := &storage.Payment{Login: login, Amount: 1000, State: storage.PaymentQueued, Nonce: nonce, Height: height}
+	if err := u.signer.sign(ctx, u.rpc(), p); err != nil {
+		t.Fatal(err)
+	}
+	if err := u.backend.QueuePayment(p); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func checkPayment(t *testing.T, u *PayoutsProcessor, node *fakenode.Node, p *storage.Payment, state string) {
+	record, _ := u.backend.GetPayment(p.Id)
+	if record == nil || record.State != state {
+		t.Errorf("Payment to %s must be %s, got %+v", p.Login, state, record)
+		return
+	}
+	balance, _ := u.backend.GetBalance(p.Login)
+	paid := node.Balance(p.Login).Int64()
+	switch {
+	case state == storage.PaymentConfirmed && (balance != 0 || paid != 1000*1e9):
+		t.Errorf("Payment to %s must be paid once, balance %v, received %v Wei", p.Login, balance, paid)
+	case state == storage.PaymentRolledBack && (balance != 1000 || paid != 0):
+		t.Errorf("Payment to %s must be rolled back, balance %v, received %v Wei", p.Login, balance, paid)
+	}
+}
+
+func TestRecoverNodeSignedPayments(t *testing.T) {
+	node := fakenode.New(1000, "0x0000000000000000000000000000000000000001")
+	defer node.Close()
+	u := newTestProcessor(t, node, &PayoutsConfig{Address: "0x00000000000000000000000000000000000000aa", AutoGas: true})
+	ctx := context.Background()
+
+	// Crashed before saving hash of sent transaction
+	lost := queueTestPayment(t, u, "0x00000000000000000000000000000000000000b1")
+	if _, err := u.signer.send(ctx, u.rpc(), lost); err != nil {
+		t.Fatal(err)
+	}
+	if u.recoverPayments(ctx, u.rpc()) {
+		t.Fatal("Must wait for transaction in tx pool")
+	}
+	node.Mine(1)
+	if !u.recoverPayments(ctx, u.rpc()) {
+		t.Fatal("Must find mined transaction by nonce")
+	}
+	checkPayment(t, u, node, lost, storage.PaymentConfirmed)
+
+	// Crashed before sending, or sent and still in tx pool of other nodes
+	unsent := queueTestPayment(t, u, "0x00000000000000000000000000000000000000b2")
+	if u.recoverPayments(ctx, u.rpc()) || len(node.Pending()) != 1 {
+		t.Fatal("Must send payment again with its nonce instead of rolling back")
+	}
+	node.Mine(1)
+	if !u.recoverPayments(ctx, u.rpc()) {
+		t.Fatal("Must resolve mined payment")
+	}
+	checkPayment(t, u, node, unsent, storage.PaymentConfirmed)
+
+	// Node restarted and lost transaction
+	dropped := queueTestPayment(t, u, "0x00000000000000000000000000000000000000b3")
+	dropped.TxHash, _ = u.signer.send(ctx, u.rpc(), dropped)
+	dropped.State = storage.PaymentBroadcast
+	u.backend.UpdatePayment(dropped)
+	node.DropPending()
+	if u.recoverPayments(ctx, u.rpc()) || len(node.Pending()) != 1 {
+		t.Fatal("Must send lost payment again")
+	}
+	node.Mine(1)
+	u.recoverPayments(ctx, u.rpc())
+	checkPayment(t, u, node, dropped, storage.PaymentConfirmed)
+
+	// Nonce taken by transaction sent by someone else
+	taken := queueTestPayment(t, u, "0x00000000000000000000000000000000000000b4")
+	u.rpc().SendTransaction(ctx, u.config.Address, "0x00000000000000000000000000000000000000cc", "", "", "0x1", "", true)
+	node.Mine(1)
+	u.recoverPayments(ctx, u.rpc())
+	checkPayment(t, u, node, taken, storage.PaymentRolledBack)
+
+	// Replaced by node with lost reply, mined hash is not known to payment
+	replaced := queueTestPayment(t, u, "0x00000000000000000000000000000000000000b5")
+	replaced.TxHash, _ = u.signer.send(ctx, u.rpc(), replaced)
+	replaced.State = storage.PaymentBroadcast
+	u.backend.UpdatePayment(replaced)
+	value := "0x" + paymentValue(replaced).Text(16)
+	nonce := "0x" + strconv.FormatUint(replaced.Nonce, 16)
+	mined, err := u.rpc().SendTransaction(ctx, u.config.Address, replaced.Login, "0x5208", "0xb2d05e00", value, nonce, false)
+	if err != nil || mined == replaced.TxHash {
+		t.Fatalf("Must replace payment tx: %v", err)
+	}
+	node.Mine(1)
+	if !u.recoverPayments(ctx, u.rpc()) {
+		t.Fatal("Must adopt mined transaction with nonce of payment")
+	}
+	checkPayment(t, u, node, replaced, storage.PaymentConfirmed)
+	if record, _ := u.backend.GetPayment(replaced.Id); record.TxHash != mined {
+		t.Errorf("Payment must record mined tx %v, got %v", mined, record.TxHash)
+	}
+
+	if payments, _ := u.backend.GetActivePayments(); len(payments) != 0 {
+		t.Errorf("All payments must be resolved, got %v", len(payments))
+	}
+}
+
+func TestRecoverSignedPayment(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	os.Setenv("TEST_RECOVERY_KEY", hexutil.Encode(crypto.FromECDSA(key)))
+	defer os.Unsetenv("TEST_RECOVERY_KEY")
+	node := fakenode.New(1000, "0x0000000000000000000000000000000000000001")
+	defer node.Close()
+	u := newTestProcessor(t, node, &PayoutsConfig{AutoGas: true, Signer: SignerConfig{Enabled: true, KeyEnv: "TEST_RECOVERY_KEY"}})
+	ctx := context.Background()
+
+	// Crashed after signing, signed transaction is sent again
+	p := queueTestPayment(t, u, "0x00000000000000000000000000000000000000b1")
+	if u.recoverPayments(ctx, u.rpc()) || len(node.Pending()) != 1 {
+		t.Fatal("Must send signed transaction again")
+	}
+	node.Mine(1)
+	if !u.recoverPayments(ctx, u.rpc()) {
+		t.Fatal("Must resolve mined payment")
+	}
+	checkPayment(t, u, node, p, storage.PaymentConfirmed)
+	u.recoverPayments(ctx, u.rpc())
+	checkPayment(t, u, node, p, storage.PaymentConfirmed)
+}
@@ -0,0 +1,95 @@
+package payouts
+
+import (
+	"context"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/cyberpoolorg/etc-stratum/rpc"
+	"github.com/cyberpoolorg/etc-stratum/storage"
+	"github.com/cyberpoolorg/etc-stratum/util"
+)
+
+// Nodes accept replacement with at least 10% higher gas price
+const defaultGasBumpPercent = 10
+
+func (u *PayoutsProcessor) stuck(p *storage.Payment) bool {
+	if u.replaceAfter <= 0 {
+		return false
+	}
+	sentAt := p.SentAt
+	if sentAt == 0 {
+		sentAt = p.UpdatedAt
+	}
+	return time.Since(time.Unix(0, sentAt*int64(time.Millisecond))) > u.replaceAfter
+}
+
+// Sends payment again with the same nonce and higher gas price, up to the ceiling.
+// Whichever of its transactions is mined finishes the payment.
+func (u *PayoutsProcessor) replacePayment(ctx context.Context, client *rpc.RPCClient, p *storage.Payment) error {
+	if _, ok := u.signer.(*nodeSigner); ok && p.Height == 0 {
+		// Hash of node signed replacement is known only from reply, without height recovery can't find it by nonce
+		log.Printf("Payment %s has no height to find replacement by nonce, tx %s is not replaced", p.Id, p.TxHash)
+		return nil
+	}
+	gasPrice := util.String2Big(p.GasPrice)
+	if gasPrice.Sign() == 0 {
+		// Node picked gas price
+		tx, err := client.GetTransactionByHash(ctx, p.TxHash)
+		if err != nil || tx == nil {
+			return err
+		}
+		gasPrice = util.String2Big(tx.GasPrice)
+	}
+	bump := u.config.GasBumpPercent
+	if bump <= 0 {
+		bump = defaultGasBumpPercent
+	}
+	bumped := new(big.Int).Mul(gasPrice, big.NewInt(100+bump))
+	bumped.Div(bumped, big.NewInt(100))
+	if ceiling := u.config.MaxGasPriceWei(); ceiling.Sign() > 0 && bumped.Cmp(ceiling) > 0 {
+		bumped = ceiling
+	}
+	if bumped.Cmp(gasPrice) <= 0 {
+		log.Printf("Payment %s is stuck at max gas price %v Wei, tx %s", p.Id, gasPrice, p.TxHash)
+		return nil
+	}
+
+	replacement := *p
+	replacement.GasPrice = bumped.String()
+	if err := u.signer.sign(ctx, client, &replacement); err != nil {
+		return err
+	}
+	stuck := p.TxHash
+	// Locally signed replacement is saved before sending, so it is known even if we crash meanwhile
+	if len(replacement.RawTx) > 0 {
+		u.setReplacement(p, &replacement)
+		if err := u.backend.UpdatePayment(p); err != nil {
+			return err
+		}
+	}
+	txHash, err := u.signer.send(ctx, client, &replacement)
+	if err != nil {
+		// Node signed one is found by nonce if it was sent and mined
+		return err
+	}
+	if len(replacement.RawTx) == 0 {
+		replacement.TxHash = txHash
+		u.setReplacement(p, &replacement)
+		if err := u.backend.UpdatePayment(p); err != nil {
+			return err
+		}
+	}
+	log.Printf("Replaced stuck tx %s of payment %s with %s, gas price %v Wei", stuck, p.Id, txHash, bumped)
+	return nil
+}
+
+func (u *PayoutsProcessor) setReplacement(p, replacement *storage.Payment) {
+	p.Replaced = append(p.Replaced, p.TxHash)
+	p.TxHash = replacement.TxHash
+	p.RawTx = replacement.RawTx
+	p.GasPrice = replacement.GasPrice
+	p.State = storage.PaymentBroadcast
+	p.SentAt = util.MakeTimestamp()
+}
@@ -0,0 +1,103 @@
+package payouts
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/cyberpoolorg/etc-stratum/fakenode"
+	"github.com/cyberpoolorg/etc-stratum/storage"
+	"github.com/cyberpoolorg/etc-stratum/util"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestReplaceStuckPayment(t *testing.T) {
+	node := fakenode.New(1000, "0x0000000000000000000000000000000000000001")
+	defer node.Close()
+	u := newTestProcessor(t, node, &PayoutsConfig{Address: "0x00000000000000000000000000000000000000aa", AutoGas: true, MaxGasPrice: "1100000000"})
+	ctx := context.Background()
+
+	p := queueTestPayment(t, u, "0x00000000000000000000000000000000000000b1")
+	p.TxHash, _ = u.signer.send(ctx, u.rpc(), p)
+	p.State = storage.PaymentBroadcast
+	p.SentAt = util.MakeTimestamp()
+	u.backend.UpdatePayment(p)
+	first := node.Pending()[0]
+
+	// Without height node signed replacement could not be found by nonce
+	p.Height = 0
+	u.backend.UpdatePayment(p)
+	u.replaceAfter = 1
+	u.recoverPayments(ctx, u.rpc())
+	if record, _ := u.backend.GetPayment(p.Id); len(record.Replaced) != 0 {
+		t.Fatalf("Must not replace node signed transaction without height, got %+v", record)
+	}
+	p.Height = 1
+	u.backend.UpdatePayment(p)
+
+	// Not stuck yet
+	u.replaceAfter = defaultTxTimeout
+	u.recoverPayments(ctx, u.rpc())
+	if record, _ := u.backend.GetPayment(p.Id); len(record.Replaced) != 0 {
+		t.Fatalf("Must not replace fresh transaction, got %+v", record)
+	}
+
+	u.replaceAfter = 1
+	u.recoverPayments(ctx, u.rpc())
+	record, _ := u.backend.GetPayment(p.Id)
+	pending := node.Pending()
+	if len(pending) != 1 || len(record.Replaced) != 1 || record.TxHash != pending[0].Hash || pending[0].GasPrice.Cmp(first.GasPrice) <= 0 {
+		t.Fatalf("Must replace stuck transaction with higher gas price, got %+v", record)
+	}
+
+	// Capped by max gas price
+	u.recoverPayments(ctx, u.rpc())
+	if again, _ := u.backend.GetPayment(p.Id); len(again.Replaced) != 1 {
+		t.Fatalf("Must not bump gas price above ceiling, got %+v", again)
+	}
+
+	node.Mine(1)
+	if !u.recoverPayments(ctx, u.rpc()) {
+		t.Fatal("Must resolve mined replacement")
+	}
+	checkPayment(t, u, node, p, storage.PaymentConfirmed)
+}
+
+func TestReplaceSignedPayment(t *testing.T) {
+	key, _ := crypto.GenerateKey()
+	os.Setenv("TEST_REPLACE_KEY", hexutil.Encode(crypto.FromECDSA(key)))
+	defer os.Unsetenv("TEST_REPLACE_KEY")
+	node := fakenode.New(1000, "0x0000000000000000000000000000000000000001")
+	defer node.Close()
+	u := newTestProcessor(t, node, &PayoutsConfig{AutoGas: true, Signer: SignerConfig{Enabled: true, KeyEnv: "TEST_REPLACE_KEY"}})
+	ctx := context.Background()
+
+	p := queueTestPayment(t, u, "0x00000000000000000000000000000000000000b1")
+	u.signer.send(ctx, u.rpc(), p)
+	p.State = storage.PaymentBroadcast
+	u.backend.UpdatePayment(p)
+	stuck := p.TxHash
+
+	// Reply to replacement is lost, it is saved already
+	u.replaceAfter = 1
+	node.Fail("eth_sendRawTransaction", 1, fakenode.Failure{Drop: true})
+	u.recoverPayments(ctx, u.rpc())
+	record, _ := u.backend.GetPayment(p.Id)
+	if record.TxHash == stuck || len(record.Replaced) != 1 || record.Replaced[0] != stuck || len(record.RawTx) == 0 {
+		t.Fatalf("Must save replacement before sending it, got %+v", record)
+	}
+	if pending := node.Pending(); len(pending) != 1 || pending[0].Hash != stuck {
+		t.Fatalf("Replacement must not reach node, got %+v", pending)
+	}
+
+	// Stuck one is mined anyway
+	node.Mine(1)
+	if !u.recoverPayments(ctx, u.rpc()) {
+		t.Fatal("Must resolve mined transaction")
+	}
+	checkPayment(t, u, node, p, storage.PaymentConfirmed)
+	if record, _ := u.backend.GetPayment(p.Id); record.TxHash != stuck {
+		t.Errorf("Payment must record mined tx %v, got %v", stuck, record.TxHash)
+	}
+}
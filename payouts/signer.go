@@ -0,0 +1,196 @@
+package payouts
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+
+	"github.com/cyberpoolorg/etc-stratum/rpc"
+	"github.com/cyberpoolorg/etc-stratum/storage"
+	"github.com/cyberpoolorg/etc-stratum/util"
+)
+
+const defaultGas = 21000
+
+// Local signer is used instead of unlocked node account when enabled.
+// Key is loaded from the first of keystore, keyFile and keyEnv set.
+type SignerConfig struct {
+	Enabled bool `json:"enabled"`
+	// Encrypted JSON key, as written by geth account new
+	Keystore     string `json:"keystore"`
+	PasswordFile string `json:"passwordFile"`
+	// Plain hex private key in a file or environment variable
+	KeyFile string `json:"keyFile"`
+	KeyEnv  string `json:"keyEnv"`
+	// Checked against eth_chainId of upstreams, node one is used if not set
+	ChainId int64 `json:"chainId"`
+}
+
+// Sends payout transactions from pool address
+type txSigner interface {
+	// Makes sure transactions can be sent from pool address
+	check(ctx context.Context, client *rpc.RPCClient) error
+	// Locally signed payment gets its hash and raw transaction, nonce is set by caller.
+	// Gas price of payment is used if set.
+	sign(ctx context.Context, client *rpc.RPCClient, p *storage.Payment) error
+	send(ctx context.Context, client *rpc.RPCClient, p *storage.Payment) (string, error)
+}
+
+func newSigner(cfg *PayoutsConfig) (txSigner, error) {
+	if !cfg.Signer.Enabled {
+		return &nodeSigner{config: cfg}, nil
+	}
+	key, err := loadKey(&cfg.Signer)
+	if err != nil {
+		return nil, err
+	}
+	address := crypto.PubkeyToAddress(key.PublicKey)
+	if len(cfg.Address) == 0 {
+		cfg.Address = strings.ToLower(address.Hex())
+	} else if common.HexToAddress(cfg.Address) != address {
+		return nil, fmt.Errorf("key is for %s, not pool address %s", address.Hex(), cfg.Address)
+	}
+	return &localSigner{config: cfg, key: key, address: address}, nil
+}
+
+func paymentValue(p *storage.Payment) *big.Int {
+	return new(big.Int).Mul(big.NewInt(p.Amount), util.Shannon)
+}
+
+func loadKey(cfg *SignerConfig) (*ecdsa.PrivateKey, error) {
+	switch {
+	case len(cfg.Keystore) > 0:
+		data, err := ioutil.ReadFile(cfg.Keystore)
+		if err != nil {
+			return nil, err
+		}
+		var password string
+		if len(cfg.PasswordFile) > 0 {
+			p, err := ioutil.ReadFile(cfg.PasswordFile)
+			if err != nil {
+				return nil, err
+			}
+			password = strings.TrimRight(string(p), "\r\n")
+		}
+		key, err := keystore.DecryptKey(data, password)
+		if err != nil {
+			return nil, err
+		}
+		return key.PrivateKey, nil
+	case len(cfg.KeyFile) > 0:
+		data, err := ioutil.ReadFile(cfg.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		return parseKey(string(data))
+	case len(cfg.KeyEnv) > 0:
+		v := os.Getenv(cfg.KeyEnv)
+		if len(v) == 0 {
+			return nil, fmt.Errorf("environment variable %s is empty", cfg.KeyEnv)
+		}
+		return parseKey(v)
+	}
+	return nil, errors.New("no keystore, keyFile or keyEnv set")
+}
+
+func parseKey(s string) (*ecdsa.PrivateKey, error) {
+	return crypto.HexToECDSA(strings.TrimPrefix(strings.TrimSpace(s), "0x"))
+}
+
+// Relies on pool account unlocked on the node
+type nodeSigner struct {
+	config *PayoutsConfig
+}
+
+func (s *nodeSigner) check(ctx context.Context, client *rpc.RPCClient) error {
+	_, err := client.Sign(ctx, s.config.Address, "0x0")
+	return err
+}
+
+// Node signs on send, nonce is fixed so a lost transaction can be found later
+func (s *nodeSigner) sign(ctx context.Context, client *rpc.RPCClient, p *storage.Payment) error {
+	return nil
+}
+
+func (s *nodeSigner) send(ctx context.Context, client *rpc.RPCClient, p *storage.Payment) (string, error) {
+	gas, gasPrice, autoGas := s.config.GasHex(), s.config.GasPriceHex(), s.config.AutoGas
+	if len(p.GasPrice) > 0 {
+		gas = hexutil.EncodeUint64(s.config.GasLimit())
+		gasPrice = hexutil.EncodeBig(util.String2Big(p.GasPrice))
+		autoGas = false
+	}
+	nonce := hexutil.EncodeUint64(p.Nonce)
+	return client.SendTransaction(ctx, s.config.Address, p.Recipient(), gas, gasPrice, hexutil.EncodeBig(paymentValue(p)), nonce, autoGas)
+}
+
+// Signs EIP-155 transactions with local key and sends them raw
+type localSigner struct {
+	config  *PayoutsConfig
+	key     *ecdsa.PrivateKey
+	address common.Address
+	chainId *big.Int
+}
+
+func (s *localSigner) check(ctx context.Context, client *rpc.RPCClient) error {
+	chainId, err := client.GetChainId(ctx)
+	if err != nil {
+		return err
+	}
+	if s.config.Signer.ChainId > 0 && chainId.Int64() != s.config.Signer.ChainId {
+		return fmt.Errorf("upstream %s is on chain %v, expected %v", client.Name, chainId, s.config.Signer.ChainId)
+	}
+	s.chainId = chainId
+	return nil
+}
+
+func (s *localSigner) sign(ctx context.Context, client *rpc.RPCClient, p *storage.Payment) error {
+	if s.chainId == nil {
+		if err := s.check(ctx, client); err != nil {
+			return err
+		}
+	}
+	var err error
+	gasPrice := s.config.GasPriceWei()
+	if len(p.GasPrice) > 0 {
+		gasPrice = util.String2Big(p.GasPrice)
+	} else if s.config.AutoGas {
+		if gasPrice, err = client.GetGasPrice(ctx); err != nil {
+			return err
+		}
+	}
+
+	tx := types.NewTransaction(p.Nonce, common.HexToAddress(p.Recipient()), paymentValue(p), s.config.GasLimit(), gasPrice, nil)
+	signed, err := types.SignTx(tx, types.NewEIP155Signer(s.chainId), s.key)
+	if err != nil {
+		return err
+	}
+	data, err := signed.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	p.TxHash = signed.Hash().Hex()
+	p.RawTx = hexutil.Encode(data)
+	p.GasPrice = gasPrice.String()
+	p.State = storage.PaymentSigned
+	return nil
+}
+
+// Hash is known before sending, so it is returned even if reply was lost
+func (s *localSigner) send(ctx context.Context, client *rpc.RPCClient, p *storage.Payment) (string, error) {
+	_, err := client.SendRawTransaction(ctx, p.RawTx)
+	if rpc.IsRPCError(err) {
+		return "", err
+	}
+	return p.TxHash, err
+}
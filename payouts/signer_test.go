@@ -0,0 +1,93 @@
+package payouts
+
+import (
+	"context"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cyberpoolorg/etc-stratum/fakenode"
+	"github.com/cyberpoolorg/etc-stratum/rpc"
+	"github.com/cyberpoolorg/etc-stratum/storage"
+	"github.com/ethereum/go-ethereum/accounts/keystore"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+func TestLoadKeystore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "signer")
+	defer os.RemoveAll(dir)
+	account, err := keystore.StoreKey(dir, "secret", keystore.LightScryptN, keystore.LightScryptP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.WriteFile(filepath.Join(dir, "password"), []byte("secret\n"), 0600)
+
+	signer := SignerConfig{Enabled: true, Keystore: account.URL.Path, PasswordFile: filepath.Join(dir, "password")}
+	cfg := &PayoutsConfig{Signer: signer}
+	if _, err := newSigner(cfg); err != nil {
+		t.Fatalf("Must load keystore: %v", err)
+	}
+	if cfg.Address != strings.ToLower(account.Address.Hex()) {
+		t.Errorf("Must use key address as pool address, got %v", cfg.Address)
+	}
+	cfg = &PayoutsConfig{Signer: signer, Address: "0x00000000000000000000000000000000000000aa"}
+	if _, err := newSigner(cfg); err == nil {
+		t.Error("Must reject key of other address")
+	}
+}
+
+func TestLocalSigner(t *testing.T) {
+	priv, _ := crypto.GenerateKey()
+	os.Setenv("TEST_PAYOUTS_KEY", hexutil.Encode(crypto.FromECDSA(priv)))
+	defer os.Unsetenv("TEST_PAYOUTS_KEY")
+	node := fakenode.New(1000, "0x0000000000000000000000000000000000000001")
+	defer node.Close()
+	client := rpc.NewRPCClient("test", node.URL, "5s", nil)
+	ctx := context.Background()
+
+	cfg := &PayoutsConfig{AutoGas: true, Signer: SignerConfig{Enabled: true, KeyEnv: "TEST_PAYOUTS_KEY", ChainId: 62}}
+	signer, err := newSigner(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := signer.check(ctx, client); err == nil {
+		t.Error("Must reject upstream on other chain")
+	}
+	cfg.Signer.ChainId = 61
+	if err := signer.check(ctx, client); err != nil {
+		t.Fatalf("Must accept upstream: %v", err)
+	}
+
+	node.SetBalance(cfg.Address, big.NewInt(1e18))
+	miner := "0x00000000000000000000000000000000000000bb"
+	pay := func() (string, error) {
+		nonce, _ := client.GetTransactionCount(ctx, cfg.Address, "pending")
+		p := &storage.Payment{Login: miner, Amount: 1000, Nonce: nonce}
+		if err := signer.sign(ctx, client, p); err != nil {
+			return "", err
+		}
+		return signer.send(ctx, client, p)
+	}
+	node.Fail("eth_sendRawTransaction", 1, fakenode.Failure{Code: -32000, Message: "txpool is full"})
+	if _, err := pay(); !rpc.IsRPCError(err) {
+		t.Fatalf("Must fail with node error, got %v", err)
+	}
+	// Rejected transaction must not take a nonce, both get into the same block
+	for i := 0; i < 2; i++ {
+		if _, err := pay(); err != nil {
+			t.Fatalf("Must send tx: %v", err)
+		}
+	}
+	pending := node.Pending()
+	if len(pending) != 2 || pending[0].Nonce != 0 || pending[1].Nonce != 1 {
+		t.Fatalf("Expected nonces 0 and 1, got %+v", pending)
+	}
+	node.Mine(1)
+	if node.Balance(miner).Int64() != 2000*1e9 {
+		t.Errorf("Miner must receive payments, got %v", node.Balance(miner))
+	}
+}
@@ -1,6 +1,8 @@
 package payouts
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"math/big"
@@ -16,18 +18,23 @@ import (
 )
 
 type UnlockerConfig struct {
-	Enabled           bool     `json:"enabled"`
-	PoolFee           float64  `json:"poolFee"`
-	PoolFeeAddress    string   `json:"poolFeeAddress"`
-	Donate            bool     `json:"donate"`
-	Depth             int64    `json:"depth"`
-	ImmatureDepth     int64    `json:"immatureDepth"`
-	KeepTxFees        bool     `json:"keepTxFees"`
-	Interval          string   `json:"interval"`
-	Daemon            string   `json:"daemon"`
-	Timeout           string   `json:"timeout"`
-	Ecip1017FBlock    int64    `json:"ecip1017FBlock"`
-	Ecip1017EraRounds *big.Int `json:"ecip1017EraRounds"`
+	Enabled           bool           `json:"enabled"`
+	PoolFee           float64        `json:"poolFee"`
+	PoolFeeAddress    string         `json:"poolFeeAddress"`
+	Donate            bool           `json:"donate"`
+	Depth             int64          `json:"depth"`
+	ImmatureDepth     int64          `json:"immatureDepth"`
+	KeepTxFees        bool           `json:"keepTxFees"`
+	Interval          string         `json:"interval"`
+	Daemon            string         `json:"daemon"`
+	Timeout           string         `json:"timeout"`
+	Auth              rpc.Auth       `json:"auth" structs:",omitnested"`
+	Upstream          []rpc.Upstream `json:"upstream" structs:",omitnested"`
+	MinSynced         int            `json:"minSynced"`
+	BatchSize         int            `json:"batchSize"`
+	Concurrency       int            `json:"concurrency"`
+	Ecip1017FBlock    int64          `json:"ecip1017FBlock"`
+	Ecip1017EraRounds *big.Int       `json:"ecip1017EraRounds"`
 }
 
 const minDepth = 16
@@ -40,11 +47,11 @@ var big8 = big.NewInt(8)
 var homesteadReward = math.MustParseBig256("5000000000000000000")
 
 type BlockUnlocker struct {
-	config   *UnlockerConfig
-	backend  *storage.RedisClient
-	rpc      *rpc.RPCClient
-	halt     bool
-	lastFail error
+	config    *UnlockerConfig
+	backend   *storage.RedisClient
+	upstreams *rpc.Pool
+	halt      bool
+	lastFail  error
 }
 
 func NewBlockUnlocker(cfg *UnlockerConfig, backend *storage.RedisClient, network *string) *BlockUnlocker {
@@ -68,16 +75,22 @@ func NewBlockUnlocker(cfg *UnlockerConfig, backend *storage.RedisClient, network
 		log.Fatalf("Immature depth can't be < %v, your depth is %v", minDepth, cfg.ImmatureDepth)
 	}
 	u := &BlockUnlocker{config: cfg, backend: backend}
-	u.rpc = rpc.NewRPCClient("BlockUnlocker", cfg.Daemon, cfg.Timeout)
+	upstreams := rpc.UpstreamList(cfg.Upstream, "BlockUnlocker", cfg.Daemon, cfg.Timeout, cfg.Auth)
+	u.upstreams = rpc.NewUpstreamPool("BlockUnlocker", upstreams, false)
 	return u
 }
 
+func (u *BlockUnlocker) rpc() *rpc.RPCClient {
+	return u.upstreams.Client()
+}
+
 func (u *BlockUnlocker) Start() {
 	log.Println("Starting block unlocker")
 	intv := util.MustParseDuration(u.config.Interval)
 	timer := time.NewTimer(intv)
 	log.Printf("Set block unlock interval to %v", intv)
 
+	u.upstreams.Check()
 	u.unlockPendingBlocks()
 	u.unlockAndCreditMiners()
 	timer.Reset(intv)
@@ -86,6 +99,7 @@ func (u *BlockUnlocker) Start() {
 		for {
 			select {
 			case <-timer.C:
+				u.upstreams.Check()
 				u.unlockPendingBlocks()
 				u.unlockAndCreditMiners()
 				timer.Reset(intv)
@@ -102,42 +116,67 @@ type UnlockResult struct {
 	blocks         int
 }
 
-func (u *BlockUnlocker) unlockCandidates(candidates []*storage.BlockData) (*UnlockResult, error) {
+func (u *BlockUnlocker) unlockCandidates(ctx context.Context, candidates []*storage.BlockData) (*UnlockResult, error) {
 	result := &UnlockResult{}
 
+	// Fetch all blocks around candidates at once
+	var heights []int64
+	seen := make(map[int64]bool)
 	for _, candidate := range candidates {
-		orphan := true
-
+		// avoid scanning the first 16 blocks
 		if candidate.Height < minDepth {
-			orphan = false
-			// avoid scanning the first 16 blocks
 			continue
 		}
-		for i := int64(minDepth * -1); i < minDepth; i++ {
-			height := candidate.Height + i
+		for _, height := range scanHeights(candidate) {
+			if !seen[height] {
+				seen[height] = true
+				heights = append(heights, height)
+			}
+		}
+	}
+	blocks, err := u.fetchBlocks(ctx, heights)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
 
-			if height < 0 {
-				continue
+	// Uncles are needed only for candidates which are not main chain blocks
+	var refs []uncleRef
+	seenRefs := make(map[uncleRef]bool)
+	for _, candidate := range candidates {
+		if candidate.Height < minDepth || findBlock(blocks, candidate) != nil {
+			continue
+		}
+		for _, height := range scanHeights(candidate) {
+			for index := range blocks[height].Uncles {
+				ref := uncleRef{height, index}
+				if !seenRefs[ref] {
+					seenRefs[ref] = true
+					refs = append(refs, ref)
+				}
 			}
+		}
+	}
+	uncles, err := u.fetchUncles(ctx, refs)
+	if err != nil {
+		return nil, err
+	}
 
-			block, err := u.rpc.GetBlockByHeight(height)
+	for _, candidate := range candidates {
+		if candidate.Height < minDepth {
+			continue
+		}
+		orphan := true
 
-			if err != nil {
-				log.Printf("Error while retrieving block %v from node: %v", height, err)
-				return nil, err
-			}
-			if block == nil {
-				return nil, fmt.Errorf("Error while retrieving block %v from node, wrong node height", height)
-			}
+		for _, height := range scanHeights(candidate) {
+			block := blocks[height]
 
 			if matchCandidate(block, candidate) {
 				orphan = false
 				result.blocks++
 
-				err = u.handleBlock(block, candidate)
+				err = u.handleBlock(ctx, block, candidate)
 				if err != nil {
-					u.halt = true
-					u.lastFail = err
 					return nil, err
 				}
 				result.maturedBlocks = append(result.maturedBlocks, candidate)
@@ -145,35 +184,24 @@ func (u *BlockUnlocker) unlockCandidates(candidates []*storage.BlockData) (*Unlo
 				break
 			}
 
-			if len(block.Uncles) == 0 {
-				continue
-			}
-
-			for uncleIndex, uncleHash := range block.Uncles {
-				uncle, err := u.rpc.GetUncleByBlockNumberAndIndex(height, uncleIndex)
-				if err != nil {
-					return nil, fmt.Errorf("Error while retrieving uncle of block %v from node: %v", uncleHash, err)
-				}
-				if uncle == nil {
-					return nil, fmt.Errorf("Error while retrieving uncle of block %v from node", height)
+			for uncleIndex := range block.Uncles {
+				uncle, ok := uncles[uncleRef{height, uncleIndex}]
+				if !ok || !matchCandidate(uncle, candidate) {
+					continue
 				}
 
 				// Found uncle
-				if matchCandidate(uncle, candidate) {
-					orphan = false
-					result.uncles++
-
-					err := handleUncle(height, uncle, candidate, u.config)
-					if err != nil {
-						u.halt = true
-						u.lastFail = err
-						return nil, err
-					}
-					result.maturedBlocks = append(result.maturedBlocks, candidate)
-					log.Printf("Mature uncle %v/%v of reward %v with hash: %v", candidate.Height, candidate.UncleHeight,
-						util.FormatReward(candidate.Reward), uncle.Hash[0:10])
-					break
+				orphan = false
+				result.uncles++
+
+				err := handleUncle(height, uncle, candidate, u.config)
+				if err != nil {
+					return nil, err
 				}
+				result.maturedBlocks = append(result.maturedBlocks, candidate)
+				log.Printf("Mature uncle %v/%v of reward %v with hash: %v", candidate.Height, candidate.UncleHeight,
+					util.FormatReward(candidate.Reward), uncle.Hash[0:10])
+				break
 			}
 
 			if !orphan {
@@ -191,6 +219,25 @@ func (u *BlockUnlocker) unlockCandidates(candidates []*storage.BlockData) (*Unlo
 	return result, nil
 }
 
+func scanHeights(candidate *storage.BlockData) []int64 {
+	var heights []int64
+	for i := int64(minDepth * -1); i < minDepth; i++ {
+		if height := candidate.Height + i; height >= 0 {
+			heights = append(heights, height)
+		}
+	}
+	return heights
+}
+
+func findBlock(blocks map[int64]*rpc.GetBlockReply, candidate *storage.BlockData) *rpc.GetBlockReply {
+	for _, height := range scanHeights(candidate) {
+		if matchCandidate(blocks[height], candidate) {
+			return blocks[height]
+		}
+	}
+	return nil
+}
+
 func matchCandidate(block *rpc.GetBlockReply, candidate *storage.BlockData) bool {
 
 	if len(candidate.Hash) > 0 && strings.EqualFold(candidate.Hash, block.Hash) {
@@ -207,7 +254,7 @@ func matchCandidate(block *rpc.GetBlockReply, candidate *storage.BlockData) bool
 	return false
 }
 
-func (u *BlockUnlocker) handleBlock(block *rpc.GetBlockReply, candidate *storage.BlockData) error {
+func (u *BlockUnlocker) handleBlock(ctx context.Context, block *rpc.GetBlockReply, candidate *storage.BlockData) error {
 	correctHeight, err := strconv.ParseInt(strings.Replace(block.Number, "0x", "", -1), 16, 64)
 	if err != nil {
 		return err
@@ -220,9 +267,9 @@ func (u *BlockUnlocker) handleBlock(block *rpc.GetBlockReply, candidate *storage
 	rewardForUncles := big.NewInt(0).Mul(uncleReward, big.NewInt(int64(len(block.Uncles))))
 	reward.Add(reward, rewardForUncles)
 
-	extraTxReward, err := u.getExtraRewardForTx(block)
+	extraTxReward, err := u.getExtraRewardForTx(ctx, block)
 	if err != nil {
-		return fmt.Errorf("Error while fetching TX receipt: %v", err)
+		return fmt.Errorf("Error while fetching TX receipt: %w", err)
 	}
 	if u.config.KeepTxFees {
 		candidate.ExtraReward = extraTxReward
@@ -251,16 +298,57 @@ func handleUncle(height int64, uncle *rpc.GetBlockReply, candidate *storage.Bloc
 	return nil
 }
 
+// Blocks are credited only if all synced upstreams have the same block at height
+func (u *BlockUnlocker) checkConsensus(ctx context.Context, height int64) error {
+	synced := u.upstreams.Synced()
+	required := u.config.MinSynced
+	if required <= 0 {
+		required = 1
+	}
+	if len(synced) < required {
+		return fmt.Errorf("%v of %v upstreams are synced, %v required", len(synced), len(u.upstreams.Clients()), required)
+	}
+	var hash, source string
+	for _, client := range synced {
+		block, err := client.GetBlockByHeight(ctx, height)
+		if err != nil {
+			return fmt.Errorf("failed to get block %v from %s: %w", height, client.Name, err)
+		}
+		if block == nil {
+			return fmt.Errorf("%s has no block %v", client.Name, height)
+		}
+		if len(source) == 0 {
+			hash, source = block.Hash, client.Name
+		} else if !strings.EqualFold(hash, block.Hash) {
+			return fmt.Errorf("%s and %s disagree on block %v: %v != %v", source, client.Name, height, hash, block.Hash)
+		}
+	}
+	return nil
+}
+
+// Node outages are retried on next run, anything else needs operator attention
+func (u *BlockUnlocker) fail(err error) {
+	if rpc.IsTemporary(err) {
+		log.Printf("Node is unavailable, will retry on next run: %v", err)
+		return
+	}
+	u.halt = true
+	u.lastFail = err
+}
+
 func (u *BlockUnlocker) unlockPendingBlocks() {
 	if u.halt {
 		log.Println("Unlocking suspended due to last critical error:", u.lastFail)
 		return
 	}
 
-	current, err := u.rpc.GetPendingBlock()
+	ctx := context.Background()
+	current, err := u.rpc().GetPendingBlock(ctx)
+	if err == nil && current == nil {
+		err = &rpc.NodeError{Err: errors.New("no pending block")}
+	}
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.fail(err)
 		log.Printf("Unable to get current blockchain height from node: %v", err)
 		return
 	}
@@ -285,10 +373,9 @@ func (u *BlockUnlocker) unlockPendingBlocks() {
 		return
 	}
 
-	result, err := u.unlockCandidates(candidates)
+	result, err := u.unlockCandidates(ctx, candidates)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.fail(err)
 		log.Printf("Failed to unlock blocks: %v", err)
 		return
 	}
@@ -355,10 +442,13 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 		return
 	}
 
-	current, err := u.rpc.GetPendingBlock()
+	ctx := context.Background()
+	current, err := u.rpc().GetPendingBlock(ctx)
+	if err == nil && current == nil {
+		err = &rpc.NodeError{Err: errors.New("no pending block")}
+	}
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		u.fail(err)
 		log.Printf("Unable to get current blockchain height from node: %v", err)
 		return
 	}
@@ -383,10 +473,16 @@ func (u *BlockUnlocker) unlockAndCreditMiners() {
 		return
 	}
 
-	result, err := u.unlockCandidates(immature)
+	// Highest block scanned for candidates, agreeing on it means agreeing on all of them
+	err = u.checkConsensus(ctx, currentHeight-u.config.Depth+minDepth)
 	if err != nil {
-		u.halt = true
-		u.lastFail = err
+		log.Printf("Skipping credit of miners, will retry on next run: %v", err)
+		return
+	}
+
+	result, err := u.unlockCandidates(ctx, immature)
+	if err != nil {
+		u.fail(err)
 		log.Printf("Failed to unlock blocks: %v", err)
 		return
 	}
@@ -551,15 +647,20 @@ func getUncleReward(uHeight *big.Int, height *big.Int, era *big.Int, reward *big
 	return getRewardForUncle(reward)
 }
 
-func (u *BlockUnlocker) getExtraRewardForTx(block *rpc.GetBlockReply) (*big.Int, error) {
+func (u *BlockUnlocker) getExtraRewardForTx(ctx context.Context, block *rpc.GetBlockReply) (*big.Int, error) {
 	amount := new(big.Int)
 
+	hashes := make([]string, len(block.Transactions))
+	for i, tx := range block.Transactions {
+		hashes[i] = tx.Hash
+	}
+	receipts, err := u.fetchReceipts(ctx, hashes)
+	if err != nil {
+		return nil, err
+	}
 	for _, tx := range block.Transactions {
-		receipt, err := u.rpc.GetTxReceipt(tx.Hash)
-		if err != nil {
-			return nil, err
-		}
-		if receipt != nil {
+		receipt, ok := receipts[tx.Hash]
+		if ok {
 			gasUsed := util.String2Big(receipt.GasUsed)
 			gasPrice := util.String2Big(tx.GasPrice)
 			fee := new(big.Int).Mul(gasUsed, gasPrice)
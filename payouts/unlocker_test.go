@@ -1,6 +1,8 @@
 package payouts
 
 import (
+	"context"
+	"github.com/cyberpoolorg/etc-stratum/fakenode"
 	"github.com/cyberpoolorg/etc-stratum/rpc"
 	"github.com/cyberpoolorg/etc-stratum/storage"
 	"math/big"
@@ -163,3 +165,99 @@ func TestMatchCandidate(t *testing.T) {
 		t.Error("Must match with hash")
 	}
 }
+
+func newTestUnlocker(urls ...string) *BlockUnlocker {
+	var upstreams []rpc.Upstream
+	for _, url := range urls {
+		upstreams = append(upstreams, rpc.Upstream{Name: url, Url: url, Timeout: "5s"})
+	}
+	cfg := &UnlockerConfig{Ecip1017EraRounds: big.NewInt(5000000)}
+	return &BlockUnlocker{config: cfg, upstreams: rpc.NewUpstreamPool("test", upstreams, false)}
+}
+
+func TestUnlockCandidates(t *testing.T) {
+	node := fakenode.New(1000, "0x0000000000000000000000000000000000000001")
+	defer node.Close()
+
+	node.Mine(20)
+	node.MineBlock(&fakenode.Block{Nonce: "0x00000000000000a1"})
+	uncle := node.SideBlock(22, "0x00000000000000a2")
+	node.Mine(1)
+	node.MineBlock(&fakenode.Block{Uncles: []*fakenode.Block{uncle}})
+	node.MineBlock(&fakenode.Block{Nonce: "0x00000000000000a4"})
+	node.Mine(5)
+	node.Reorg(6, 40)
+
+	candidates := []*storage.BlockData{
+		{Height: 21, RoundHeight: 21, Nonce: "0x00000000000000a1"},
+		{Height: 22, RoundHeight: 22, Nonce: "0x00000000000000a2"},
+		{Height: 24, RoundHeight: 24, Nonce: "0x00000000000000a3"},
+		{Height: 25, RoundHeight: 25, Nonce: "0x00000000000000a4"},
+	}
+	result, err := newTestUnlocker(node.URL).unlockCandidates(context.Background(), candidates)
+	if err != nil {
+		t.Fatalf("Unlock failed: %v", err)
+	}
+	if result.blocks != 1 || result.uncles != 1 || result.orphans != 2 {
+		t.Fatalf("Expected 1 block, 1 uncle and 2 orphans, got %v, %v and %v", result.blocks, result.uncles, result.orphans)
+	}
+	if candidates[0].Hash != node.BlockByNumber(21).Hash || candidates[0].Reward.String() != "5000000000000000000" {
+		t.Errorf("Unexpected block %+v", candidates[0])
+	}
+	if candidates[1].Height != 23 || candidates[1].UncleHeight != 22 || candidates[1].Hash != uncle.Hash {
+		t.Errorf("Unexpected uncle %+v", candidates[1])
+	}
+	if candidates[1].Reward.String() != "4375000000000000000" {
+		t.Errorf("Unexpected uncle reward %v", candidates[1].Reward)
+	}
+	if !candidates[2].Orphan || !candidates[3].Orphan {
+		t.Error("Missing and reorged blocks must be orphans")
+	}
+}
+
+func TestCheckConsensus(t *testing.T) {
+	coinbase := "0x0000000000000000000000000000000000000001"
+	main, backup, fork := fakenode.New(1000, coinbase), fakenode.New(1000, coinbase), fakenode.New(1000, coinbase)
+	defer main.Close()
+	defer backup.Close()
+	defer fork.Close()
+	for _, node := range []*fakenode.Node{main, backup, fork} {
+		node.Mine(40)
+	}
+	fork.Reorg(5, 5)
+
+	u := newTestUnlocker(main.URL, backup.URL)
+	u.upstreams.Check()
+	if err := u.checkConsensus(context.Background(), 38); err != nil {
+		t.Errorf("Nodes must agree: %v", err)
+	}
+
+	u = newTestUnlocker(main.URL, backup.URL, fork.URL)
+	u.upstreams.Check()
+	if err := u.checkConsensus(context.Background(), 30); err != nil {
+		t.Errorf("Nodes must agree below fork: %v", err)
+	}
+	if err := u.checkConsensus(context.Background(), 38); err == nil {
+		t.Error("Must detect node on another chain")
+	}
+
+	fork.SetSyncing(true)
+	u.upstreams.Check()
+	if err := u.checkConsensus(context.Background(), 38); err != nil {
+		t.Errorf("Syncing node must be ignored: %v", err)
+	}
+
+	u.config.MinSynced = 3
+	if err := u.checkConsensus(context.Background(), 38); err == nil {
+		t.Error("Must require minimum number of synced nodes")
+	}
+
+	u.config.MinSynced = 0
+	for _, node := range []*fakenode.Node{main, backup} {
+		node.SetSyncing(true)
+	}
+	u.upstreams.Check()
+	if err := u.checkConsensus(context.Background(), 38); err == nil {
+		t.Error("Must not credit miners while all nodes are syncing")
+	}
+}
@@ -0,0 +1,182 @@
+package policy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Firewall backend applying bans outside of the process
+type Banner interface {
+	Ban(ip string, timeout int64) error
+	Unban(ip string) error
+}
+
+func NewBanner(cfg *Banning) (Banner, error) {
+	switch cfg.Backend {
+	case "", "ipset":
+		if len(cfg.IPSet) == 0 {
+			return NewMemoryBanner(), nil
+		}
+		return &ipsetBanner{set: cfg.IPSet, sudo: !cfg.NoSudo}, nil
+	case "nftables":
+		if len(cfg.NftTable) == 0 || len(cfg.NftSet) == 0 {
+			return nil, fmt.Errorf("nftables backend requires nftTable and nftSet")
+		}
+		family := cfg.NftFamily
+		if len(family) == 0 {
+			family = "inet"
+		}
+		return &nftablesBanner{family: family, table: cfg.NftTable, set: cfg.NftSet, sudo: !cfg.NoSudo}, nil
+	case "iptables":
+		if len(cfg.IPTablesChain) == 0 {
+			return nil, fmt.Errorf("iptables backend requires iptablesChain")
+		}
+		return &iptablesBanner{chain: cfg.IPTablesChain, sudo: !cfg.NoSudo}, nil
+	case "webhook":
+		if len(cfg.Webhook) == 0 {
+			return nil, fmt.Errorf("webhook backend requires webhook url")
+		}
+		return &webhookBanner{url: cfg.Webhook, client: &http.Client{Timeout: 10 * time.Second}}, nil
+	case "log", "memory":
+		return NewMemoryBanner(), nil
+	}
+	return nil, fmt.Errorf("unknown banning backend %q", cfg.Backend)
+}
+
+func runCmd(sudo bool, cmd string, args ...string) error {
+	if sudo {
+		args = append([]string{cmd}, args...)
+		cmd = "sudo"
+	}
+	out, err := exec.Command(cmd, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", cmd, strings.Join(args, " "), err, bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+type ipsetBanner struct {
+	set  string
+	sudo bool
+}
+
+func (b *ipsetBanner) Ban(ip string, timeout int64) error {
+	log.Printf("Banned %v with timeout %v on ipset %s", ip, timeout, b.set)
+	return runCmd(b.sudo, "ipset", "add", b.set, ip, "timeout", fmt.Sprint(timeout), "-!")
+}
+
+func (b *ipsetBanner) Unban(ip string) error {
+	log.Printf("Unbanned %v on ipset %s", ip, b.set)
+	return runCmd(b.sudo, "ipset", "del", b.set, ip, "-!")
+}
+
+// Set must be created with timeout flag
+type nftablesBanner struct {
+	family string
+	table  string
+	set    string
+	sudo   bool
+}
+
+func (b *nftablesBanner) Ban(ip string, timeout int64) error {
+	log.Printf("Banned %v with timeout %v on nftables set %s", ip, timeout, b.set)
+	element := fmt.Sprintf("{ %s timeout %ds }", ip, timeout)
+	return runCmd(b.sudo, "nft", "add", "element", b.family, b.table, b.set, element)
+}
+
+func (b *nftablesBanner) Unban(ip string) error {
+	log.Printf("Unbanned %v on nftables set %s", ip, b.set)
+	element := fmt.Sprintf("{ %s }", ip)
+	return runCmd(b.sudo, "nft", "delete", "element", b.family, b.table, b.set, element)
+}
+
+// Rules have no expiry, bans are lifted by policy reset
+type iptablesBanner struct {
+	chain string
+	sudo  bool
+}
+
+func (b *iptablesBanner) command(ip string) string {
+	if strings.Contains(ip, ":") {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+func (b *iptablesBanner) Ban(ip string, timeout int64) error {
+	log.Printf("Banned %v on iptables chain %s", ip, b.chain)
+	return runCmd(b.sudo, b.command(ip), "-I", b.chain, "-s", ip, "-j", "DROP")
+}
+
+func (b *iptablesBanner) Unban(ip string) error {
+	log.Printf("Unbanned %v on iptables chain %s", ip, b.chain)
+	return runCmd(b.sudo, b.command(ip), "-D", b.chain, "-s", ip, "-j", "DROP")
+}
+
+type webhookBanner struct {
+	url    string
+	client *http.Client
+}
+
+func (b *webhookBanner) Ban(ip string, timeout int64) error {
+	log.Printf("Banned %v with timeout %v through webhook", ip, timeout)
+	return b.post(map[string]interface{}{"action": "ban", "ip": ip, "timeout": timeout})
+}
+
+func (b *webhookBanner) Unban(ip string) error {
+	log.Printf("Unbanned %v through webhook", ip)
+	return b.post(map[string]interface{}{"action": "unban", "ip": ip})
+}
+
+func (b *webhookBanner) post(body interface{}) error {
+	data, _ := json.Marshal(body)
+	resp, err := b.client.Post(b.url, "application/json", bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook replied %s", resp.Status)
+	}
+	return nil
+}
+
+// Keeps bans in memory only, useful without firewall access and in tests
+type MemoryBanner struct {
+	sync.RWMutex
+	banned map[string]int64
+}
+
+func NewMemoryBanner() *MemoryBanner {
+	return &MemoryBanner{banned: make(map[string]int64)}
+}
+
+func (b *MemoryBanner) Ban(ip string, timeout int64) error {
+	b.Lock()
+	defer b.Unlock()
+	b.banned[ip] = timeout
+	log.Println("Banned peer", ip)
+	return nil
+}
+
+func (b *MemoryBanner) Unban(ip string) error {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.banned, ip)
+	log.Println("Unbanned peer", ip)
+	return nil
+}
+
+func (b *MemoryBanner) IsBanned(ip string) bool {
+	b.RLock()
+	defer b.RUnlock()
+	_, ok := b.banned[ip]
+	return ok
+}
@@ -0,0 +1,112 @@
+package policy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/cyberpoolorg/etc-stratum/storage"
+)
+
+const policyChannel = "policy"
+
+type controlMessage struct {
+	Action string `json:"action"`
+	IP     string `json:"ip,omitempty"`
+}
+
+// Listens for changes made through any instance
+func (s *PolicyServer) subscribe() {
+	for {
+		err := s.storage.Subscribe(policyChannel, s.handleControlMessage)
+		log.Printf("Subscription to %s channel lost: %v", policyChannel, err)
+		time.Sleep(time.Second)
+	}
+}
+
+func (s *PolicyServer) handleControlMessage(payload string) {
+	var msg controlMessage
+	if err := json.Unmarshal([]byte(payload), &msg); err != nil {
+		log.Printf("Malformed policy message: %v", err)
+		return
+	}
+	switch msg.Action {
+	case "refresh":
+		s.refreshState()
+	case "unban":
+		s.liftBan(msg.IP)
+	default:
+		log.Printf("Unknown policy action %q", msg.Action)
+	}
+}
+
+func (s *PolicyServer) publish(msg *controlMessage) error {
+	data, _ := json.Marshal(msg)
+	return s.storage.Publish(policyChannel, string(data))
+}
+
+func (s *PolicyServer) liftBan(ip string) {
+	s.statsMu.Lock()
+	x, ok := s.stats[ip]
+	if ok {
+		delete(s.stats, ip)
+	}
+	s.statsMu.Unlock()
+
+	if ok && atomic.LoadInt32(&x.Banned) > 0 {
+		log.Printf("Ban lifted for %v", ip)
+		s.banChannel <- banRequest{ip: ip, unban: true}
+	}
+}
+
+func (s *PolicyServer) GetList(name string) ([]string, error) {
+	switch name {
+	case "blacklist":
+		return s.storage.GetBlacklist()
+	case "whitelist":
+		return s.storage.GetWhitelist()
+	}
+	return nil, fmt.Errorf("unknown list %q", name)
+}
+
+// Adds or removes list entry and reloads lists on all instances
+func (s *PolicyServer) UpdateList(name, entry string, add bool) (bool, error) {
+	if len(entry) == 0 {
+		return false, fmt.Errorf("empty entry")
+	}
+	switch name {
+	case "blacklist":
+	case "whitelist":
+		if _, _, err := parseIPRange(entry); err != nil {
+			return false, err
+		}
+	default:
+		return false, fmt.Errorf("unknown list %q", name)
+	}
+
+	var changed bool
+	var err error
+	if add {
+		changed, err = s.storage.AddToList(name, entry)
+	} else {
+		changed, err = s.storage.RemoveFromList(name, entry)
+	}
+	if err != nil || !changed {
+		return changed, err
+	}
+	return true, s.publish(&controlMessage{Action: "refresh"})
+}
+
+func (s *PolicyServer) GetBans() ([]*storage.Ban, error) {
+	return s.storage.GetBans()
+}
+
+// Drops ban from storage and firewalls of all instances
+func (s *PolicyServer) Unban(ip string) error {
+	if err := s.storage.RemoveBan(ip); err != nil {
+		return err
+	}
+	return s.publish(&controlMessage{Action: "unban", IP: ip})
+}
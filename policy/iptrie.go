@@ -0,0 +1,139 @@
+package policy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Binary prefix trie over 16-byte addresses, IPv4 is stored IPv4-mapped
+type ipTrie struct {
+	root *trieNode
+	size int
+}
+
+type trieNode struct {
+	children [2]*trieNode
+	terminal bool
+}
+
+func newIPTrie() *ipTrie {
+	return &ipTrie{root: &trieNode{}}
+}
+
+// Accepts plain addresses, CIDR ranges and IPv4 wildcards like 10.0.*.*
+func (t *ipTrie) Insert(entry string) error {
+	ip, bits, err := parseIPRange(entry)
+	if err != nil {
+		return err
+	}
+	node := t.root
+	for i := 0; i < bits; i++ {
+		if node.terminal {
+			return nil
+		}
+		b := bit(ip, i)
+		if node.children[b] == nil {
+			node.children[b] = &trieNode{}
+		}
+		node = node.children[b]
+	}
+	if !node.terminal {
+		node.terminal = true
+		node.children = [2]*trieNode{}
+		t.size++
+	}
+	return nil
+}
+
+func (t *ipTrie) Contains(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	ip = ip.To16()
+	node := t.root
+	for i := 0; node != nil; i++ {
+		if node.terminal {
+			return true
+		}
+		if i == 128 {
+			return false
+		}
+		node = node.children[bit(ip, i)]
+	}
+	return false
+}
+
+func (t *ipTrie) Len() int {
+	return t.size
+}
+
+func bit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
+
+func parseIPRange(entry string) (net.IP, int, error) {
+	entry = strings.TrimSpace(entry)
+	if strings.Contains(entry, "/") {
+		_, ipnet, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, 0, err
+		}
+		ones, _ := ipnet.Mask.Size()
+		// IPv4-mapped ranges like ::ffff:10.0.0.0/104 already have 16-byte mask
+		if len(ipnet.Mask) == net.IPv4len {
+			ones += 96
+		}
+		return checkPrefix(entry, ipnet.IP.To16(), ones)
+	}
+	if strings.Contains(entry, "*") {
+		ip, ones, err := parseWildcard(entry)
+		if err != nil {
+			return nil, 0, err
+		}
+		return checkPrefix(entry, ip, ones)
+	}
+	ip := net.ParseIP(entry)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("invalid address %q", entry)
+	}
+	return ip.To16(), 128, nil
+}
+
+// Longer prefix would walk the trie past the address
+func checkPrefix(entry string, ip net.IP, ones int) (net.IP, int, error) {
+	if ones > 128 {
+		return nil, 0, fmt.Errorf("invalid prefix length in %q", entry)
+	}
+	return ip, ones, nil
+}
+
+func parseWildcard(entry string) (net.IP, int, error) {
+	parts := strings.Split(entry, ".")
+	if len(parts) > 4 {
+		return nil, 0, fmt.Errorf("invalid wildcard %q", entry)
+	}
+	octets := make([]byte, 4)
+	n := 0
+	for i, part := range parts {
+		if part == "*" {
+			// Everything after the first wildcard must be a wildcard too
+			for _, rest := range parts[i:] {
+				if rest != "*" {
+					return nil, 0, fmt.Errorf("invalid wildcard %q", entry)
+				}
+			}
+			break
+		}
+		v, err := strconv.ParseUint(part, 10, 8)
+		if err != nil {
+			return nil, 0, fmt.Errorf("invalid wildcard %q", entry)
+		}
+		octets[i] = byte(v)
+		n++
+	}
+	ip := net.IPv4(octets[0], octets[1], octets[2], octets[3])
+	return ip.To16(), 96 + n*8, nil
+}
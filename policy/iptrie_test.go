@@ -0,0 +1,76 @@
+package policy
+
+import (
+	"testing"
+)
+
+func TestIPTrie(t *testing.T) {
+	trie := newIPTrie()
+	for _, entry := range []string{"10.0.0.1", "192.168.0.0/16", "172.16.*.*", "2001:db8::/32", "::ffff:100.64.0.0/106", "::ffff:1.2.3.4/128"} {
+		if err := trie.Insert(entry); err != nil {
+			t.Errorf("Must accept %s: %v", entry, err)
+		}
+	}
+
+	matches := map[string]bool{
+		"10.0.0.1":        true,
+		"10.0.0.2":        false,
+		"192.168.44.1":    true,
+		"192.169.0.1":     false,
+		"172.16.200.3":    true,
+		"172.17.0.1":      false,
+		"2001:db8::1":     true,
+		"2001:db9::1":     false,
+		"::ffff:10.0.0.1": true,
+		"100.64.1.1":      true,
+		"100.128.0.1":     false,
+		"1.2.3.4":         true,
+		"1.2.3.5":         false,
+		"not-an-ip":       false,
+	}
+	for ip, expected := range matches {
+		if trie.Contains(ip) != expected {
+			t.Errorf("Contains(%s) must be %v", ip, expected)
+		}
+	}
+}
+
+func TestIPTrieInvalid(t *testing.T) {
+	trie := newIPTrie()
+	for _, entry := range []string{"10.0.0.256", "10.*.0.1", "10.0.0.0/33", "::ffff:10.0.0.0/129", "2001:db8::/129", "x"} {
+		if trie.Insert(entry) == nil {
+			t.Errorf("Must reject %s", entry)
+		}
+	}
+	if trie.Len() != 0 {
+		t.Error("Must not store invalid entries")
+	}
+}
+
+func TestUpdateListMappedRange(t *testing.T) {
+	s := newTestServer(NewMemoryBanner())
+	if _, err := s.UpdateList("whitelist", "::ffff:10.0.0.0/129", true); err == nil {
+		t.Error("Must reject oversized prefix")
+	}
+	_, bits, err := parseIPRange("::ffff:10.0.0.0/104")
+	if err != nil || bits != 104 {
+		t.Errorf("Mapped range must keep its prefix length, got %v: %v", bits, err)
+	}
+	// Used to panic walking past the address
+	s.setLists(nil, []string{"::ffff:10.0.0.0/104"})
+	if !s.InWhiteList("10.1.2.3") || s.InWhiteList("11.0.0.1") {
+		t.Error("Must match mapped range as IPv4 range")
+	}
+}
+
+func TestLists(t *testing.T) {
+	s := newTestServer(NewMemoryBanner())
+	s.setLists([]string{"0xbad"}, []string{"127.0.0.0/8"})
+
+	if !s.InBlackList("0xbad") || s.InBlackList("0xgood") {
+		t.Error("Must match blacklisted logins exactly")
+	}
+	if !s.InWhiteList("127.0.0.53") || s.InWhiteList("8.8.8.8") {
+		t.Error("Must match whitelisted ranges")
+	}
+}
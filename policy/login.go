@@ -0,0 +1,81 @@
+package policy
+
+import (
+	"log"
+	"sync/atomic"
+
+	"github.com/cyberpoolorg/etc-stratum/util"
+)
+
+// Temporary blacklisting of logins submitting bad work from any number of IPs
+type LoginBanning struct {
+	Enabled        bool    `json:"enabled"`
+	Timeout        int64   `json:"timeout"`
+	InvalidPercent float32 `json:"invalidPercent"`
+	CheckThreshold int32   `json:"checkThreshold"`
+	Window         string  `json:"window"`
+	MalformedLimit int32   `json:"malformedLimit"`
+}
+
+func (s *PolicyServer) getLogin(login string) *Stats {
+	s.statsMu.Lock()
+	defer s.statsMu.Unlock()
+
+	x, ok := s.loginStats[login]
+	if !ok {
+		x = &Stats{shares: newShareWindow(s.loginShareWindow)}
+		s.loginStats[login] = x
+	}
+	x.heartbeat()
+	return x
+}
+
+// Share ratio is tracked for reporting even with login banning disabled
+func (s *PolicyServer) ApplyLoginSharePolicy(login string, validShare bool) bool {
+	x := s.getLogin(login)
+	exceeded, _, _ := x.applyShare(validShare, s.config.LoginBanning.CheckThreshold, s.config.LoginBanning.InvalidPercent)
+	if exceeded && s.config.LoginBanning.Enabled {
+		s.blacklistLogin(login, "Invalid shares")
+		return false
+	}
+	return true
+}
+
+func (s *PolicyServer) ApplyLoginMalformedPolicy(login string) bool {
+	if !s.config.LoginBanning.Enabled || len(login) == 0 {
+		return true
+	}
+	x := s.getLogin(login)
+	n := x.incrMalformed()
+	if n >= s.config.LoginBanning.MalformedLimit {
+		atomic.StoreInt32(&x.Malformed, 0)
+		s.blacklistLogin(login, "Malformed requests")
+		return false
+	}
+	return true
+}
+
+func (s *PolicyServer) blacklistLogin(login, reason string) {
+	if s.InBlackList(login) {
+		return
+	}
+	s.Lock()
+	s.blacklist[login] = struct{}{}
+	s.Unlock()
+
+	timeout := s.config.LoginBanning.Timeout
+	log.Printf("Blacklisted login %v for %v seconds: %s", login, timeout, reason)
+	if s.storage == nil {
+		return
+	}
+	go func() {
+		expiresAt := util.MakeTimestamp() + timeout*1000
+		if err := s.storage.BlacklistLogin(login, expiresAt); err != nil {
+			log.Printf("Failed to write blacklisted login to backend: %v", err)
+			return
+		}
+		if err := s.publish(&controlMessage{Action: "refresh"}); err != nil {
+			log.Printf("Failed to publish policy refresh: %v", err)
+		}
+	}()
+}
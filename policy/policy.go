@@ -1,10 +1,7 @@
 package policy
 
 import (
-	"fmt"
 	"log"
-	"os/exec"
-	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,11 +11,12 @@ import (
 )
 
 type Config struct {
-	Workers         int     `json:"workers"`
-	Banning         Banning `json:"banning"`
-	Limits          Limits  `json:"limits"`
-	ResetInterval   string  `json:"resetInterval"`
-	RefreshInterval string  `json:"refreshInterval"`
+	Workers         int          `json:"workers"`
+	Banning         Banning      `json:"banning"`
+	LoginBanning    LoginBanning `json:"loginBanning"`
+	Limits          Limits       `json:"limits"`
+	ResetInterval   string       `json:"resetInterval"`
+	RefreshInterval string       `json:"refreshInterval"`
 }
 
 type Limits struct {
@@ -30,46 +28,87 @@ type Limits struct {
 
 type Banning struct {
 	Enabled        bool    `json:"enabled"`
+	Backend        string  `json:"backend"`
+	NoSudo         bool    `json:"noSudo"`
 	IPSet          string  `json:"ipset"`
+	NftFamily      string  `json:"nftFamily"`
+	NftTable       string  `json:"nftTable"`
+	NftSet         string  `json:"nftSet"`
+	IPTablesChain  string  `json:"iptablesChain"`
+	Webhook        string  `json:"webhook"`
 	Timeout        int64   `json:"timeout"`
 	InvalidPercent float32 `json:"invalidPercent"`
 	CheckThreshold int32   `json:"checkThreshold"`
+	Window         string  `json:"window"`
 	MalformedLimit int32   `json:"malformedLimit"`
 }
 
 type Stats struct {
 	sync.Mutex
-	LastBeat      int64
-	BannedAt      int64
-	ValidShares   int32
-	InvalidShares int32
-	Malformed     int32
-	ConnLimit     int32
-	Banned        int32
+	LastBeat  int64
+	BannedAt  int64
+	Malformed int32
+	ConnLimit int32
+	Banned    int32
+	shares    *shareWindow
+}
+
+type banRequest struct {
+	ip      string
+	unban   bool
+	timeout int64
+	// Persisted for other instances when set
+	ban *storage.Ban
 }
 
 type PolicyServer struct {
 	sync.RWMutex
 	statsMu    sync.Mutex
 	config     *Config
+	name       string
 	stats      map[string]*Stats
-	banChannel chan string
+	loginStats map[string]*Stats
+	banChannel chan banRequest
+	banner     Banner
 	startedAt  int64
 	grace      int64
 	timeout    int64
-	blacklist  []string
-	whitelist  []string
+	blacklist  map[string]struct{}
+	whitelist  *ipTrie
 	storage    *storage.RedisClient
+
+	// Invalid share ratio windows per IP and per login
+	shareWindow      time.Duration
+	loginShareWindow time.Duration
 }
 
-func Start(cfg *Config, storage *storage.RedisClient) *PolicyServer {
-	s := &PolicyServer{config: cfg, startedAt: util.MakeTimestamp()}
+func Start(cfg *Config, name string, storage *storage.RedisClient) *PolicyServer {
+	s := &PolicyServer{config: cfg, name: name, startedAt: util.MakeTimestamp()}
 	grace := util.MustParseDuration(cfg.Limits.Grace)
 	s.grace = int64(grace / time.Millisecond)
-	s.banChannel = make(chan string, 64)
+	s.banChannel = make(chan banRequest, 64)
 	s.stats = make(map[string]*Stats)
+	s.loginStats = make(map[string]*Stats)
+	if len(cfg.Banning.Window) > 0 {
+		s.shareWindow = util.MustParseDuration(cfg.Banning.Window)
+	}
+	if len(cfg.LoginBanning.Window) > 0 {
+		s.loginShareWindow = util.MustParseDuration(cfg.LoginBanning.Window)
+	}
+	banner, err := NewBanner(&cfg.Banning)
+	if err != nil {
+		log.Fatalf("Failed to set up banning: %v", err)
+	}
+	s.banner = banner
 	s.storage = storage
+
+	for i := 0; i < s.config.Workers; i++ {
+		s.startPolicyWorker()
+	}
+	log.Printf("Running with %v policy workers", s.config.Workers)
+
 	s.refreshState()
+	go s.subscribe()
 
 	timeout := util.MustParseDuration(s.config.ResetInterval)
 	s.timeout = int64(timeout / time.Millisecond)
@@ -90,15 +129,11 @@ func Start(cfg *Config, storage *storage.RedisClient) *PolicyServer {
 				resetTimer.Reset(resetIntv)
 			case <-refreshTimer.C:
 				s.refreshState()
+				s.writeShareCounts(refreshIntv * 2)
 				refreshTimer.Reset(refreshIntv)
 			}
 		}
 	}()
-
-	for i := 0; i < s.config.Workers; i++ {
-		s.startPolicyWorker()
-	}
-	log.Printf("Running with %v policy workers", s.config.Workers)
 	return s
 }
 
@@ -106,8 +141,8 @@ func (s *PolicyServer) startPolicyWorker() {
 	go func() {
 		for {
 			select {
-			case ip := <-s.banChannel:
-				s.doBan(ip)
+			case req := <-s.banChannel:
+				s.doBan(req)
 			}
 		}
 	}()
@@ -117,8 +152,8 @@ func (s *PolicyServer) resetStats() {
 	now := util.MakeTimestamp()
 	banningTimeout := s.config.Banning.Timeout * 1000
 	total := 0
+	var unbanned []string
 	s.statsMu.Lock()
-	defer s.statsMu.Unlock()
 
 	for key, m := range s.stats {
 		lastBeat := atomic.LoadInt64(&m.LastBeat)
@@ -129,6 +164,7 @@ func (s *PolicyServer) resetStats() {
 			if atomic.CompareAndSwapInt32(&m.Banned, 1, 0) {
 				log.Printf("Ban dropped for %v", key)
 				delete(s.stats, key)
+				unbanned = append(unbanned, key)
 				total++
 			}
 		}
@@ -137,28 +173,91 @@ func (s *PolicyServer) resetStats() {
 			total++
 		}
 	}
+	for key, m := range s.loginStats {
+		if now-atomic.LoadInt64(&m.LastBeat) >= s.timeout {
+			delete(s.loginStats, key)
+		}
+	}
+	s.statsMu.Unlock()
 	log.Printf("Flushed stats for %v IP addresses", total)
+
+	for _, ip := range unbanned {
+		s.banChannel <- banRequest{ip: ip, unban: true}
+	}
 }
 
 func (s *PolicyServer) refreshState() {
-	s.Lock()
-	defer s.Unlock()
-	var err error
-
-	s.blacklist, err = s.storage.GetBlacklist()
+	expired, err := s.storage.PurgeBlacklist()
+	if err != nil {
+		log.Printf("Failed to purge expired blacklist entries: %v", err)
+	}
+	for _, login := range expired {
+		log.Printf("Blacklisting expired for %v", login)
+	}
+	blacklist, err := s.storage.GetBlacklist()
 	if err != nil {
 		log.Printf("Failed to get blacklist from backend: %v", err)
 	}
-	s.whitelist, err = s.storage.GetWhitelist()
+	whitelist, err := s.storage.GetWhitelist()
 	if err != nil {
 		log.Printf("Failed to get whitelist from backend: %v", err)
 	}
+	s.setLists(blacklist, whitelist)
+
+	if s.config.Banning.Enabled {
+		s.loadBans()
+	}
 	log.Println("Policy state refresh complete")
 }
 
+func (s *PolicyServer) setLists(blacklist, whitelist []string) {
+	black := make(map[string]struct{}, len(blacklist))
+	for _, addy := range blacklist {
+		black[addy] = struct{}{}
+	}
+	white := newIPTrie()
+	for _, entry := range whitelist {
+		if err := white.Insert(entry); err != nil {
+			log.Printf("Skipping whitelist entry: %v", err)
+		}
+	}
+	s.Lock()
+	s.blacklist = black
+	s.whitelist = white
+	s.Unlock()
+}
+
+// Applies bans issued by other instances or before restart
+func (s *PolicyServer) loadBans() {
+	bans, err := s.storage.GetBans()
+	if err != nil {
+		log.Printf("Failed to get bans from backend: %v", err)
+		return
+	}
+	now := util.MakeTimestamp()
+	total := 0
+	for _, ban := range bans {
+		timeout := (ban.ExpiresAt - now) / 1000
+		if timeout <= 0 || s.InWhiteList(ban.IP) {
+			continue
+		}
+		x := s.Get(ban.IP)
+		// Let resetStats lift the ban when it expires
+		atomic.StoreInt64(&x.BannedAt, ban.ExpiresAt-s.config.Banning.Timeout*1000)
+		if atomic.CompareAndSwapInt32(&x.Banned, 0, 1) {
+			s.banChannel <- banRequest{ip: ban.IP, timeout: timeout}
+			total++
+		}
+	}
+	if total > 0 {
+		log.Printf("Loaded %v bans from backend", total)
+	}
+}
+
 func (s *PolicyServer) NewStats() *Stats {
 	x := &Stats{
 		ConnLimit: s.config.Limits.Limit,
+		shares:    newShareWindow(s.shareWindow),
 	}
 	x.heartbeat()
 	return x
@@ -178,9 +277,9 @@ func (s *PolicyServer) Get(ip string) *Stats {
 	}
 }
 
-func (s *PolicyServer) BanClient(ip string) {
+func (s *PolicyServer) BanClient(ip, reason string) {
 	x := s.Get(ip)
-	s.forceBan(x, ip)
+	s.forceBan(x, ip, &storage.Ban{Reason: reason})
 }
 
 func (s *PolicyServer) IsBanned(ip string) bool {
@@ -202,7 +301,7 @@ func (s *PolicyServer) ApplyLimitPolicy(ip string) bool {
 func (s *PolicyServer) ApplyLoginPolicy(addy, ip string) bool {
 	if s.InBlackList(addy) {
 		x := s.Get(ip)
-		s.forceBan(x, ip)
+		s.forceBan(x, ip, &storage.Ban{Reason: "Blacklisted login " + addy})
 		return false
 	}
 	return true
@@ -212,7 +311,7 @@ func (s *PolicyServer) ApplyMalformedPolicy(ip string) bool {
 	x := s.Get(ip)
 	n := x.incrMalformed()
 	if n >= s.config.Banning.MalformedLimit {
-		s.forceBan(x, ip)
+		s.forceBan(x, ip, &storage.Ban{Reason: "Malformed requests", Malformed: int64(n)})
 		return false
 	}
 	return true
@@ -220,53 +319,34 @@ func (s *PolicyServer) ApplyMalformedPolicy(ip string) bool {
 
 func (s *PolicyServer) ApplySharePolicy(ip string, validShare bool) bool {
 	x := s.Get(ip)
-	x.Lock()
-
-	if validShare {
-		x.ValidShares++
-		if s.config.Limits.Enabled {
-			x.incrLimit(s.config.Limits.LimitJump)
-		}
-	} else {
-		x.InvalidShares++
+	if validShare && s.config.Limits.Enabled {
+		x.incrLimit(s.config.Limits.LimitJump)
 	}
-
-	totalShares := x.ValidShares + x.InvalidShares
-	if totalShares < s.config.Banning.CheckThreshold {
-		x.Unlock()
-		return true
-	}
-	validShares := float32(x.ValidShares)
-	invalidShares := float32(x.InvalidShares)
-	x.resetShares()
-	x.Unlock()
-
-	ratio := invalidShares / validShares
-
-	if ratio >= s.config.Banning.InvalidPercent/100.0 {
-		s.forceBan(x, ip)
+	exceeded, validShares, invalidShares := x.applyShare(validShare, s.config.Banning.CheckThreshold, s.config.Banning.InvalidPercent)
+	if exceeded {
+		s.forceBan(x, ip, &storage.Ban{
+			Reason:        "Invalid shares",
+			ValidShares:   int64(validShares),
+			InvalidShares: int64(invalidShares),
+		})
 		return false
 	}
 	return true
 }
 
-func (x *Stats) resetShares() {
-	x.ValidShares = 0
-	x.InvalidShares = 0
-}
-
-func (s *PolicyServer) forceBan(x *Stats, ip string) {
+func (s *PolicyServer) forceBan(x *Stats, ip string, ban *storage.Ban) {
 	if !s.config.Banning.Enabled || s.InWhiteList(ip) {
 		return
 	}
-	atomic.StoreInt64(&x.BannedAt, util.MakeTimestamp())
+	now := util.MakeTimestamp()
+	atomic.StoreInt64(&x.BannedAt, now)
 
 	if atomic.CompareAndSwapInt32(&x.Banned, 0, 1) {
-		if len(s.config.Banning.IPSet) > 0 {
-			s.banChannel <- ip
-		} else {
-			log.Println("Banned peer", ip)
-		}
+		ban.IP = ip
+		ban.Instance = s.name
+		ban.BannedAt = now
+		ban.ExpiresAt = now + s.config.Banning.Timeout*1000
+		s.banChannel <- banRequest{ip: ip, timeout: s.config.Banning.Timeout, ban: ban}
 	}
 }
 
@@ -285,27 +365,32 @@ func (x *Stats) decrLimit() int32 {
 func (s *PolicyServer) InBlackList(addy string) bool {
 	s.RLock()
 	defer s.RUnlock()
-	return util.StringInSlice(addy, s.blacklist)
+	_, ok := s.blacklist[addy]
+	return ok
 }
 
 func (s *PolicyServer) InWhiteList(ip string) bool {
 	s.RLock()
 	defer s.RUnlock()
-	return util.StringInSlice(ip, s.whitelist)
+	return s.whitelist != nil && s.whitelist.Contains(ip)
 }
 
-func (s *PolicyServer) doBan(ip string) {
-	set, timeout := s.config.Banning.IPSet, s.config.Banning.Timeout
-	cmd := fmt.Sprintf("sudo ipset add %s %s timeout %v -!", set, ip, timeout)
-	args := strings.Fields(cmd)
-	head := args[0]
-	args = args[1:]
-
-	log.Printf("Banned %v with timeout %v on ipset %s", ip, timeout, set)
-
-	_, err := exec.Command(head, args...).Output()
+func (s *PolicyServer) doBan(req banRequest) {
+	var err error
+	if req.unban {
+		err = s.banner.Unban(req.ip)
+	} else {
+		err = s.banner.Ban(req.ip, req.timeout)
+	}
 	if err != nil {
-		log.Printf("CMD Error: %s", err)
+		log.Printf("Banning backend error: %v", err)
+	}
+	if req.ban != nil && s.storage != nil {
+		log.Printf("Banned %v: %s", req.ip, req.ban.Reason)
+		err = s.storage.WriteBan(req.ban)
+		if err != nil {
+			log.Printf("Failed to write ban to backend: %v", err)
+		}
 	}
 }
 
@@ -0,0 +1,113 @@
+package policy
+
+import (
+	"testing"
+	"time"
+)
+
+func newTestServer(banner Banner) *PolicyServer {
+	cfg := &Config{Banning: Banning{Enabled: true, Timeout: 1800}}
+	return &PolicyServer{
+		config:     cfg,
+		stats:      make(map[string]*Stats),
+		loginStats: make(map[string]*Stats),
+		blacklist:  make(map[string]struct{}),
+		banChannel: make(chan banRequest, 64),
+		banner:     banner,
+		timeout:    3600000,
+	}
+}
+
+func TestNewBanner(t *testing.T) {
+	backends := map[string]Banning{
+		"memory":   Banning{},
+		"ipset":    Banning{IPSet: "blacklist"},
+		"nftables": Banning{Backend: "nftables", NftTable: "filter", NftSet: "blacklist"},
+		"iptables": Banning{Backend: "iptables", IPTablesChain: "POOL-BANS"},
+		"webhook":  Banning{Backend: "webhook", Webhook: "http://127.0.0.1/ban"},
+	}
+	for name, cfg := range backends {
+		if _, err := NewBanner(&cfg); err != nil {
+			t.Errorf("Must create %s backend: %v", name, err)
+		}
+	}
+	if _, err := NewBanner(&Banning{Backend: "nftables"}); err == nil {
+		t.Error("Must require nftables set")
+	}
+	if _, err := NewBanner(&Banning{Backend: "x"}); err == nil {
+		t.Error("Must reject unknown backend")
+	}
+}
+
+func TestBanAndUnban(t *testing.T) {
+	banner := NewMemoryBanner()
+	s := newTestServer(banner)
+
+	s.BanClient("1.2.3.4", "Socket flood")
+	s.doBan(<-s.banChannel)
+	if !banner.IsBanned("1.2.3.4") {
+		t.Error("Must ban peer")
+	}
+
+	s.stats["1.2.3.4"].BannedAt = 1
+	s.resetStats()
+	s.doBan(<-s.banChannel)
+	if banner.IsBanned("1.2.3.4") {
+		t.Error("Must unban peer when ban expires")
+	}
+	if _, ok := s.stats["1.2.3.4"]; ok {
+		t.Error("Must drop stats of unbanned peer")
+	}
+}
+
+func TestLoginBanning(t *testing.T) {
+	s := newTestServer(NewMemoryBanner())
+	s.config.LoginBanning = LoginBanning{Enabled: true, Timeout: 600, InvalidPercent: 50, CheckThreshold: 4, MalformedLimit: 2}
+
+	for _, valid := range []bool{true, false, true} {
+		if !s.ApplyLoginSharePolicy("0xa", valid) {
+			t.Error("Must not blacklist before threshold")
+		}
+	}
+	if s.ApplyLoginSharePolicy("0xa", false) {
+		t.Error("Must blacklist login with high invalid ratio")
+	}
+	if !s.InBlackList("0xa") {
+		t.Error("Must add login to blacklist")
+	}
+
+	s.ApplyLoginMalformedPolicy("0xb")
+	if s.ApplyLoginMalformedPolicy("0xb") || !s.InBlackList("0xb") {
+		t.Error("Must blacklist login after malformed limit")
+	}
+}
+
+func TestShareWindow(t *testing.T) {
+	w := newShareWindow(10 * time.Second)
+	now := int64(1000000)
+	w.add(now, true)
+	w.add(now, false)
+	w.add(now+5000, false)
+
+	valid, invalid := w.count(now + 5000)
+	if valid != 1 || invalid != 2 {
+		t.Errorf("Must count shares in window, got %v/%v", valid, invalid)
+	}
+	valid, invalid = w.count(now + 12000)
+	if valid != 0 || invalid != 1 {
+		t.Errorf("Must drop shares out of window, got %v/%v", valid, invalid)
+	}
+}
+
+func TestSharePolicyMinSamples(t *testing.T) {
+	s := newTestServer(NewMemoryBanner())
+	s.config.Banning.InvalidPercent = 50
+	s.config.Banning.CheckThreshold = 3
+
+	if !s.ApplySharePolicy("1.2.3.4", false) || !s.ApplySharePolicy("1.2.3.4", false) {
+		t.Error("Must not ban before minimum samples")
+	}
+	if s.ApplySharePolicy("1.2.3.4", true) {
+		t.Error("Must ban with high invalid ratio")
+	}
+}
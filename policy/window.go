@@ -0,0 +1,114 @@
+package policy
+
+import (
+	"log"
+	"time"
+
+	"github.com/cyberpoolorg/etc-stratum/storage"
+	"github.com/cyberpoolorg/etc-stratum/util"
+)
+
+const (
+	defaultShareWindow = 10 * time.Minute
+	windowBuckets      = 10
+)
+
+type shareBucket struct {
+	start   int64
+	valid   int32
+	invalid int32
+}
+
+// Share counts over the last window, kept in fixed time buckets.
+// Callers must hold the owning Stats lock.
+type shareWindow struct {
+	width   int64
+	buckets [windowBuckets]shareBucket
+}
+
+func newShareWindow(window time.Duration) *shareWindow {
+	if window <= 0 {
+		window = defaultShareWindow
+	}
+	width := int64(window/time.Millisecond) / windowBuckets
+	if width <= 0 {
+		width = 1
+	}
+	return &shareWindow{width: width}
+}
+
+func (w *shareWindow) add(now int64, valid bool) {
+	start := now - now%w.width
+	b := &w.buckets[(now/w.width)%windowBuckets]
+	if b.start != start {
+		*b = shareBucket{start: start}
+	}
+	if valid {
+		b.valid++
+	} else {
+		b.invalid++
+	}
+}
+
+func (w *shareWindow) count(now int64) (valid, invalid int32) {
+	oldest := now - now%w.width - w.width*(windowBuckets-1)
+	for _, b := range w.buckets {
+		if b.start >= oldest {
+			valid += b.valid
+			invalid += b.invalid
+		}
+	}
+	return valid, invalid
+}
+
+// Adds share and reports whether invalid ratio reached the limit,
+// minSamples guards miners with few shares in the window
+func (x *Stats) applyShare(valid bool, minSamples int32, invalidPercent float32) (bool, int32, int32) {
+	x.Lock()
+	defer x.Unlock()
+
+	now := util.MakeTimestamp()
+	x.shares.add(now, valid)
+	validShares, invalidShares := x.shares.count(now)
+	total := validShares + invalidShares
+	if total == 0 || total < minSamples {
+		return false, validShares, invalidShares
+	}
+	ratio := float32(invalidShares) / float32(total)
+	return ratio >= invalidPercent/100.0, validShares, invalidShares
+}
+
+func (x *Stats) shareCounts() (valid, invalid int32) {
+	x.Lock()
+	defer x.Unlock()
+	return x.shares.count(util.MakeTimestamp())
+}
+
+// Windows of IPs and logins are reported to backend for API and admin
+func (s *PolicyServer) writeShareCounts(expire time.Duration) {
+	s.statsMu.Lock()
+	ips := collectShareCounts(s.stats)
+	logins := collectShareCounts(s.loginStats)
+	s.statsMu.Unlock()
+
+	for kind, counts := range map[string]map[string]storage.ShareCounts{"ip": ips, "login": logins} {
+		if len(counts) == 0 {
+			continue
+		}
+		err := s.storage.WriteShareCounts(s.name, kind, counts, expire)
+		if err != nil {
+			log.Printf("Failed to write %s share counts to backend: %v", kind, err)
+		}
+	}
+}
+
+func collectShareCounts(stats map[string]*Stats) map[string]storage.ShareCounts {
+	counts := make(map[string]storage.ShareCounts)
+	for key, x := range stats {
+		valid, invalid := x.shareCounts()
+		if valid+invalid > 0 {
+			counts[key] = storage.ShareCounts{Valid: int64(valid), Invalid: int64(invalid)}
+		}
+	}
+	return counts
+}
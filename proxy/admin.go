@@ -0,0 +1,359 @@
+package proxy
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/cyberpoolorg/etc-stratum/payouts"
+	"github.com/cyberpoolorg/etc-stratum/util"
+)
+
+const (
+	defaultCloseBatchSize     = 100
+	defaultCloseBatchInterval = time.Second
+)
+
+type AdminCommand struct {
+	Login         string `json:"login"`
+	IP            string `json:"ip"`
+	Host          string `json:"host"`
+	Port          int    `json:"port"`
+	Wait          int    `json:"wait"`
+	Message       string `json:"message"`
+	BatchSize     int    `json:"batchSize"`
+	BatchInterval string `json:"batchInterval"`
+	Entry         string `json:"entry"`
+}
+
+type auditEntry struct {
+	Timestamp int64  `json:"timestamp"`
+	Instance  string `json:"instance"`
+	Remote    string `json:"remote"`
+	Action    string `json:"action"`
+	Target    string `json:"target"`
+}
+
+type AdminReply struct {
+	Matched     int `json:"matched"`
+	Notified    int `json:"notified"`
+	Closing     int `json:"closing"`
+	Unsupported int `json:"unsupported"`
+}
+
+func (s *ProxyServer) ListenAdmin() {
+	if len(s.config.Proxy.Admin.Token) == 0 {
+		log.Fatal("You must set proxy admin token")
+	}
+	r := mux.NewRouter()
+	r.HandleFunc("/admin/sessions", s.adminAuth(s.AdminSessions)).Methods("GET")
+	r.HandleFunc("/admin/reconnect", s.adminAuth(s.AdminReconnect)).Methods("POST")
+	r.HandleFunc("/admin/message", s.adminAuth(s.AdminMessage)).Methods("POST")
+	r.HandleFunc("/admin/lists/{list:blacklist|whitelist}", s.adminAuth(s.AdminGetList)).Methods("GET")
+	r.HandleFunc("/admin/lists/{list:blacklist|whitelist}", s.adminAuth(s.AdminAddToList)).Methods("POST")
+	r.HandleFunc("/admin/lists/{list:blacklist|whitelist}", s.adminAuth(s.AdminRemoveFromList)).Methods("DELETE")
+	r.HandleFunc("/admin/bans", s.adminAuth(s.AdminBans)).Methods("GET")
+	r.HandleFunc("/admin/bans", s.adminAuth(s.AdminUnban)).Methods("DELETE")
+	r.HandleFunc("/admin/shares", s.adminAuth(s.AdminShareRatio)).Methods("GET")
+	r.HandleFunc("/admin/audit", s.adminAuth(s.AdminAuditLog)).Methods("GET")
+	r.HandleFunc("/admin/payouts/dryrun", s.adminAuth(s.AdminPayoutsDryRun)).Methods("GET")
+
+	// Read-only, proxy never loads payouts signer
+	if len(s.config.Payouts.Address) > 0 {
+		s.dryRunner, _ = payouts.NewDryRunProcessor(&s.config.Payouts, s.backend)
+	}
+
+	log.Printf("Proxy admin listening on %s", s.config.Proxy.Admin.Listen)
+	err := http.ListenAndServe(s.config.Proxy.Admin.Listen, r)
+	if err != nil {
+		log.Fatalf("Failed to start proxy admin: %v", err)
+	}
+}
+
+func (s *ProxyServer) adminAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !util.IsAuthorized(r, s.config.Proxy.Admin.Token) {
+			log.Printf("Unauthorized admin request from %s", r.RemoteAddr)
+			writeAdminReply(w, http.StatusUnauthorized, map[string]string{"error": "Unauthorized"})
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (s *ProxyServer) AdminSessions(w http.ResponseWriter, r *http.Request) {
+	s.sessionsMu.RLock()
+	reply := map[string]interface{}{
+		"sessions": len(s.sessions),
+		"ips":      len(s.ipSessions),
+		"logins":   len(s.loginSessions),
+	}
+	s.sessionsMu.RUnlock()
+
+	login, ip := r.URL.Query().Get("login"), r.URL.Query().Get("ip")
+	if len(login) > 0 || len(ip) > 0 {
+		var list []map[string]interface{}
+		for _, cs := range s.filterSessions(login, ip) {
+			cs.Lock()
+			id, miner, worker := cs.subscriptionID, cs.login, cs.worker
+			cs.Unlock()
+			list = append(list, map[string]interface{}{
+				"id":            id,
+				"login":         miner,
+				"worker":        worker,
+				"ip":            cs.ip,
+				"validShares":   atomic.LoadInt64(&cs.validShares),
+				"invalidShares": atomic.LoadInt64(&cs.invalidShares),
+			})
+		}
+		reply["list"] = list
+	}
+	writeAdminReply(w, http.StatusOK, reply)
+}
+
+func (s *ProxyServer) AdminReconnect(w http.ResponseWriter, r *http.Request) {
+	var cmd AdminCommand
+	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil || len(cmd.Host) == 0 || cmd.Port <= 0 {
+		writeAdminReply(w, http.StatusBadRequest, map[string]string{"error": "Host and port are required"})
+		return
+	}
+	interval, err := parseBatchInterval(cmd.BatchInterval)
+	if err != nil {
+		writeAdminReply(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	reply := AdminReply{}
+	var closing []*Session
+	for _, cs := range s.filterSessions(cmd.Login, cmd.IP) {
+		reply.Matched++
+		if !cs.supportsClientMethods() {
+			closing = append(closing, cs)
+			continue
+		}
+		err := cs.sendNotification("client.reconnect", []interface{}{cmd.Host, cmd.Port, cmd.Wait})
+		if err != nil {
+			log.Printf("Failed to send reconnect to %v@%v: %v", cs.currentLogin(), cs.ip, err)
+			continue
+		}
+		reply.Notified++
+	}
+	reply.Closing = len(closing)
+	log.Printf("Admin reconnect to %s:%v: %v sessions notified, %v will be closed", cmd.Host, cmd.Port, reply.Notified, reply.Closing)
+
+	if len(closing) > 0 {
+		go closeInBatches(closing, cmd.BatchSize, interval)
+	}
+	writeAdminReply(w, http.StatusOK, reply)
+}
+
+func (s *ProxyServer) AdminMessage(w http.ResponseWriter, r *http.Request) {
+	var cmd AdminCommand
+	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil || len(cmd.Message) == 0 {
+		writeAdminReply(w, http.StatusBadRequest, map[string]string{"error": "Message is required"})
+		return
+	}
+
+	reply := AdminReply{}
+	for _, cs := range s.filterSessions(cmd.Login, cmd.IP) {
+		reply.Matched++
+		if !cs.supportsClientMethods() {
+			reply.Unsupported++
+			continue
+		}
+		err := cs.sendNotification("client.show_message", []string{cmd.Message})
+		if err != nil {
+			log.Printf("Failed to send message to %v@%v: %v", cs.currentLogin(), cs.ip, err)
+			continue
+		}
+		reply.Notified++
+	}
+	log.Printf("Admin message sent to %v sessions, %v do not support it", reply.Notified, reply.Unsupported)
+	writeAdminReply(w, http.StatusOK, reply)
+}
+
+func (s *ProxyServer) AdminGetList(w http.ResponseWriter, r *http.Request) {
+	list, err := s.policy.GetList(mux.Vars(r)["list"])
+	if err != nil {
+		writeAdminReply(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"entries": list})
+}
+
+func (s *ProxyServer) AdminAddToList(w http.ResponseWriter, r *http.Request) {
+	var cmd AdminCommand
+	if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+		writeAdminReply(w, http.StatusBadRequest, map[string]string{"error": "Entry is required"})
+		return
+	}
+	s.updateList(w, r, cmd.Entry, true)
+}
+
+func (s *ProxyServer) AdminRemoveFromList(w http.ResponseWriter, r *http.Request) {
+	s.updateList(w, r, r.URL.Query().Get("entry"), false)
+}
+
+func (s *ProxyServer) updateList(w http.ResponseWriter, r *http.Request, entry string, add bool) {
+	list := mux.Vars(r)["list"]
+	changed, err := s.policy.UpdateList(list, entry, add)
+	if err != nil {
+		writeAdminReply(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if changed {
+		action := "remove"
+		if add {
+			action = "add"
+		}
+		s.audit(r, list+":"+action, entry)
+	}
+	writeAdminReply(w, http.StatusOK, map[string]bool{"changed": changed})
+}
+
+func (s *ProxyServer) AdminBans(w http.ResponseWriter, r *http.Request) {
+	bans, err := s.policy.GetBans()
+	if err != nil {
+		writeAdminReply(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"bans": bans})
+}
+
+func (s *ProxyServer) AdminUnban(w http.ResponseWriter, r *http.Request) {
+	ip := r.URL.Query().Get("ip")
+	if len(ip) == 0 {
+		writeAdminReply(w, http.StatusBadRequest, map[string]string{"error": "IP is required"})
+		return
+	}
+	if err := s.policy.Unban(ip); err != nil {
+		writeAdminReply(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	s.audit(r, "unban", ip)
+	writeAdminReply(w, http.StatusOK, map[string]bool{"changed": true})
+}
+
+// Invalid share ratio within banning window, summed over all instances
+func (s *ProxyServer) AdminShareRatio(w http.ResponseWriter, r *http.Request) {
+	kind, entry := "ip", r.URL.Query().Get("ip")
+	if login := r.URL.Query().Get("login"); len(login) > 0 {
+		kind, entry = "login", strings.ToLower(login)
+	}
+	if len(entry) == 0 {
+		writeAdminReply(w, http.StatusBadRequest, map[string]string{"error": "IP or login is required"})
+		return
+	}
+	shares, err := s.backend.GetShareCounts(kind, entry)
+	if err != nil {
+		writeAdminReply(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{
+		kind:           entry,
+		"valid":        shares.Valid,
+		"invalid":      shares.Invalid,
+		"invalidRatio": shares.InvalidRatio(),
+	})
+}
+
+func (s *ProxyServer) AdminAuditLog(w http.ResponseWriter, r *http.Request) {
+	raw, err := s.backend.GetAuditLog(100)
+	if err != nil {
+		writeAdminReply(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	entries := make([]json.RawMessage, len(raw))
+	for i, v := range raw {
+		entries[i] = json.RawMessage(v)
+	}
+	writeAdminReply(w, http.StatusOK, map[string]interface{}{"entries": entries})
+}
+
+// Uses payouts config of this instance, nothing is locked or sent
+func (s *ProxyServer) AdminPayoutsDryRun(w http.ResponseWriter, r *http.Request) {
+	if s.dryRunner == nil {
+		writeAdminReply(w, http.StatusNotFound, map[string]string{"error": "Payouts address is not set"})
+		return
+	}
+	report, err := s.dryRunner.DryRun(r.Context())
+	if err != nil {
+		writeAdminReply(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeAdminReply(w, http.StatusOK, report)
+}
+
+func (s *ProxyServer) audit(r *http.Request, action, target string) {
+	entry := auditEntry{
+		Timestamp: util.MakeTimestamp() / 1000,
+		Instance:  s.config.Name,
+		Remote:    r.RemoteAddr,
+		Action:    action,
+		Target:    target,
+	}
+	log.Printf("Admin %s %s from %s", action, target, r.RemoteAddr)
+	data, _ := json.Marshal(&entry)
+	if err := s.backend.WriteAuditLog(string(data)); err != nil {
+		log.Printf("Failed to write audit log: %v", err)
+	}
+}
+
+func (s *ProxyServer) filterSessions(login, ip string) []*Session {
+	s.sessionsMu.RLock()
+	defer s.sessionsMu.RUnlock()
+
+	var result []*Session
+	for cs := range s.sessions {
+		if len(login) > 0 && cs.login != login {
+			continue
+		}
+		if len(ip) > 0 && cs.ip != ip {
+			continue
+		}
+		result = append(result, cs)
+	}
+	return result
+}
+
+// Spread disconnects so miners do not reconnect all at once
+func closeInBatches(sessions []*Session, size int, interval time.Duration) {
+	if size <= 0 {
+		size = defaultCloseBatchSize
+	}
+	for i := 0; i < len(sessions); i += size {
+		end := i + size
+		if end > len(sessions) {
+			end = len(sessions)
+		}
+		for _, cs := range sessions[i:end] {
+			cs.conn.Close()
+		}
+		log.Printf("Closed %v of %v sessions", end, len(sessions))
+		if end < len(sessions) {
+			time.Sleep(interval)
+		}
+	}
+}
+
+func parseBatchInterval(s string) (time.Duration, error) {
+	if len(s) == 0 {
+		return defaultCloseBatchInterval, nil
+	}
+	return time.ParseDuration(s)
+}
+
+func writeAdminReply(w http.ResponseWriter, status int, reply interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(reply)
+	if err != nil {
+		log.Println("Error serializing admin response: ", err)
+	}
+}
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"log"
 	"math/big"
 	"strconv"
@@ -30,6 +31,7 @@ type BlockTemplate struct {
 	GetPendingBlockCache *rpc.GetBlockReplyPart
 	nonces               map[string]bool
 	headers              map[string]heightDiffPair
+	remote               bool
 }
 
 type Block struct {
@@ -54,7 +56,7 @@ func (s *ProxyServer) fetchBlockTemplate() {
 		log.Printf("Error while refreshing pending block on %s: %s", rpc.Name, err)
 		return
 	}
-	reply, err := rpc.GetWork()
+	reply, err := rpc.GetWork(context.Background())
 	if err != nil {
 		log.Printf("Error while refreshing block template on %s: %s", rpc.Name, err)
 		return
@@ -65,6 +67,12 @@ func (s *ProxyServer) fetchBlockTemplate() {
 
 	pendingReply.Difficulty = util.ToHex(s.config.Proxy.Difficulty)
 
+	s.applyBlockTemplate(rpc.Name, reply, pendingReply, height, diff, false)
+	s.publishJob(reply, pendingReply, height, diff)
+}
+
+func (s *ProxyServer) applyBlockTemplate(source string, reply []string, pendingReply *rpc.GetBlockReplyPart, height uint64, diff int64, remote bool) {
+	t := s.currentBlockTemplate()
 	newTemplate := BlockTemplate{
 		Header:               reply[0],
 		Seed:                 reply[1],
@@ -73,6 +81,7 @@ func (s *ProxyServer) fetchBlockTemplate() {
 		Difficulty:           big.NewInt(diff),
 		GetPendingBlockCache: pendingReply,
 		headers:              make(map[string]heightDiffPair),
+		remote:               remote,
 	}
 
 	newTemplate.headers[reply[0]] = heightDiffPair{
@@ -87,7 +96,7 @@ func (s *ProxyServer) fetchBlockTemplate() {
 		}
 	}
 	s.blockTemplate.Store(&newTemplate)
-	log.Printf("New block to mine on %s at height %d / %s", rpc.Name, height, reply[0][0:10])
+	log.Printf("New block to mine on %s at height %d / %s", source, height, reply[0][0:10])
 
 	if s.config.Proxy.Stratum.Enabled {
 		go s.broadcastNewJobs()
@@ -96,7 +105,7 @@ func (s *ProxyServer) fetchBlockTemplate() {
 
 func (s *ProxyServer) fetchPendingBlock() (*rpc.GetBlockReplyPart, uint64, int64, error) {
 	rpc := s.rpc()
-	reply, err := rpc.GetPendingBlock()
+	reply, err := rpc.GetPendingBlock(context.Background())
 	if err != nil {
 		log.Printf("Error while refreshing pending block on %s: %s", rpc.Name, err)
 		return nil, 0, 0, err
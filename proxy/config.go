@@ -4,15 +4,16 @@ import (
 	"github.com/cyberpoolorg/etc-stratum/api"
 	"github.com/cyberpoolorg/etc-stratum/payouts"
 	"github.com/cyberpoolorg/etc-stratum/policy"
+	"github.com/cyberpoolorg/etc-stratum/rpc"
 	"github.com/cyberpoolorg/etc-stratum/storage"
 )
 
 type Config struct {
-	Name                  string        `json:"name"`
-	Proxy                 Proxy         `json:"proxy"`
-	Api                   api.ApiConfig `json:"api"`
-	Upstream              []Upstream    `json:"upstream"`
-	UpstreamCheckInterval string        `json:"upstreamCheckInterval"`
+	Name                  string         `json:"name"`
+	Proxy                 Proxy          `json:"proxy"`
+	Api                   api.ApiConfig  `json:"api"`
+	Upstream              []rpc.Upstream `json:"upstream"`
+	UpstreamCheckInterval string         `json:"upstreamCheckInterval"`
 
 	Threads int `json:"threads"`
 
@@ -50,14 +51,35 @@ type Proxy struct {
 
 	Stratum Stratum `json:"stratum"`
 
+	Admin Admin `json:"admin"`
+
+	JobDistribution JobDistribution `json:"jobDistribution"`
+
 	StratumNiceHash StratumNiceHash `json:"stratum_nice_hash"`
 }
 
 type Stratum struct {
+	Enabled             bool   `json:"enabled"`
+	Listen              string `json:"listen"`
+	Timeout             string `json:"timeout"`
+	MaxConn             int    `json:"maxConn"`
+	MaxSessionsPerIP    int    `json:"maxSessionsPerIP"`
+	MaxSessionsPerLogin int    `json:"maxSessionsPerLogin"`
+	WriteTimeout        string `json:"writeTimeout"`
+	QueueSize           int    `json:"queueSize"`
+	ResumeTimeout       string `json:"resumeTimeout"`
+	ResumeCacheSize     int    `json:"resumeCacheSize"`
+}
+
+type Admin struct {
 	Enabled bool   `json:"enabled"`
 	Listen  string `json:"listen"`
-	Timeout string `json:"timeout"`
-	MaxConn int    `json:"maxConn"`
+	Token   string `json:"token"`
+}
+
+type JobDistribution struct {
+	Enabled       bool   `json:"enabled"`
+	LeaderTimeout string `json:"leaderTimeout"`
 }
 
 type StratumNiceHash struct {
@@ -66,9 +88,3 @@ type StratumNiceHash struct {
 	Timeout string `json:"timeout"`
 	MaxConn int    `json:"maxConn"`
 }
-
-type Upstream struct {
-	Name    string `json:"name"`
-	Url     string `json:"url"`
-	Timeout string `json:"timeout"`
-}
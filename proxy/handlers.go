@@ -25,9 +25,22 @@ func (s *ProxyServer) handleLoginRPC(cs *Session, params []string, id string) (b
 	if !s.policy.ApplyLoginPolicy(login, cs.ip) {
 		return false, &ErrorReply{Code: -1, Message: "You are blacklisted"}
 	}
-	cs.login = login
-	s.registerSession(cs)
-	log.Printf("Stratum miner connected %v@%v", login, cs.ip)
+	if !workerPattern.MatchString(id) {
+		id = "0"
+	}
+	if err := s.registerSession(cs, login); err != nil {
+		log.Printf("Refused stratum login %v@%v: %v", login, cs.ip, err)
+		return false, &ErrorReply{Code: -1, Message: err.Error()}
+	}
+	cs.Lock()
+	cs.worker = id
+	cs.Unlock()
+	cs.resumed = s.resumeSession(cs, login, id)
+	if cs.resumed {
+		log.Printf("Stratum miner resumed session %v for %v@%v", cs.subscriptionID, login, cs.ip)
+	} else {
+		log.Printf("Stratum miner connected %v@%v", login, cs.ip)
+	}
 	return true, nil
 }
 
@@ -36,7 +49,7 @@ func (s *ProxyServer) handleGetWorkRPC(cs *Session) ([]string, *ErrorReply) {
 	if t == nil || len(t.Header) == 0 || s.isSick() {
 		return nil, &ErrorReply{Code: 0, Message: "Work not ready"}
 	}
-	return []string{t.Header, t.Seed, s.diff}, nil
+	return s.jobForSession(cs, t), nil
 }
 
 func (s *ProxyServer) handleTCPSubmitRPC(cs *Session, id string, params []string) (bool, *ErrorReply) {
@@ -47,7 +60,9 @@ func (s *ProxyServer) handleTCPSubmitRPC(cs *Session, id string, params []string
 	if !ok {
 		return false, &ErrorReply{Code: 25, Message: "Not subscribed"}
 	}
-	return s.handleSubmitRPC(cs, cs.login, id, params)
+	reply, errReply := s.handleSubmitRPC(cs, cs.login, id, params)
+	cs.trackShare(reply)
+	return reply, errReply
 }
 
 func (s *ProxyServer) handleSubmitRPC(cs *Session, login, id string, params []string) (bool, *ErrorReply) {
@@ -56,18 +71,23 @@ func (s *ProxyServer) handleSubmitRPC(cs *Session, login, id string, params []st
 	}
 	if len(params) != 3 {
 		s.policy.ApplyMalformedPolicy(cs.ip)
+		s.policy.ApplyLoginMalformedPolicy(login)
 		log.Printf("Malformed params from %s@%s %v", login, cs.ip, params)
 		return false, &ErrorReply{Code: -1, Message: "Invalid params"}
 	}
 
 	if !noncePattern.MatchString(params[0]) || !hashPattern.MatchString(params[1]) || !hashPattern.MatchString(params[2]) {
 		s.policy.ApplyMalformedPolicy(cs.ip)
+		s.policy.ApplyLoginMalformedPolicy(login)
 		log.Printf("Malformed PoW result from %s@%s %v", login, cs.ip, params)
 		return false, &ErrorReply{Code: -1, Message: "Malformed PoW result"}
 	}
 	t := s.currentBlockTemplate()
-	exist, validShare := s.processShare(login, id, cs.ip, t, params)
+	exist, validShare := s.processShare(login, id, cs.ip, t, params, s.shareDifficulty(cs))
 	ok := s.policy.ApplySharePolicy(cs.ip, !exist && validShare)
+	if !s.policy.ApplyLoginSharePolicy(login, !exist && validShare) {
+		ok = false
+	}
 
 	if exist {
 		log.Printf("Duplicate share from %s@%s %v", login, cs.ip, params)
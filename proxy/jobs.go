@@ -0,0 +1,242 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/cyberpoolorg/etc-stratum/rpc"
+	"github.com/cyberpoolorg/etc-stratum/util"
+)
+
+const (
+	jobsChannel      = "jobs"
+	solutionsChannel = "solutions"
+	resultsChannel   = "results"
+	workLeaderRole   = "work"
+
+	defaultLeaderTimeout = 3 * time.Second
+)
+
+type jobMessage struct {
+	Leader     string                 `json:"leader"`
+	Work       []string               `json:"work"`
+	Height     uint64                 `json:"height"`
+	Difficulty int64                  `json:"difficulty"`
+	Pending    *rpc.GetBlockReplyPart `json:"pending"`
+}
+
+type solutionMessage struct {
+	Id       string   `json:"id"`
+	Instance string   `json:"instance"`
+	Params   []string `json:"params"`
+}
+
+// Leader reports outcome of a submitted solution back to the instance that found it
+type submitResult struct {
+	Id       string `json:"id"`
+	Instance string `json:"instance"`
+	Accepted bool   `json:"accepted"`
+	Error    string `json:"error"`
+}
+
+// One elected instance polls nodes and publishes jobs to the others
+func (s *ProxyServer) startJobDistribution() {
+	s.leaderTimeout = defaultLeaderTimeout
+	if len(s.config.Proxy.JobDistribution.LeaderTimeout) > 0 {
+		s.leaderTimeout = util.MustParseDuration(s.config.Proxy.JobDistribution.LeaderTimeout)
+	}
+	s.solutions = make(map[string]chan *submitResult)
+	log.Printf("Job distribution enabled, leader timeout %v", s.leaderTimeout)
+
+	s.electWorkLeader()
+	go func() {
+		intv := s.leaderTimeout / 3
+		timer := time.NewTimer(intv)
+		for {
+			select {
+			case <-timer.C:
+				s.electWorkLeader()
+				s.publishCurrentJob()
+				timer.Reset(intv)
+			}
+		}
+	}()
+
+	go s.subscribe(jobsChannel, s.handleJobMessage)
+	go s.subscribe(solutionsChannel, s.handleSolutionMessage)
+	go s.subscribe(resultsChannel, s.handleResultMessage)
+}
+
+func (s *ProxyServer) subscribe(channel string, handler func(string)) {
+	for {
+		err := s.backend.Subscribe(channel, handler)
+		log.Printf("Subscription to %s channel lost: %v", channel, err)
+		time.Sleep(time.Second)
+	}
+}
+
+func (s *ProxyServer) electWorkLeader() {
+	leader, err := s.backend.AcquireLeader(workLeaderRole, s.config.Name, s.leaderTimeout)
+	if err != nil {
+		log.Printf("Failed to elect work leader: %v", err)
+		leader = false
+	}
+	if leader != s.isWorkLeader() {
+		if leader {
+			log.Printf("Became work leader, polling nodes for jobs")
+		} else {
+			log.Printf("Lost work leadership, following published jobs")
+		}
+	}
+	if leader {
+		atomic.StoreInt32(&s.workLeader, 1)
+	} else {
+		atomic.StoreInt32(&s.workLeader, 0)
+	}
+}
+
+func (s *ProxyServer) isWorkLeader() bool {
+	return atomic.LoadInt32(&s.workLeader) == 1
+}
+
+// Followers poll nodes themselves only when the leader went silent
+func (s *ProxyServer) mustPollNode() bool {
+	if !s.config.Proxy.JobDistribution.Enabled || s.isWorkLeader() {
+		return true
+	}
+	last := atomic.LoadInt64(&s.lastRemoteJob)
+	return util.MakeTimestamp()-last > int64(s.leaderTimeout/time.Millisecond)
+}
+
+func (s *ProxyServer) refreshBlockTemplate() {
+	if s.mustPollNode() {
+		s.fetchBlockTemplate()
+	}
+}
+
+func (s *ProxyServer) publishJob(work []string, pending *rpc.GetBlockReplyPart, height uint64, diff int64) {
+	if !s.config.Proxy.JobDistribution.Enabled || !s.isWorkLeader() {
+		return
+	}
+	msg := jobMessage{Leader: s.config.Name, Work: work, Height: height, Difficulty: diff, Pending: pending}
+	data, _ := json.Marshal(&msg)
+	err := s.backend.Publish(jobsChannel, string(data))
+	if err != nil {
+		log.Printf("Failed to publish job: %v", err)
+	}
+}
+
+// Republished periodically so followers know the leader is alive
+func (s *ProxyServer) publishCurrentJob() {
+	t := s.currentBlockTemplate()
+	if t == nil || t.remote {
+		return
+	}
+	s.publishJob([]string{t.Header, t.Seed, t.Target}, t.GetPendingBlockCache, t.Height, t.Difficulty.Int64())
+}
+
+func (s *ProxyServer) handleJobMessage(payload string) {
+	var msg jobMessage
+	err := json.Unmarshal([]byte(payload), &msg)
+	if err != nil || len(msg.Work) < 3 {
+		log.Printf("Malformed job message: %v", err)
+		return
+	}
+	if msg.Leader == s.config.Name {
+		return
+	}
+	atomic.StoreInt64(&s.lastRemoteJob, util.MakeTimestamp())
+
+	t := s.currentBlockTemplate()
+	if t != nil && t.Header == msg.Work[0] {
+		return
+	}
+	s.applyBlockTemplate(msg.Leader, msg.Work, msg.Pending, msg.Height, msg.Difficulty, true)
+}
+
+// Nodes accept only solutions for work they issued, so remote work goes back to the leader.
+// Without an answer from the leader the solution is submitted to own upstream.
+func (s *ProxyServer) submitBlock(t *BlockTemplate, params []string) (bool, error) {
+	if !t.remote {
+		return s.rpc().SubmitBlock(context.Background(), params)
+	}
+	msg := solutionMessage{Id: fmt.Sprintf("%s:%d", s.config.Name, time.Now().UnixNano()), Instance: s.config.Name, Params: params}
+	reply := make(chan *submitResult, 1)
+	s.solutionsMu.Lock()
+	s.solutions[msg.Id] = reply
+	s.solutionsMu.Unlock()
+	defer func() {
+		s.solutionsMu.Lock()
+		delete(s.solutions, msg.Id)
+		s.solutionsMu.Unlock()
+	}()
+
+	data, _ := json.Marshal(&msg)
+	err := s.backend.Publish(solutionsChannel, string(data))
+	if err != nil {
+		log.Printf("Failed to publish solution, submitting to %s: %v", s.rpc().Name, err)
+		return s.rpc().SubmitBlock(context.Background(), params)
+	}
+	select {
+	case result := <-reply:
+		if len(result.Error) == 0 {
+			return result.Accepted, nil
+		}
+		log.Printf("Leader failed to submit solution, submitting to %s: %v", s.rpc().Name, result.Error)
+	case <-time.After(s.leaderTimeout):
+		log.Printf("No submit result from leader, submitting to %s", s.rpc().Name)
+	}
+	return s.rpc().SubmitBlock(context.Background(), params)
+}
+
+func (s *ProxyServer) handleSolutionMessage(payload string) {
+	if !s.isWorkLeader() {
+		return
+	}
+	var msg solutionMessage
+	err := json.Unmarshal([]byte(payload), &msg)
+	if err != nil || len(msg.Params) != 3 {
+		log.Printf("Malformed solution message: %v", err)
+		return
+	}
+	ok, err := s.rpc().SubmitBlock(context.Background(), msg.Params)
+	result := submitResult{Id: msg.Id, Instance: msg.Instance, Accepted: ok}
+	if err != nil {
+		log.Printf("Block submission failure for %s: %v", msg.Instance, err)
+		result.Error = err.Error()
+	} else if !ok {
+		log.Printf("Block from %s rejected by %s", msg.Instance, s.rpc().Name)
+	} else {
+		log.Printf("Submitted block found on %s", msg.Instance)
+		s.fetchBlockTemplate()
+	}
+	data, _ := json.Marshal(&result)
+	if err := s.backend.Publish(resultsChannel, string(data)); err != nil {
+		log.Printf("Failed to publish submit result: %v", err)
+	}
+}
+
+func (s *ProxyServer) handleResultMessage(payload string) {
+	var result submitResult
+	err := json.Unmarshal([]byte(payload), &result)
+	if err != nil {
+		log.Printf("Malformed submit result message: %v", err)
+		return
+	}
+	if result.Instance != s.config.Name {
+		return
+	}
+	s.solutionsMu.Lock()
+	reply, ok := s.solutions[result.Id]
+	s.solutionsMu.Unlock()
+	if ok {
+		select {
+		case reply <- &result:
+		default:
+		}
+	}
+}
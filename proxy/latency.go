@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+const latencySamples = 4096
+
+// Keeps a window of recent job delivery latencies
+type latencyTracker struct {
+	sync.Mutex
+	samples []time.Duration
+	next    int
+	full    bool
+}
+
+func newLatencyTracker(size int) *latencyTracker {
+	return &latencyTracker{samples: make([]time.Duration, size)}
+}
+
+func (l *latencyTracker) add(d time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+
+	l.samples[l.next] = d
+	l.next++
+	if l.next == len(l.samples) {
+		l.next = 0
+		l.full = true
+	}
+}
+
+func (l *latencyTracker) percentiles(ps ...float64) []time.Duration {
+	l.Lock()
+	n := l.next
+	if l.full {
+		n = len(l.samples)
+	}
+	sorted := make([]time.Duration, n)
+	copy(sorted, l.samples[:n])
+	l.Unlock()
+
+	result := make([]time.Duration, len(ps))
+	if n == 0 {
+		return result
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for i, p := range ps {
+		idx := int(float64(n-1) * p / 100)
+		result[i] = sorted[idx]
+	}
+	return result
+}
+
+func (s *ProxyServer) writeBroadcastLatency() {
+	if s.broadcastLatency == nil {
+		return
+	}
+	p := s.broadcastLatency.percentiles(50, 90, 99)
+	err := s.backend.WriteBroadcastLatency(s.config.Name, p[0], p[1], p[2])
+	if err != nil {
+		log.Printf("Failed to write broadcast latency to backend: %v", err)
+	}
+}
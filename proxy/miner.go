@@ -5,6 +5,7 @@ import (
 	"math/big"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/cyberpoolorg/go-etchash"
 	"github.com/ethereum/go-ethereum/common"
@@ -15,22 +16,29 @@ var ecip1099FBlockMordor uint64 = 2520000   // mordor
 
 var hasher *etchash.Etchash = nil
 
-func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, params []string) (bool, bool) {
-	if hasher == nil {
+var hasherOnce sync.Once
+
+// Nil for unknown network
+func (s *ProxyServer) etchasher() *etchash.Etchash {
+	hasherOnce.Do(func() {
 		if s.config.Network == "classic" {
 			hasher = etchash.New(&ecip1099FBlockClassic, nil)
 		} else if s.config.Network == "mordor" {
 			hasher = etchash.New(&ecip1099FBlockMordor, nil)
-		} else {
-			log.Printf("Unknown network configuration %s", s.config.Network)
-			return false, false
 		}
+	})
+	return hasher
+}
+
+func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, params []string, shareDiff int64) (bool, bool) {
+	if s.etchasher() == nil {
+		log.Printf("Unknown network configuration %s", s.config.Network)
+		return false, false
 	}
 	nonceHex := params[0]
 	hashNoNonce := params[1]
 	mixDigest := params[2]
 	nonce, _ := strconv.ParseUint(strings.Replace(nonceHex, "0x", "", -1), 16, 64)
-	shareDiff := s.config.Proxy.Difficulty
 
 	h, ok := t.headers[hashNoNonce]
 	if !ok {
@@ -59,14 +67,14 @@ func (s *ProxyServer) processShare(login, id, ip string, t *BlockTemplate, param
 	}
 
 	if hasher.Verify(block) {
-		ok, err := s.rpc().SubmitBlock(params)
+		ok, err := s.submitBlock(t, params)
 		if err != nil {
 			log.Printf("Block submission failure at height %v for %v: %v", h.height, t.Header, err)
 		} else if !ok {
 			log.Printf("Block rejected at height %v for %v", h.height, t.Header)
 			return false, false
 		} else {
-			s.fetchBlockTemplate()
+			s.refreshBlockTemplate()
 			exist, err := s.backend.WriteBlock(login, id, params, shareDiff, h.diff.Int64(), h.height, s.hashrateExpiration)
 			if exist {
 				return true, false
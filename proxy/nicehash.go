@@ -0,0 +1,170 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// EthereumStratum/1.0.0 as spoken by NiceHash and most GPU miners
+const nicehashProtocol = "EthereumStratum/1.0.0"
+
+// Extranonces held by live and resumable sessions, sessions sharing one would search the same nonces
+type extranoncePool struct {
+	sync.Mutex
+	next uint32
+	used map[string]struct{}
+}
+
+// Miner picks the rest of the 8 byte nonce
+var nonceSuffixPattern = regexp.MustCompile("^[0-9a-f]{12}$")
+
+func (cs *Session) handleNiceHashMessage(s *ProxyServer, req *StratumReq) error {
+	var params []string
+	if err := json.Unmarshal(req.Params, &params); err != nil {
+		log.Println("Malformed stratum request params from", cs.ip)
+		return err
+	}
+	switch req.Method {
+	case "mining.subscribe":
+		if len(params) < 2 || !strings.HasPrefix(params[1], nicehashProtocol) {
+			return cs.sendTCPError(req.Id, &ErrorReply{Code: 20, Message: "Unsupported protocol"})
+		}
+		var state *sessionState
+		if len(params) > 2 {
+			state = s.takeSession(params[2])
+		}
+		cs.Lock()
+		if state != nil {
+			s.extranonces.release(cs.extranonce)
+			cs.subscriptionID = params[2]
+			cs.extranonce = state.extranonce
+			cs.resumeState = state
+		} else if len(cs.extranonce) == 0 {
+			extranonce, ok := s.newExtranonce()
+			if !ok {
+				cs.Unlock()
+				log.Printf("No free extranonce for %v", cs.ip)
+				return cs.sendTCPError(req.Id, &ErrorReply{Code: 20, Message: "Extranonce range exhausted"})
+			}
+			cs.extranonce = extranonce
+		}
+		cs.dialect = dialectNiceHash
+		reply := []interface{}{[]string{"mining.notify", cs.subscriptionID, nicehashProtocol}, cs.extranonce}
+		cs.Unlock()
+		return cs.sendTCPResult(req.Id, reply)
+	case "mining.extranonce.subscribe":
+		return cs.sendTCPResult(req.Id, true)
+	case "mining.authorize":
+		if !cs.isNiceHash() {
+			return cs.sendTCPError(req.Id, &ErrorReply{Code: 25, Message: "Not subscribed"})
+		}
+		if len(params) == 0 {
+			return cs.sendTCPError(req.Id, &ErrorReply{Code: -1, Message: "Invalid params"})
+		}
+		login, worker := splitWorker(params[0])
+		reply, errReply := s.handleLoginRPC(cs, []string{login}, worker)
+		if errReply != nil {
+			return cs.sendTCPError(req.Id, errReply)
+		}
+		if err := cs.sendTCPResult(req.Id, reply); err != nil {
+			return err
+		}
+		diff := float64(s.shareDifficulty(cs)) / math.Pow(2, 32)
+		if err := cs.sendNotification("mining.set_difficulty", []float64{diff}); err != nil {
+			return err
+		}
+		s.pushCurrentJob(cs)
+		return nil
+	case "mining.submit":
+		if len(params) != 3 {
+			s.policy.ApplyMalformedPolicy(cs.ip)
+			return cs.sendTCPError(req.Id, &ErrorReply{Code: -1, Message: "Invalid params"})
+		}
+		_, worker := splitWorker(params[0])
+		cs.Lock()
+		extranonce := cs.extranonce
+		cs.Unlock()
+		suffix := strings.TrimPrefix(params[2], "0x")
+		if len(suffix) != 16-len(extranonce) || !nonceSuffixPattern.MatchString(suffix) {
+			s.policy.ApplyMalformedPolicy(cs.ip)
+			return cs.sendTCPError(req.Id, &ErrorReply{Code: -1, Message: "Malformed nonce"})
+		}
+		nonce := "0x" + extranonce + suffix
+		header := "0x" + strings.TrimPrefix(params[1], "0x")
+		reply, errReply := s.handleTCPSubmitRPC(cs, worker, []string{nonce, header, s.mixDigest(header, nonce)})
+		if errReply != nil {
+			return cs.sendTCPError(req.Id, errReply)
+		}
+		return cs.sendTCPResult(req.Id, reply)
+	}
+	return cs.sendTCPError(req.Id, s.handleUnknownRPC(cs, req.Method))
+}
+
+func (s *ProxyServer) newExtranonce() (string, bool) {
+	if extranonce, ok := s.extranonces.acquire(); ok {
+		return extranonce, true
+	}
+	s.dropExpiredSessions()
+	return s.extranonces.acquire()
+}
+
+func (p *extranoncePool) acquire() (string, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.used == nil {
+		p.used = make(map[string]struct{})
+	}
+	for i := 0; i <= 0xffff; i++ {
+		p.next++
+		extranonce := fmt.Sprintf("%04x", p.next&0xffff)
+		if _, ok := p.used[extranonce]; !ok {
+			p.used[extranonce] = struct{}{}
+			return extranonce, true
+		}
+	}
+	return "", false
+}
+
+func (p *extranoncePool) release(extranonce string) {
+	p.Lock()
+	defer p.Unlock()
+	delete(p.used, extranonce)
+}
+
+// NiceHash miners do not send mix digest, it is computed for known jobs only
+func (s *ProxyServer) mixDigest(header, nonceHex string) string {
+	t := s.currentBlockTemplate()
+	if t == nil || s.etchasher() == nil {
+		return common.Hash{}.Hex()
+	}
+	h, ok := t.headers[header]
+	if !ok {
+		return common.Hash{}.Hex()
+	}
+	nonce, _ := strconv.ParseUint(strings.TrimPrefix(nonceHex, "0x"), 16, 64)
+	mix, _ := s.etchasher().Compute(h.height, common.HexToHash(header), nonce)
+	return mix.Hex()
+}
+
+func splitWorker(s string) (string, string) {
+	parts := strings.SplitN(s, ".", 2)
+	if len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return parts[0], "0"
+}
+
+func (cs *Session) isNiceHash() bool {
+	cs.Lock()
+	defer cs.Unlock()
+	return cs.dialect == dialectNiceHash
+}
@@ -1,6 +1,7 @@
 package proxy
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"log"
@@ -13,6 +14,8 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/hashicorp/golang-lru/simplelru"
+	"github.com/cyberpoolorg/etc-stratum/payouts"
 	"github.com/cyberpoolorg/etc-stratum/policy"
 	"github.com/cyberpoolorg/etc-stratum/rpc"
 	"github.com/cyberpoolorg/etc-stratum/storage"
@@ -22,17 +25,31 @@ import (
 type ProxyServer struct {
 	config             *Config
 	blockTemplate      atomic.Value
-	upstream           int32
-	upstreams          []*rpc.RPCClient
+	upstreams          *rpc.Pool
 	backend            *storage.RedisClient
 	diff               string
 	policy             *policy.PolicyServer
 	hashrateExpiration time.Duration
 	failsCount         int64
-	sessionsMu sync.RWMutex
-	sessions   map[*Session]struct{}
-	timeout    time.Duration
-	Extranonce string
+	sessionsMu         sync.RWMutex
+	sessions           map[*Session]struct{}
+	ipSessions         map[string]int
+	loginSessions      map[string]int
+	timeout            time.Duration
+	writeTimeout       time.Duration
+	queueSize          int
+	broadcastLatency   *latencyTracker
+	resumeMu           sync.Mutex
+	resumeCache        *simplelru.LRU
+	resumeTimeout      time.Duration
+	workLeader         int32
+	lastRemoteJob      int64
+	leaderTimeout      time.Duration
+	solutionsMu        sync.Mutex
+	solutions          map[string]chan *submitResult
+	extranonces        extranoncePool
+	dryRunner          *payouts.PayoutsProcessor
+	Extranonce         string
 }
 
 type jobDetails struct {
@@ -47,32 +64,51 @@ type Session struct {
 	sync.Mutex
 	conn           *net.TCPConn
 	login          string
+	worker         string
 	subscriptionID string
 	JobDeatils     jobDetails
+	difficulty     int64
+	target         string
+	validShares    int64
+	invalidShares  int64
+	resumed        bool
+	resumeState    *sessionState
+	dialect        int
+	extranonce     string
+	out            chan *outMessage
+	closed         bool
 }
 
 func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 	if len(cfg.Name) == 0 {
 		log.Fatal("You must set instance name")
 	}
-	policy := policy.Start(&cfg.Proxy.Policy, backend)
+	policy := policy.Start(&cfg.Proxy.Policy, cfg.Name, backend)
 
 	proxy := &ProxyServer{config: cfg, backend: backend, policy: policy}
 	proxy.diff = util.GetTargetHex(cfg.Proxy.Difficulty)
 
-	proxy.upstreams = make([]*rpc.RPCClient, len(cfg.Upstream))
-	for i, v := range cfg.Upstream {
-		proxy.upstreams[i] = rpc.NewRPCClient(v.Name, v.Url, v.Timeout)
-		log.Printf("Upstream: %s => %s", v.Name, v.Url)
-	}
+	proxy.upstreams = rpc.NewUpstreamPool("Proxy", cfg.Upstream, true)
 	log.Printf("Default upstream: %s => %s", proxy.rpc().Name, proxy.rpc().Url)
 
 	if cfg.Proxy.Stratum.Enabled {
 		proxy.sessions = make(map[*Session]struct{})
+		proxy.ipSessions = make(map[string]int)
+		proxy.loginSessions = make(map[string]int)
+		proxy.broadcastLatency = newLatencyTracker(latencySamples)
+		proxy.initResumeCache()
 		go proxy.ListenTCP()
 	}
 
-	proxy.fetchBlockTemplate()
+	if cfg.Proxy.Admin.Enabled {
+		go proxy.ListenAdmin()
+	}
+
+	if cfg.Proxy.JobDistribution.Enabled {
+		proxy.startJobDistribution()
+	}
+
+	proxy.refreshBlockTemplate()
 
 	proxy.hashrateExpiration = util.MustParseDuration(cfg.Proxy.HashrateExpiration)
 
@@ -90,7 +126,7 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 		for {
 			select {
 			case <-refreshTimer.C:
-				proxy.fetchBlockTemplate()
+				proxy.refreshBlockTemplate()
 				refreshTimer.Reset(refreshIntv)
 			}
 		}
@@ -120,13 +156,13 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 					}
 					n := height - prev
 					if n > 0 {
-						block, err := rpc.GetBlockByHeight(height)
+						block, err := rpc.GetBlockByHeight(context.Background(), height)
 						if err != nil || block == nil {
 							log.Printf("Error while retrieving block from node: %v", err)
 							proxy.markSick()
 						} else {
 							timestamp, _ := strconv.ParseInt(strings.Replace(block.Timestamp, "0x", "", -1), 16, 64)
-							prevblock, _ := rpc.GetBlockByHeight(prev)
+							prevblock, _ := rpc.GetBlockByHeight(context.Background(), prev)
 							prevtime, _ := strconv.ParseInt(strings.Replace(prevblock.Timestamp, "0x", "", -1), 16, 64)
 							blocktime := float64(timestamp-prevtime) / float64(n)
 							err = backend.WriteNodeState(cfg.Name, t.Height, t.Difficulty, blocktime)
@@ -135,6 +171,7 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 								proxy.markSick()
 							} else {
 								proxy.markOk()
+								proxy.writeBroadcastLatency()
 							}
 						}
 					} else {
@@ -144,6 +181,7 @@ func NewProxy(cfg *Config, backend *storage.RedisClient) *ProxyServer {
 							proxy.markSick()
 						} else {
 							proxy.markOk()
+							proxy.writeBroadcastLatency()
 						}
 					}
 				}
@@ -172,24 +210,14 @@ func (s *ProxyServer) Start() {
 }
 
 func (s *ProxyServer) rpc() *rpc.RPCClient {
-	i := atomic.LoadInt32(&s.upstream)
-	return s.upstreams[i]
+	return s.upstreams.Client()
 }
 
 func (s *ProxyServer) checkUpstreams() {
-	candidate := int32(0)
-	backup := false
-
-	for i, v := range s.upstreams {
-		if v.Check() && !backup {
-			candidate = int32(i)
-			backup = true
-		}
-	}
-
-	if s.upstream != candidate {
-		log.Printf("Switching to %v upstream", s.upstreams[candidate].Name)
-		atomic.StoreInt32(&s.upstream, candidate)
+	s.upstreams.Check()
+	err := s.backend.WriteUpstreamHealth(s.config.Name, s.upstreams.Health())
+	if err != nil {
+		log.Printf("Failed to write upstream health to backend: %v", err)
 	}
 }
 
@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/golang-lru/simplelru"
+
+	"github.com/cyberpoolorg/etc-stratum/util"
+)
+
+const defaultResumeCacheSize = 65536
+
+// Worker state kept for a short while after disconnect
+type sessionState struct {
+	login         string
+	worker        string
+	extranonce    string
+	difficulty    int64
+	target        string
+	job           jobDetails
+	validShares   int64
+	invalidShares int64
+	expiresAt     int64
+	resumed       bool
+}
+
+func (s *ProxyServer) initResumeCache() {
+	cfg := s.config.Proxy.Stratum
+	if len(cfg.ResumeTimeout) == 0 {
+		return
+	}
+	s.resumeTimeout = util.MustParseDuration(cfg.ResumeTimeout)
+	size := cfg.ResumeCacheSize
+	if size <= 0 {
+		size = defaultResumeCacheSize
+	}
+	// Saved session holds its extranonce until it is resumed or dropped
+	cache, err := simplelru.NewLRU(size, func(key, value interface{}) {
+		if state := value.(*sessionState); !state.resumed {
+			s.extranonces.release(state.extranonce)
+		}
+	})
+	if err != nil {
+		log.Fatalf("Failed to create session cache: %v", err)
+	}
+	s.resumeCache = cache
+	log.Printf("Stratum sessions can be resumed within %v", s.resumeTimeout)
+}
+
+// Opaque, miner gets it in subscribe reply and presents it on reconnect
+func newSessionID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// Claims state saved under the ID, it is applied once the same worker authorizes
+func (s *ProxyServer) takeSession(id string) *sessionState {
+	if s.resumeCache == nil || len(id) == 0 {
+		return nil
+	}
+	s.resumeMu.Lock()
+	defer s.resumeMu.Unlock()
+
+	v, ok := s.resumeCache.Get(id)
+	if !ok {
+		return nil
+	}
+	state := v.(*sessionState)
+	// Resumed session takes over the extranonce, expired one frees it
+	state.resumed = state.expiresAt >= util.MakeTimestamp()
+	s.resumeCache.Remove(id)
+	if !state.resumed {
+		return nil
+	}
+	return state
+}
+
+// Frees extranonces held by sessions nobody came back for
+func (s *ProxyServer) dropExpiredSessions() {
+	if s.resumeCache == nil {
+		return
+	}
+	s.resumeMu.Lock()
+	defer s.resumeMu.Unlock()
+
+	now := util.MakeTimestamp()
+	for _, id := range s.resumeCache.Keys() {
+		if v, ok := s.resumeCache.Peek(id); ok && v.(*sessionState).expiresAt < now {
+			s.resumeCache.Remove(id)
+		}
+	}
+}
+
+func (s *ProxyServer) resumeSession(cs *Session, login, worker string) bool {
+	cs.Lock()
+	state := cs.resumeState
+	cs.resumeState = nil
+	if state == nil || state.login != login || state.worker != worker {
+		// Fresh session starts with pool difficulty
+		cs.difficulty = s.config.Proxy.Difficulty
+		cs.target = s.diff
+		cs.Unlock()
+		return false
+	}
+	cs.difficulty = state.difficulty
+	cs.target = state.target
+	cs.JobDeatils = state.job
+	cs.Unlock()
+	atomic.StoreInt64(&cs.validShares, state.validShares)
+	atomic.StoreInt64(&cs.invalidShares, state.invalidShares)
+	return true
+}
+
+// Reports whether session state, and its extranonce, went to resume cache
+func (s *ProxyServer) saveSession(cs *Session) bool {
+	if s.resumeCache == nil || !cs.isNiceHash() {
+		return false
+	}
+	cs.Lock()
+	if len(cs.login) == 0 {
+		cs.Unlock()
+		return false
+	}
+	id := cs.subscriptionID
+	state := &sessionState{
+		login:      cs.login,
+		worker:     cs.worker,
+		extranonce: cs.extranonce,
+		difficulty: cs.difficulty,
+		target:     cs.target,
+		job:        cs.JobDeatils,
+		expiresAt:  util.MakeTimestamp() + int64(s.resumeTimeout/time.Millisecond),
+	}
+	cs.Unlock()
+	state.validShares = atomic.LoadInt64(&cs.validShares)
+	state.invalidShares = atomic.LoadInt64(&cs.invalidShares)
+	s.resumeMu.Lock()
+	s.resumeCache.Add(id, state)
+	s.resumeMu.Unlock()
+	return true
+}
+
+// Resumed miners may have missed jobs while they were away
+func (s *ProxyServer) pushCurrentJob(cs *Session) {
+	t := s.currentBlockTemplate()
+	if t == nil || len(t.Header) == 0 || s.isSick() {
+		return
+	}
+	cs.Lock()
+	known := cs.JobDeatils.HeaderHash == t.Header
+	cs.Unlock()
+	if known {
+		return
+	}
+	reply := s.jobForSession(cs, t)
+	if err := cs.pushNewJob(reply, time.Now()); err != nil {
+		log.Printf("Job transmit error to %v@%v: %v", cs.login, cs.ip, err)
+	}
+}
+
+func (s *ProxyServer) jobForSession(cs *Session, t *BlockTemplate) []string {
+	cs.Lock()
+	defer cs.Unlock()
+
+	target := cs.target
+	if len(target) == 0 {
+		target = s.diff
+	}
+	cs.JobDeatils = jobDetails{SeedHash: t.Seed, HeaderHash: t.Header}
+	return []string{t.Header, t.Seed, target}
+}
+
+func (s *ProxyServer) shareDifficulty(cs *Session) int64 {
+	cs.Lock()
+	defer cs.Unlock()
+
+	if cs.difficulty > 0 {
+		return cs.difficulty
+	}
+	return s.config.Proxy.Difficulty
+}
+
+func (cs *Session) trackShare(valid bool) {
+	if valid {
+		atomic.AddInt64(&cs.validShares, 1)
+	} else {
+		atomic.AddInt64(&cs.invalidShares, 1)
+	}
+}
@@ -7,18 +7,46 @@ import (
 	"io"
 	"log"
 	"net"
+	"strings"
 	"time"
 
 	"github.com/cyberpoolorg/etc-stratum/util"
 )
 
 const (
-	MaxReqSize = 1024
+	MaxReqSize          = 1024
+	defaultQueueSize    = 32
+	defaultWriteTimeout = 10 * time.Second
 )
 
+var (
+	errTooManyLoginSessions = errors.New("Too many sessions for this login")
+	errSessionClosed        = errors.New("Session closed")
+	errQueueOverflow        = errors.New("Outbound queue overflow")
+)
+
+// Stratum flavours spoken by a session
+const (
+	dialectEthProxy = iota
+	dialectNiceHash
+)
+
+type outMessage struct {
+	payload  interface{}
+	queuedAt time.Time
+}
+
 func (s *ProxyServer) ListenTCP() {
 	timeout := util.MustParseDuration(s.config.Proxy.Stratum.Timeout)
 	s.timeout = timeout
+	s.writeTimeout = defaultWriteTimeout
+	if len(s.config.Proxy.Stratum.WriteTimeout) > 0 {
+		s.writeTimeout = util.MustParseDuration(s.config.Proxy.Stratum.WriteTimeout)
+	}
+	s.queueSize = s.config.Proxy.Stratum.QueueSize
+	if s.queueSize <= 0 {
+		s.queueSize = defaultQueueSize
+	}
 
 	addr, err := net.ResolveTCPAddr("tcp4", s.config.Proxy.Stratum.Listen)
 	if err != nil {
@@ -47,16 +75,24 @@ func (s *ProxyServer) ListenTCP() {
 			conn.Close()
 			continue
 		}
+		if !s.acquireIPSession(ip) {
+			log.Printf("Too many sessions from %s, refusing connection", ip)
+			go refuseTCPClient(conn, "Too many sessions from your IP")
+			continue
+		}
 		n += 1
-		cs := &Session{conn: conn, ip: ip}
+		cs := &Session{conn: conn, ip: ip, subscriptionID: newSessionID()}
 
 		accept <- n
 		go func(cs *Session) {
-			err = s.handleTCPClient(cs)
-			if err != nil {
-				s.removeSession(cs)
-				conn.Close()
+			s.handleTCPClient(cs)
+			s.removeSession(cs)
+			if !s.saveSession(cs) {
+				s.extranonces.release(cs.extranonce)
 			}
+			// Writer flushes pending replies and closes connection
+			cs.closeQueue()
+			s.releaseIPSession(cs.ip)
 			<-accept
 		}(cs)
 	}
@@ -64,13 +100,16 @@ func (s *ProxyServer) ListenTCP() {
 
 func (s *ProxyServer) handleTCPClient(cs *Session) error {
 	cs.enc = json.NewEncoder(cs.conn)
+	cs.out = make(chan *outMessage, s.queueSize)
+	go s.writeTCPClient(cs)
+
 	connbuff := bufio.NewReaderSize(cs.conn, MaxReqSize)
 	s.setDeadline(cs.conn)
 	for {
 		data, isPrefix, err := connbuff.ReadLine()
 		if isPrefix {
 			log.Printf("Socket flood detected from %s", cs.ip)
-			s.policy.BanClient(cs.ip)
+			s.policy.BanClient(cs.ip, "Socket flood")
 			return err
 		} else if err == io.EOF {
 			log.Printf("Client %s disconnected", cs.ip)
@@ -100,6 +139,9 @@ func (s *ProxyServer) handleTCPClient(cs *Session) error {
 }
 
 func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
+	if strings.HasPrefix(req.Method, "mining.") {
+		return cs.handleNiceHashMessage(s, req)
+	}
 	// Handle RPC methods
 	switch req.Method {
 	case "eth_submitLogin":
@@ -113,7 +155,11 @@ func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
 		if errReply != nil {
 			return cs.sendTCPError(req.Id, errReply)
 		}
-		return cs.sendTCPResult(req.Id, reply)
+		err = cs.sendTCPResult(req.Id, reply)
+		if err == nil && cs.resumed {
+			s.pushCurrentJob(cs)
+		}
+		return err
 	case "eth_getWork":
 		reply, errReply := s.handleGetWorkRPC(cs)
 		if errReply != nil {
@@ -141,47 +187,175 @@ func (cs *Session) handleTCPMessage(s *ProxyServer, req *StratumReq) error {
 }
 
 func (cs *Session) sendTCPResult(id json.RawMessage, result interface{}) error {
-	cs.Lock()
-	defer cs.Unlock()
-
 	message := JSONRpcResp{Id: id, Version: "2.0", Error: nil, Result: result}
-	return cs.enc.Encode(&message)
+	return cs.enqueue(&outMessage{payload: &message})
 }
 
-func (cs *Session) pushNewJob(result interface{}) error {
-	cs.Lock()
-	defer cs.Unlock()
+func (cs *Session) pushNewJob(job []string, queuedAt time.Time) error {
+	if cs.isNiceHash() {
+		header := strings.TrimPrefix(job[0], "0x")
+		params := []interface{}{header, strings.TrimPrefix(job[1], "0x"), header, true}
+		message := JSONRpcNotification{Version: "2.0", Method: "mining.notify", Params: params}
+		return cs.enqueue(&outMessage{payload: &message, queuedAt: queuedAt})
+	}
 	// FIXME: Temporarily add ID for Claymore compliance
-	message := JSONPushMessage{Version: "2.0", Result: result, Id: 0}
-	return cs.enc.Encode(&message)
+	message := JSONPushMessage{Version: "2.0", Result: &job, Id: 0}
+	return cs.enqueue(&outMessage{payload: &message, queuedAt: queuedAt})
 }
 
 func (cs *Session) sendTCPError(id json.RawMessage, reply *ErrorReply) error {
-	cs.Lock()
-	defer cs.Unlock()
-
 	message := JSONRpcResp{Id: id, Version: "2.0", Error: reply}
-	err := cs.enc.Encode(&message)
+	err := cs.enqueue(&outMessage{payload: &message})
 	if err != nil {
 		return err
 	}
 	return errors.New(reply.Message)
 }
 
+func (cs *Session) sendNotification(method string, params interface{}) error {
+	message := JSONRpcNotification{Version: "2.0", Method: method, Params: params}
+	return cs.enqueue(&outMessage{payload: &message})
+}
+
+// Only NiceHash miners understand client.* methods
+func (cs *Session) supportsClientMethods() bool {
+	return cs.isNiceHash()
+}
+
+// Login is set by reader goroutine, other goroutines read it with this
+func (cs *Session) currentLogin() string {
+	cs.Lock()
+	defer cs.Unlock()
+	return cs.login
+}
+
+func (cs *Session) enqueue(msg *outMessage) error {
+	cs.Lock()
+	defer cs.Unlock()
+
+	if cs.closed {
+		return errSessionClosed
+	}
+	select {
+	case cs.out <- msg:
+		return nil
+	default:
+		// Evict slow client, reader will fail and clean up the session
+		cs.conn.Close()
+		return errQueueOverflow
+	}
+}
+
+func (cs *Session) closeQueue() {
+	cs.Lock()
+	defer cs.Unlock()
+
+	if !cs.closed {
+		cs.closed = true
+		close(cs.out)
+	}
+}
+
+func (s *ProxyServer) writeTCPClient(cs *Session) {
+	defer cs.conn.Close()
+
+	for msg := range cs.out {
+		cs.conn.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+		err := cs.enc.Encode(msg.payload)
+		if err != nil {
+			log.Printf("Write error to %v@%v: %v", cs.currentLogin(), cs.ip, err)
+			cs.conn.Close()
+			// Discard the rest until the reader closes the queue
+			for range cs.out {
+			}
+			return
+		}
+		if !msg.queuedAt.IsZero() {
+			s.broadcastLatency.add(time.Since(msg.queuedAt))
+			s.setDeadline(cs.conn)
+		}
+	}
+}
+
 func (self *ProxyServer) setDeadline(conn *net.TCPConn) {
-	conn.SetDeadline(time.Now().Add(self.timeout))
+	conn.SetReadDeadline(time.Now().Add(self.timeout))
+}
+
+func refuseTCPClient(conn *net.TCPConn, reason string) {
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	message := JSONRpcResp{Version: "2.0", Error: &ErrorReply{Code: -1, Message: reason}}
+	json.NewEncoder(conn).Encode(&message)
+}
+
+func (s *ProxyServer) acquireIPSession(ip string) bool {
+	limit := s.config.Proxy.Stratum.MaxSessionsPerIP
+	if limit <= 0 || s.policy.InWhiteList(ip) {
+		limit = 0
+	}
+
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	if limit > 0 && s.ipSessions[ip] >= limit {
+		return false
+	}
+	s.ipSessions[ip]++
+	return true
 }
 
-func (s *ProxyServer) registerSession(cs *Session) {
+func (s *ProxyServer) releaseIPSession(ip string) {
 	s.sessionsMu.Lock()
 	defer s.sessionsMu.Unlock()
+
+	if s.ipSessions[ip] <= 1 {
+		delete(s.ipSessions, ip)
+	} else {
+		s.ipSessions[ip]--
+	}
+}
+
+func (s *ProxyServer) registerSession(cs *Session, login string) error {
+	s.sessionsMu.Lock()
+	defer s.sessionsMu.Unlock()
+
+	if _, ok := s.sessions[cs]; ok {
+		if cs.login == login {
+			return nil
+		}
+		s.decrLoginSessions(cs.login)
+		delete(s.sessions, cs)
+	}
+
+	limit := s.config.Proxy.Stratum.MaxSessionsPerLogin
+	if limit > 0 && s.loginSessions[login] >= limit {
+		return errTooManyLoginSessions
+	}
+	cs.Lock()
+	cs.login = login
+	cs.Unlock()
 	s.sessions[cs] = struct{}{}
+	s.loginSessions[login]++
+	return nil
 }
 
 func (s *ProxyServer) removeSession(cs *Session) {
 	s.sessionsMu.Lock()
 	defer s.sessionsMu.Unlock()
-	delete(s.sessions, cs)
+
+	if _, ok := s.sessions[cs]; ok {
+		delete(s.sessions, cs)
+		s.decrLoginSessions(cs.login)
+	}
+}
+
+// Must be called with sessionsMu held
+func (s *ProxyServer) decrLoginSessions(login string) {
+	if s.loginSessions[login] <= 1 {
+		delete(s.loginSessions, login)
+	} else {
+		s.loginSessions[login]--
+	}
 }
 
 func (s *ProxyServer) broadcastNewJobs() {
@@ -189,32 +363,27 @@ func (s *ProxyServer) broadcastNewJobs() {
 	if t == nil || len(t.Header) == 0 || s.isSick() {
 		return
 	}
-	reply := []string{t.Header, t.Seed, s.diff}
-
 	s.sessionsMu.RLock()
-	defer s.sessionsMu.RUnlock()
+	sessions := make([]*Session, 0, len(s.sessions))
+	for m := range s.sessions {
+		sessions = append(sessions, m)
+	}
+	s.sessionsMu.RUnlock()
 
-	count := len(s.sessions)
-	log.Printf("Broadcasting new job to %v stratum miners", count)
+	log.Printf("Broadcasting new job to %v stratum miners", len(sessions))
 
 	start := time.Now()
-	bcast := make(chan int, 1024)
-	n := 0
-
-	for m, _ := range s.sessions {
-		n++
-		bcast <- n
-
-		go func(cs *Session) {
-			err := cs.pushNewJob(&reply)
-			<-bcast
-			if err != nil {
-				log.Printf("Job transmit error to %v@%v: %v", cs.login, cs.ip, err)
-				s.removeSession(cs)
-			} else {
-				s.setDeadline(cs.conn)
+	evicted := 0
+	for _, cs := range sessions {
+		reply := s.jobForSession(cs, t)
+		err := cs.pushNewJob(reply, start)
+		if err != nil {
+			if err == errQueueOverflow {
+				evicted++
 			}
-		}(m)
+			log.Printf("Job transmit error to %v@%v: %v", cs.currentLogin(), cs.ip, err)
+			s.removeSession(cs)
+		}
 	}
-	log.Printf("Jobs broadcast finished %s", time.Since(start))
+	log.Printf("Jobs broadcast finished %s, evicted %v slow clients", time.Since(start), evicted)
 }
@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type testMessage struct {
+	Id     json.RawMessage
+	Method string
+	Params json.RawMessage
+	Result json.RawMessage
+	Error  *ErrorReply
+}
+
+type testMiner struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func newTestServer() *ProxyServer {
+	return &ProxyServer{
+		config:        &Config{},
+		sessions:      make(map[*Session]struct{}),
+		loginSessions: make(map[string]int),
+		writeTimeout:  time.Second,
+	}
+}
+
+// Session on proxy side of loopback connection, miner reads what proxy writes
+func newTestSession(t *testing.T, s *ProxyServer) (*Session, *testMiner) {
+	ln, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp4", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cs := &Session{conn: server, ip: "127.0.0.1", subscriptionID: newSessionID()}
+	cs.enc = json.NewEncoder(server)
+	cs.out = make(chan *outMessage, 8)
+	go s.writeTCPClient(cs)
+	t.Cleanup(func() {
+		cs.closeQueue()
+		conn.Close()
+	})
+	return cs, &testMiner{t: t, conn: conn, reader: bufio.NewReader(conn)}
+}
+
+func (m *testMiner) read() *testMessage {
+	m.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	line, err := m.reader.ReadBytes('\n')
+	if err != nil {
+		m.t.Fatalf("Expected message: %v", err)
+	}
+	var msg testMessage
+	if err := json.Unmarshal(line, &msg); err != nil {
+		m.t.Fatal(err)
+	}
+	return &msg
+}
+
+func (m *testMiner) expectClosed() {
+	m.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := m.reader.ReadBytes('\n'); err != io.EOF {
+		m.t.Fatalf("Connection must be closed, got %v", err)
+	}
+}
+
+func stratumRequest(method string, params ...string) *StratumReq {
+	data, _ := json.Marshal(params)
+	return &StratumReq{JSONRpcReq: JSONRpcReq{Id: json.RawMessage("1"), Method: method, Params: data}}
+}
+
+func TestNegotiateDialect(t *testing.T) {
+	s := newTestServer()
+	cs, miner := newTestSession(t, s)
+	if cs.supportsClientMethods() {
+		t.Fatal("New session must speak ETHProxy")
+	}
+
+	if err := cs.handleTCPMessage(s, stratumRequest("mining.authorize", "0xabc.rig1", "x")); err == nil {
+		t.Error("Authorize without subscribe must fail")
+	}
+	if msg := miner.read(); msg.Error == nil || msg.Error.Code != 25 {
+		t.Errorf("Expected not subscribed error, got %+v", msg)
+	}
+	if err := cs.handleTCPMessage(s, stratumRequest("mining.subscribe", "miner/1.0", "EthereumStratum/2.0.0")); err == nil {
+		t.Error("EIP-1571 subscribe must be refused")
+	}
+	if msg := miner.read(); msg.Error == nil || msg.Error.Code != 20 {
+		t.Errorf("Expected unsupported protocol error, got %+v", msg)
+	}
+	if cs.supportsClientMethods() {
+		t.Fatal("Refused subscribe must keep ETHProxy dialect")
+	}
+
+	if err := cs.handleTCPMessage(s, stratumRequest("mining.subscribe", "miner/1.0", "EthereumStratum/1.0.0")); err != nil {
+		t.Fatal(err)
+	}
+	if !cs.supportsClientMethods() {
+		t.Fatal("Subscribed session must speak NiceHash")
+	}
+	var reply []json.RawMessage
+	var notify []string
+	var extranonce string
+	json.Unmarshal(miner.read().Result, &reply)
+	if len(reply) != 2 || json.Unmarshal(reply[0], &notify) != nil || json.Unmarshal(reply[1], &extranonce) != nil {
+		t.Fatalf("Unexpected subscribe reply %s", reply)
+	}
+	if len(notify) != 3 || notify[1] != cs.subscriptionID || notify[2] != nicehashProtocol || len(extranonce) != 4 {
+		t.Errorf("Unexpected subscribe reply %v %v", notify, extranonce)
+	}
+
+	// Subscribing again must not leak or change extranonce
+	cs.handleTCPMessage(s, stratumRequest("mining.subscribe", "miner/1.0", "EthereumStratum/1.0.0"))
+	json.Unmarshal(miner.read().Result, &reply)
+	var again string
+	json.Unmarshal(reply[1], &again)
+	if again != extranonce || len(s.extranonces.used) != 1 {
+		t.Errorf("Extranonce %v must be kept, got %v with %v in use", extranonce, again, len(s.extranonces.used))
+	}
+}
+
+func adminCall(t *testing.T, handler http.HandlerFunc, cmd *AdminCommand) *AdminReply {
+	data, _ := json.Marshal(cmd)
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/", bytes.NewReader(data)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("Admin command failed with %v: %s", w.Code, w.Body)
+	}
+	var reply AdminReply
+	json.Unmarshal(w.Body.Bytes(), &reply)
+	return &reply
+}
+
+func TestClientMethods(t *testing.T) {
+	s := newTestServer()
+	nicehash, nicehashMiner := newTestSession(t, s)
+	nicehash.dialect = dialectNiceHash
+	ethproxy, ethproxyMiner := newTestSession(t, s)
+	s.registerSession(nicehash, "0xabc")
+	s.registerSession(ethproxy, "0xabc")
+
+	reply := adminCall(t, s.AdminMessage, &AdminCommand{Message: "Maintenance"})
+	if reply.Matched != 2 || reply.Notified != 1 || reply.Unsupported != 1 {
+		t.Errorf("Unexpected message reply %+v", reply)
+	}
+	msg := nicehashMiner.read()
+	if msg.Method != "client.show_message" || string(msg.Params) != `["Maintenance"]` {
+		t.Errorf("Unexpected notification %s %s", msg.Method, msg.Params)
+	}
+
+	reply = adminCall(t, s.AdminReconnect, &AdminCommand{Host: "eu2.example.org", Port: 8008, BatchInterval: "1ms"})
+	if reply.Matched != 2 || reply.Notified != 1 || reply.Closing != 1 {
+		t.Errorf("Unexpected reconnect reply %+v", reply)
+	}
+	msg = nicehashMiner.read()
+	if msg.Method != "client.reconnect" || string(msg.Params) != `["eu2.example.org",8008,0]` {
+		t.Errorf("Unexpected notification %s %s", msg.Method, msg.Params)
+	}
+	ethproxyMiner.expectClosed()
+}
+
+func TestCloseInBatches(t *testing.T) {
+	s := newTestServer()
+	var sessions []*Session
+	var miners []*testMiner
+	for i := 0; i < 5; i++ {
+		cs, miner := newTestSession(t, s)
+		sessions = append(sessions, cs)
+		miners = append(miners, miner)
+	}
+
+	start := time.Now()
+	closeInBatches(sessions, 2, 50*time.Millisecond)
+	// 3 batches with pauses between them only
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Unexpected close duration %v", elapsed)
+	}
+	for _, miner := range miners {
+		miner.expectClosed()
+	}
+}
+
+func TestExtranoncePool(t *testing.T) {
+	var p extranoncePool
+	seen := make(map[string]bool)
+	for i := 0; i <= 0xffff; i++ {
+		extranonce, ok := p.acquire()
+		if !ok || seen[extranonce] {
+			t.Fatalf("Extranonce %v must be unique", extranonce)
+		}
+		seen[extranonce] = true
+	}
+	if _, ok := p.acquire(); ok {
+		t.Fatal("Exhausted range must fail")
+	}
+	p.release("1234")
+	if extranonce, ok := p.acquire(); !ok || extranonce != "1234" {
+		t.Errorf("Released extranonce must be reused, got %v", extranonce)
+	}
+}
+
+// Saved session keeps its extranonce until it is resumed, evicted or expired
+func TestResumeExtranonce(t *testing.T) {
+	s := newTestServer()
+	s.config.Proxy.Stratum.ResumeTimeout = "1m"
+	s.initResumeCache()
+	cs, _ := newTestSession(t, s)
+	cs.dialect = dialectNiceHash
+	cs.login = "0xabc"
+	cs.extranonce, _ = s.newExtranonce()
+
+	if !s.saveSession(cs) {
+		t.Fatal("Session must be saved")
+	}
+	if _, ok := s.extranonces.used[cs.extranonce]; !ok {
+		t.Fatal("Saved session must hold extranonce")
+	}
+	state := s.takeSession(cs.subscriptionID)
+	if state == nil || state.extranonce != cs.extranonce {
+		t.Fatalf("Session must be resumed with %v, got %+v", cs.extranonce, state)
+	}
+	if _, ok := s.extranonces.used[cs.extranonce]; !ok {
+		t.Fatal("Resumed session must hold extranonce")
+	}
+	if s.takeSession(cs.subscriptionID) != nil {
+		t.Fatal("Session must not be resumed twice")
+	}
+
+	s.saveSession(cs)
+	v, _ := s.resumeCache.Peek(cs.subscriptionID)
+	v.(*sessionState).expiresAt = 0
+	s.dropExpiredSessions()
+	if _, ok := s.extranonces.used[cs.extranonce]; ok {
+		t.Error("Expired session must free extranonce")
+	}
+
+	cs.extranonce, _ = s.newExtranonce()
+	s.saveSession(cs)
+	for i := 0; i < defaultResumeCacheSize; i++ {
+		s.resumeCache.Add(newSessionID(), &sessionState{})
+	}
+	if _, ok := s.extranonces.used[cs.extranonce]; ok {
+		t.Error("Evicted session must free extranonce")
+	}
+}
@@ -0,0 +1,103 @@
+package rpc
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Node accepts tokens issued within a minute, reissue well before that
+const jwtRefreshInterval = 30 * time.Second
+
+type Auth struct {
+	Headers  map[string]string `json:"headers"`
+	Username string            `json:"username"`
+	Password string            `json:"password"`
+	// Path to file with hex encoded 32 bytes secret shared with node
+	JWTSecret string `json:"jwtSecret"`
+}
+
+type authenticator struct {
+	sync.Mutex
+	headers  map[string]string
+	username string
+	password string
+	secret   []byte
+	token    string
+	issuedAt time.Time
+}
+
+func newAuthenticator(cfg *Auth) (*authenticator, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	a := &authenticator{headers: cfg.Headers, username: cfg.Username, password: cfg.Password}
+	if len(cfg.JWTSecret) > 0 {
+		secret, err := readJWTSecret(cfg.JWTSecret)
+		if err != nil {
+			return nil, err
+		}
+		a.secret = secret
+	}
+	return a, nil
+}
+
+func readJWTSecret(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := strings.TrimPrefix(strings.TrimSpace(string(data)), "0x")
+	secret, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JWT secret in %s: %v", path, err)
+	}
+	if len(secret) != 32 {
+		return nil, fmt.Errorf("invalid JWT secret in %s: want 32 bytes, got %v", path, len(secret))
+	}
+	return secret, nil
+}
+
+func (a *authenticator) apply(h http.Header) {
+	if a == nil {
+		return
+	}
+	for k, v := range a.headers {
+		h.Set(k, v)
+	}
+	if len(a.secret) > 0 {
+		h.Set("Authorization", "Bearer "+a.jwt(time.Now()))
+	} else if len(a.username) > 0 {
+		h.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(a.username+":"+a.password)))
+	}
+}
+
+func (a *authenticator) jwt(now time.Time) string {
+	a.Lock()
+	defer a.Unlock()
+
+	if len(a.token) == 0 || now.Sub(a.issuedAt) >= jwtRefreshInterval {
+		a.token = signJWT(a.secret, now)
+		a.issuedAt = now
+	}
+	return a.token
+}
+
+// HS256 token carrying only "iat" claim as required by engine API
+func signJWT(secret []byte, now time.Time) string {
+	header, _ := json.Marshal(map[string]string{"alg": "HS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]int64{"iat": now.Unix()})
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + enc.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,111 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+)
+
+// Single request of a batch, Result must be a pointer to unmarshal reply into
+type BatchElem struct {
+	Method string
+	Params interface{}
+	Result interface{}
+	Error  error
+}
+
+type batchReply struct {
+	Id     uint64          `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  json.RawMessage `json:"error"`
+}
+
+// Sends all requests at once, returned error is for the whole batch,
+// per request errors are set on elements. Batches must contain only
+// idempotent reads as they are retried on transport errors.
+func (r *RPCClient) BatchCall(ctx context.Context, batch []BatchElem) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	return withRetry(ctx, true, func() error {
+		return r.batchCall(ctx, batch)
+	})
+}
+
+func (r *RPCClient) batchCall(ctx context.Context, batch []BatchElem) error {
+	reqs := make([]map[string]interface{}, len(batch))
+	index := make(map[uint64]int, len(batch))
+	var first uint64
+	for i, elem := range batch {
+		id := atomic.AddUint64(&r.requestId, 1)
+		if i == 0 {
+			first = id
+		}
+		reqs[i] = map[string]interface{}{"jsonrpc": "2.0", "method": elem.Method, "params": elem.Params, "id": id}
+		index[id] = i
+	}
+	data, _ := json.Marshal(reqs)
+
+	resp, err := r.transport.call(ctx, strconv.FormatUint(first, 10), data)
+	if err != nil {
+		r.markSick()
+		return &TransportError{err}
+	}
+	// Node refusing the batch, e.g. with batching disabled, replies with single error
+	if resp = bytes.TrimSpace(resp); len(resp) > 0 && resp[0] == '{' {
+		var reply batchReply
+		if err := json.Unmarshal(resp, &reply); err == nil && len(reply.Error) > 0 && string(reply.Error) != "null" {
+			return parseRPCError(reply.Error)
+		}
+		return &NodeError{fmt.Errorf("unexpected batch reply: %s", resp)}
+	}
+	var replies []batchReply
+	err = json.Unmarshal(resp, &replies)
+	if err != nil {
+		r.markSick()
+		return &TransportError{fmt.Errorf("unreadable batch reply: %v", err)}
+	}
+
+	for _, reply := range replies {
+		i, ok := index[reply.Id]
+		if !ok {
+			continue
+		}
+		delete(index, reply.Id)
+		elem := &batch[i]
+		elem.Error = nil
+		if len(reply.Error) > 0 && string(reply.Error) != "null" {
+			elem.Error = parseRPCError(reply.Error)
+			continue
+		}
+		if elem.Result != nil {
+			if len(reply.Result) == 0 {
+				reply.Result = json.RawMessage("null")
+			}
+			if err := json.Unmarshal(reply.Result, elem.Result); err != nil {
+				elem.Error = &NodeError{fmt.Errorf("malformed %s result: %v", elem.Method, err)}
+			}
+		}
+	}
+	for id, i := range index {
+		batch[i].Error = &NodeError{fmt.Errorf("missing reply for request %v", id)}
+	}
+	return nil
+}
+
+func BlockByHeightRequest(height int64, reply **GetBlockReply) BatchElem {
+	params := []interface{}{fmt.Sprintf("0x%x", height), true}
+	return BatchElem{Method: "eth_getBlockByNumber", Params: params, Result: reply}
+}
+
+func UncleByBlockNumberAndIndexRequest(height int64, index int, reply **GetBlockReply) BatchElem {
+	params := []interface{}{fmt.Sprintf("0x%x", height), fmt.Sprintf("0x%x", index)}
+	return BatchElem{Method: "eth_getUncleByBlockNumberAndIndex", Params: params, Result: reply}
+}
+
+func TxReceiptRequest(hash string, reply **TxReceipt) BatchElem {
+	return BatchElem{Method: "eth_getTransactionReceipt", Params: []string{hash}, Result: reply}
+}
@@ -0,0 +1,96 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	maxRetries   = 3
+	retryBackoff = 250 * time.Millisecond
+)
+
+// Node could not be reached or reply could not be read
+type TransportError struct {
+	Err error
+}
+
+func (e *TransportError) Error() string {
+	return "transport error: " + e.Err.Error()
+}
+
+func (e *TransportError) Unwrap() error {
+	return e.Err
+}
+
+// Node replied with malformed or unexpected data
+type NodeError struct {
+	Err error
+}
+
+func (e *NodeError) Error() string {
+	return "node error: " + e.Err.Error()
+}
+
+func (e *NodeError) Unwrap() error {
+	return e.Err
+}
+
+// JSON-RPC error object returned by node
+type RPCError struct {
+	Code    int
+	Message string
+}
+
+func (e *RPCError) Error() string {
+	return fmt.Sprintf("%s (code %d)", e.Message, e.Code)
+}
+
+// Temporary errors are worth retrying later, request did not reach the node
+func IsTemporary(err error) bool {
+	var transportErr *TransportError
+	return errors.As(err, &transportErr)
+}
+
+func IsRPCError(err error) bool {
+	var rpcErr *RPCError
+	return errors.As(err, &rpcErr)
+}
+
+// Nodes are not consistent about message type, never trust it to be a string
+func parseRPCError(raw json.RawMessage) *RPCError {
+	var reply struct {
+		Code    int         `json:"code"`
+		Message interface{} `json:"message"`
+	}
+	if err := json.Unmarshal(raw, &reply); err != nil {
+		return &RPCError{Code: 0, Message: string(raw)}
+	}
+	message, ok := reply.Message.(string)
+	if !ok {
+		message = fmt.Sprint(reply.Message)
+	}
+	return &RPCError{Code: reply.Code, Message: message}
+}
+
+// Retries idempotent requests on transport errors with exponential backoff
+func withRetry(ctx context.Context, idempotent bool, fn func() error) error {
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || !idempotent || !IsTemporary(err) || attempt == maxRetries {
+			return err
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
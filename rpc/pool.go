@@ -0,0 +1,208 @@
+package rpc
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cyberpoolorg/etc-stratum/util"
+)
+
+// Upstreams are scored on every check, higher is better
+const (
+	maxScore = 1000
+	// Per block behind the highest upstream
+	lagPenalty      = 100
+	syncingPenalty  = 500
+	lowPeers        = 3
+	lowPeersPenalty = 200
+	// One point per this much of response latency
+	latencyUnit       = 10 * time.Millisecond
+	maxLatencyPenalty = 200
+	// Keep current upstream unless another one scores better by this margin
+	switchMargin = 150
+)
+
+type Upstream struct {
+	Name    string `json:"name"`
+	Url     string `json:"url"`
+	Timeout string `json:"timeout"`
+	Auth    Auth   `json:"auth"`
+}
+
+// Single daemon of older configs is used when no upstream list is set
+func UpstreamList(upstreams []Upstream, name, daemon, timeout string, auth Auth) []Upstream {
+	if len(upstreams) > 0 {
+		return upstreams
+	}
+	return []Upstream{{Name: name, Url: daemon, Timeout: timeout, Auth: auth}}
+}
+
+type Health struct {
+	Name      string `json:"name"`
+	Alive     bool   `json:"alive"`
+	Primary   bool   `json:"primary"`
+	Height    int64  `json:"height"`
+	Syncing   bool   `json:"syncing"`
+	Peers     int64  `json:"peers"`
+	Latency   int64  `json:"latency"`
+	Score     int64  `json:"score"`
+	CheckedAt int64  `json:"checkedAt"`
+}
+
+// Set of upstreams with health based failover
+type Pool struct {
+	sync.RWMutex
+	name      string
+	clients   []*RPCClient
+	current   int32
+	health    []Health
+	checkWork bool
+}
+
+// checkWork requires upstreams to serve eth_getWork, only mining proxy needs that
+func NewPool(name string, clients []*RPCClient, checkWork bool) *Pool {
+	return &Pool{name: name, clients: clients, checkWork: checkWork}
+}
+
+func NewUpstreamPool(name string, upstreams []Upstream, checkWork bool) *Pool {
+	clients := make([]*RPCClient, len(upstreams))
+	for i, v := range upstreams {
+		clients[i] = NewRPCClient(v.Name, v.Url, v.Timeout, &v.Auth)
+		log.Printf("%s upstream: %s => %s", name, v.Name, v.Url)
+	}
+	return NewPool(name, clients, checkWork)
+}
+
+func (p *Pool) Client() *RPCClient {
+	return p.clients[atomic.LoadInt32(&p.current)]
+}
+
+func (p *Pool) Clients() []*RPCClient {
+	return p.clients
+}
+
+// Alive and synced upstreams as of last check
+func (p *Pool) Synced() []*RPCClient {
+	p.RLock()
+	defer p.RUnlock()
+	var clients []*RPCClient
+	for i, h := range p.health {
+		if h.Alive && !h.Syncing {
+			clients = append(clients, p.clients[i])
+		}
+	}
+	return clients
+}
+
+func (p *Pool) Health() []Health {
+	p.RLock()
+	defer p.RUnlock()
+	return append([]Health(nil), p.health...)
+}
+
+// Probes all upstreams and switches to the best one
+func (p *Pool) Check() {
+	health := make([]Health, len(p.clients))
+	var wg sync.WaitGroup
+	for i, c := range p.clients {
+		wg.Add(1)
+		go func(i int, c *RPCClient) {
+			defer wg.Done()
+			health[i] = p.probe(c)
+		}(i, c)
+	}
+	wg.Wait()
+	scoreHealth(health)
+
+	current := int(atomic.LoadInt32(&p.current))
+	candidate := selectUpstream(health, current)
+	if candidate != current {
+		log.Printf("%s: switching to %v upstream, score %v", p.name, p.clients[candidate].Name, health[candidate].Score)
+		atomic.StoreInt32(&p.current, int32(candidate))
+	}
+	health[candidate].Primary = true
+
+	p.Lock()
+	p.health = health
+	p.Unlock()
+}
+
+func (p *Pool) probe(c *RPCClient) Health {
+	ctx := context.Background()
+	h := Health{Name: c.Name, CheckedAt: util.MakeTimestamp()}
+
+	start := time.Now()
+	height, err := c.GetBlockNumber(ctx)
+	if err != nil {
+		return h
+	}
+	h.Latency = int64(time.Since(start) / time.Millisecond)
+	h.Height = height
+	if h.Syncing, err = c.Syncing(ctx); err != nil {
+		return h
+	}
+	if h.Peers, err = c.GetPeerCount(ctx); err != nil {
+		return h
+	}
+	if p.checkWork {
+		if _, err = c.GetWork(ctx); err != nil {
+			return h
+		}
+	}
+	c.markAlive()
+	h.Alive = !c.Sick()
+	return h
+}
+
+func scoreHealth(health []Health) {
+	var best int64
+	for _, h := range health {
+		if h.Alive && h.Height > best {
+			best = h.Height
+		}
+	}
+	for i := range health {
+		h := &health[i]
+		if !h.Alive {
+			h.Score = 0
+			continue
+		}
+		score := int64(maxScore)
+		score -= (best - h.Height) * lagPenalty
+		if h.Syncing {
+			score -= syncingPenalty
+		}
+		if h.Peers < lowPeers {
+			score -= lowPeersPenalty
+		}
+		latency := h.Latency / int64(latencyUnit/time.Millisecond)
+		if latency > maxLatencyPenalty {
+			latency = maxLatencyPenalty
+		}
+		score -= latency
+		if score < 1 {
+			score = 1
+		}
+		h.Score = score
+	}
+}
+
+// Earlier upstream wins a tie, current one is kept if none is alive
+func selectUpstream(health []Health, current int) int {
+	best := -1
+	for i, h := range health {
+		if h.Alive && (best < 0 || h.Score > health[best].Score) {
+			best = i
+		}
+	}
+	if best < 0 || best == current {
+		return current
+	}
+	if health[current].Alive && health[best].Score-health[current].Score < switchMargin {
+		return current
+	}
+	return best
+}
@@ -0,0 +1,38 @@
+package rpc
+
+import "testing"
+
+func TestUpstreamSelection(t *testing.T) {
+	health := []Health{
+		{Name: "main", Alive: true, Height: 100, Peers: 25, Latency: 20},
+		{Name: "backup", Alive: true, Height: 101, Peers: 25, Latency: 40},
+		{Name: "syncing", Alive: true, Height: 101, Peers: 25, Syncing: true},
+		{Name: "dead", Height: 200},
+	}
+	scoreHealth(health)
+	if health[0].Score != 898 || health[1].Score != 996 || health[2].Score != 500 || health[3].Score != 0 {
+		t.Errorf("Unexpected scores %+v", health)
+	}
+	if selectUpstream(health, 0) != 0 {
+		t.Error("Must keep current upstream lagging by one block")
+	}
+	if selectUpstream(health, 2) != 1 {
+		t.Error("Must leave syncing upstream")
+	}
+	if selectUpstream(health, 3) != 1 {
+		t.Error("Must leave dead upstream")
+	}
+
+	health[0].Height = 98
+	scoreHealth(health)
+	if selectUpstream(health, 0) != 1 {
+		t.Error("Must switch from lagging upstream")
+	}
+
+	for i := range health {
+		health[i].Alive = false
+	}
+	if selectUpstream(health, 2) != 2 {
+		t.Error("Must keep current upstream if none is alive")
+	}
+}
@@ -1,16 +1,17 @@
 package rpc
 
 import (
-	"bytes"
+	"context"
 	"crypto/sha256"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log"
 	"math/big"
-	"net/http"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/cyberpoolorg/etc-stratum/util"
@@ -23,7 +24,8 @@ type RPCClient struct {
 	sick        bool
 	sickRate    int
 	successRate int
-	client      *http.Client
+	requestId   uint64
+	transport   transport
 }
 
 type GetBlockReply struct {
@@ -48,10 +50,11 @@ type GetBlockReplyPart struct {
 const receiptStatusSuccessful = "0x1"
 
 type TxReceipt struct {
-	TxHash    string `json:"transactionHash"`
-	GasUsed   string `json:"gasUsed"`
-	BlockHash string `json:"blockHash"`
-	Status    string `json:"status"`
+	TxHash            string `json:"transactionHash"`
+	GasUsed           string `json:"gasUsed"`
+	EffectiveGasPrice string `json:"effectiveGasPrice"`
+	BlockHash         string `json:"blockHash"`
+	Status            string `json:"status"`
 }
 
 func (r *TxReceipt) Confirmed() bool {
@@ -67,121 +70,111 @@ func (r *TxReceipt) Successful() bool {
 }
 
 type Tx struct {
-	Gas      string `json:"gas"`
-	GasPrice string `json:"gasPrice"`
-	Hash     string `json:"hash"`
+	Gas       string `json:"gas"`
+	GasPrice  string `json:"gasPrice"`
+	Hash      string `json:"hash"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Value     string `json:"value"`
+	Nonce     string `json:"nonce"`
+	BlockHash string `json:"blockHash"`
 }
 
 type JSONRpcResp struct {
-	Id     *json.RawMessage       `json:"id"`
-	Result *json.RawMessage       `json:"result"`
-	Error  map[string]interface{} `json:"error"`
+	Id     *json.RawMessage `json:"id"`
+	Result *json.RawMessage `json:"result"`
+	Error  json.RawMessage  `json:"error"`
 }
 
-func NewRPCClient(name, url, timeout string) *RPCClient {
+func NewRPCClient(name, url, timeout string, auth *Auth) *RPCClient {
 	rpcClient := &RPCClient{Name: name, Url: url}
 	timeoutIntv := util.MustParseDuration(timeout)
-	rpcClient.client = &http.Client{
-		Timeout: timeoutIntv,
+	authenticator, err := newAuthenticator(auth)
+	if err != nil {
+		log.Fatalf("Failed to set up auth for %s upstream: %v", name, err)
 	}
+	rpcClient.transport = newTransport(url, timeoutIntv, authenticator)
 	return rpcClient
 }
 
-func (r *RPCClient) GetWork() ([]string, error) {
-	rpcResp, err := r.doPost(r.Url, "eth_getWork", []string{})
-	if err != nil {
-		return nil, err
-	}
+func (r *RPCClient) GetWork(ctx context.Context) ([]string, error) {
 	var reply []string
-	err = json.Unmarshal(*rpcResp.Result, &reply)
+	err := r.call(ctx, "eth_getWork", []string{}, &reply, false)
+	if err == nil && len(reply) < 3 {
+		err = &NodeError{errors.New("work is not ready")}
+	}
 	return reply, err
 }
 
-func (r *RPCClient) GetPendingBlock() (*GetBlockReplyPart, error) {
-	rpcResp, err := r.doPost(r.Url, "eth_getBlockByNumber", []interface{}{"pending", false})
-	if err != nil {
-		return nil, err
-	}
-	if rpcResp.Result != nil {
-		var reply *GetBlockReplyPart
-		err = json.Unmarshal(*rpcResp.Result, &reply)
-		return reply, err
-	}
-	return nil, nil
+func (r *RPCClient) GetPendingBlock(ctx context.Context) (*GetBlockReplyPart, error) {
+	var reply *GetBlockReplyPart
+	err := r.call(ctx, "eth_getBlockByNumber", []interface{}{"pending", false}, &reply, true)
+	return reply, err
 }
 
-func (r *RPCClient) GetBlockByHeight(height int64) (*GetBlockReply, error) {
+func (r *RPCClient) GetBlockByHeight(ctx context.Context, height int64) (*GetBlockReply, error) {
 	params := []interface{}{fmt.Sprintf("0x%x", height), true}
-	return r.getBlockBy("eth_getBlockByNumber", params)
+	return r.getBlockBy(ctx, "eth_getBlockByNumber", params)
 }
 
-func (r *RPCClient) GetBlockByHash(hash string) (*GetBlockReply, error) {
+func (r *RPCClient) GetBlockByHash(ctx context.Context, hash string) (*GetBlockReply, error) {
 	params := []interface{}{hash, true}
-	return r.getBlockBy("eth_getBlockByHash", params)
+	return r.getBlockBy(ctx, "eth_getBlockByHash", params)
 }
 
-func (r *RPCClient) GetUncleByBlockNumberAndIndex(height int64, index int) (*GetBlockReply, error) {
+func (r *RPCClient) GetUncleByBlockNumberAndIndex(ctx context.Context, height int64, index int) (*GetBlockReply, error) {
 	params := []interface{}{fmt.Sprintf("0x%x", height), fmt.Sprintf("0x%x", index)}
-	return r.getBlockBy("eth_getUncleByBlockNumberAndIndex", params)
+	return r.getBlockBy(ctx, "eth_getUncleByBlockNumberAndIndex", params)
 }
 
-func (r *RPCClient) getBlockBy(method string, params []interface{}) (*GetBlockReply, error) {
-	rpcResp, err := r.doPost(r.Url, method, params)
-	if err != nil {
-		return nil, err
-	}
-	if rpcResp.Result != nil {
-		var reply *GetBlockReply
-		err = json.Unmarshal(*rpcResp.Result, &reply)
-		return reply, err
-	}
-	return nil, nil
+func (r *RPCClient) getBlockBy(ctx context.Context, method string, params []interface{}) (*GetBlockReply, error) {
+	var reply *GetBlockReply
+	err := r.call(ctx, method, params, &reply, true)
+	return reply, err
 }
 
-func (r *RPCClient) GetTxReceipt(hash string) (*TxReceipt, error) {
-	rpcResp, err := r.doPost(r.Url, "eth_getTransactionReceipt", []string{hash})
-	if err != nil {
-		return nil, err
-	}
-	if rpcResp.Result != nil {
-		var reply *TxReceipt
-		err = json.Unmarshal(*rpcResp.Result, &reply)
-		return reply, err
-	}
-	return nil, nil
+// Nil if transaction is neither mined nor in the pool
+func (r *RPCClient) GetTransactionByHash(ctx context.Context, hash string) (*Tx, error) {
+	var reply *Tx
+	err := r.call(ctx, "eth_getTransactionByHash", []string{hash}, &reply, true)
+	return reply, err
 }
 
-func (r *RPCClient) SubmitBlock(params []string) (bool, error) {
-	rpcResp, err := r.doPost(r.Url, "eth_submitWork", params)
-	if err != nil {
-		return false, err
-	}
+func (r *RPCClient) GetTxReceipt(ctx context.Context, hash string) (*TxReceipt, error) {
+	var reply *TxReceipt
+	err := r.call(ctx, "eth_getTransactionReceipt", []string{hash}, &reply, true)
+	return reply, err
+}
+
+func (r *RPCClient) SubmitBlock(ctx context.Context, params []string) (bool, error) {
 	var reply bool
-	err = json.Unmarshal(*rpcResp.Result, &reply)
+	err := r.call(ctx, "eth_submitWork", params, &reply, false)
 	return reply, err
 }
 
-func (r *RPCClient) GetBalance(address string) (*big.Int, error) {
-	rpcResp, err := r.doPost(r.Url, "eth_getBalance", []string{address, "latest"})
-	if err != nil {
-		return nil, err
-	}
+func (r *RPCClient) GetBalance(ctx context.Context, address string) (*big.Int, error) {
 	var reply string
-	err = json.Unmarshal(*rpcResp.Result, &reply)
+	err := r.call(ctx, "eth_getBalance", []string{address, "latest"}, &reply, true)
 	if err != nil {
 		return nil, err
 	}
 	return util.String2Big(reply), err
 }
 
-func (r *RPCClient) Sign(from string, s string) (string, error) {
-	hash := sha256.Sum256([]byte(s))
-	rpcResp, err := r.doPost(r.Url, "eth_sign", []string{from, hexutil.Encode(hash[:])})
+// Empty for accounts without contract code
+func (r *RPCClient) GetCode(ctx context.Context, address string) (string, error) {
 	var reply string
+	err := r.call(ctx, "eth_getCode", []string{address, "latest"}, &reply, true)
 	if err != nil {
-		return reply, err
+		return "", err
 	}
-	err = json.Unmarshal(*rpcResp.Result, &reply)
+	return strings.TrimPrefix(reply, "0x"), nil
+}
+
+func (r *RPCClient) Sign(ctx context.Context, from string, s string) (string, error) {
+	hash := sha256.Sum256([]byte(s))
+	var reply string
+	err := r.call(ctx, "eth_sign", []string{from, hexutil.Encode(hash[:])}, &reply, true)
 	if err != nil {
 		return reply, err
 	}
@@ -191,35 +184,51 @@ func (r *RPCClient) Sign(from string, s string) (string, error) {
 	return reply, err
 }
 
-func (r *RPCClient) GetPeerCount() (int64, error) {
-	rpcResp, err := r.doPost(r.Url, "net_peerCount", nil)
+func (r *RPCClient) GetPeerCount(ctx context.Context) (int64, error) {
+	var reply string
+	err := r.call(ctx, "net_peerCount", nil, &reply, true)
 	if err != nil {
 		return 0, err
 	}
+	return strconv.ParseInt(strings.Replace(reply, "0x", "", -1), 16, 64)
+}
+
+func (r *RPCClient) GetBlockNumber(ctx context.Context) (int64, error) {
 	var reply string
-	err = json.Unmarshal(*rpcResp.Result, &reply)
+	err := r.call(ctx, "eth_blockNumber", nil, &reply, true)
 	if err != nil {
 		return 0, err
 	}
 	return strconv.ParseInt(strings.Replace(reply, "0x", "", -1), 16, 64)
 }
 
-func (r *RPCClient) SendTransaction(from, to, gas, gasPrice, value string, autoGas bool) (string, error) {
+// Node replies false when synced and progress object otherwise
+func (r *RPCClient) Syncing(ctx context.Context) (bool, error) {
+	var reply json.RawMessage
+	err := r.call(ctx, "eth_syncing", nil, &reply, true)
+	if err != nil {
+		return false, err
+	}
+	return string(reply) != "false", nil
+}
+
+// Never retried, a lost reply does not mean transaction was not sent
+// Node picks nonce when it is empty
+func (r *RPCClient) SendTransaction(ctx context.Context, from, to, gas, gasPrice, value, nonce string, autoGas bool) (string, error) {
 	params := map[string]string{
 		"from":  from,
 		"to":    to,
 		"value": value,
 	}
+	if len(nonce) > 0 {
+		params["nonce"] = nonce
+	}
 	if !autoGas {
 		params["gas"] = gas
 		params["gasPrice"] = gasPrice
 	}
-	rpcResp, err := r.doPost(r.Url, "eth_sendTransaction", []interface{}{params})
 	var reply string
-	if err != nil {
-		return reply, err
-	}
-	err = json.Unmarshal(*rpcResp.Result, &reply)
+	err := r.call(ctx, "eth_sendTransaction", []interface{}{params}, &reply, false)
 	if err != nil {
 		return reply, err
 	}
@@ -230,42 +239,84 @@ func (r *RPCClient) SendTransaction(from, to, gas, gasPrice, value string, autoG
 	return reply, err
 }
 
-func (r *RPCClient) doPost(url string, method string, params interface{}) (*JSONRpcResp, error) {
-	jsonReq := map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params, "id": 0}
-	data, _ := json.Marshal(jsonReq)
+// Never retried either, data is signed transaction in hex
+func (r *RPCClient) SendRawTransaction(ctx context.Context, data string) (string, error) {
+	var reply string
+	err := r.call(ctx, "eth_sendRawTransaction", []string{data}, &reply, false)
+	return reply, err
+}
 
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(data))
-	req.Header.Set("Content-Length", (string)(len(data)))
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/json")
+// Next nonce of address, tag "pending" includes transactions in the pool
+func (r *RPCClient) GetTransactionCount(ctx context.Context, address, tag string) (uint64, error) {
+	var reply string
+	err := r.call(ctx, "eth_getTransactionCount", []string{address, tag}, &reply, true)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.Replace(reply, "0x", "", -1), 16, 64)
+}
 
-	resp, err := r.client.Do(req)
+func (r *RPCClient) GetChainId(ctx context.Context) (*big.Int, error) {
+	var reply string
+	err := r.call(ctx, "eth_chainId", nil, &reply, true)
 	if err != nil {
-		r.markSick()
 		return nil, err
 	}
-	defer resp.Body.Close()
+	return util.String2Big(reply), nil
+}
 
-	var rpcResp *JSONRpcResp
-	err = json.NewDecoder(resp.Body).Decode(&rpcResp)
+func (r *RPCClient) GetGasPrice(ctx context.Context) (*big.Int, error) {
+	var reply string
+	err := r.call(ctx, "eth_gasPrice", nil, &reply, true)
 	if err != nil {
-		r.markSick()
 		return nil, err
 	}
-	if rpcResp.Error != nil {
+	return util.String2Big(reply), nil
+}
+
+// Unmarshals result into reply, idempotent requests are retried on transport errors
+func (r *RPCClient) call(ctx context.Context, method string, params interface{}, reply interface{}, idempotent bool) error {
+	return withRetry(ctx, idempotent, func() error {
+		rpcResp, err := r.doCall(ctx, method, params)
+		if err != nil {
+			return err
+		}
+		result := []byte("null")
+		if rpcResp.Result != nil {
+			result = *rpcResp.Result
+		}
+		if err := json.Unmarshal(result, reply); err != nil {
+			r.markSick()
+			return &NodeError{fmt.Errorf("malformed %s result: %v", method, err)}
+		}
+		return nil
+	})
+}
+
+func (r *RPCClient) doCall(ctx context.Context, method string, params interface{}) (*JSONRpcResp, error) {
+	id := atomic.AddUint64(&r.requestId, 1)
+	jsonReq := map[string]interface{}{"jsonrpc": "2.0", "method": method, "params": params, "id": id}
+	data, _ := json.Marshal(jsonReq)
+
+	resp, err := r.transport.call(ctx, strconv.FormatUint(id, 10), data)
+	if err != nil {
 		r.markSick()
-		return nil, errors.New(rpcResp.Error["message"].(string))
+		return nil, &TransportError{err}
 	}
-	return rpcResp, err
-}
 
-func (r *RPCClient) Check() bool {
-	_, err := r.GetWork()
+	var rpcResp *JSONRpcResp
+	err = json.Unmarshal(resp, &rpcResp)
+	if err == nil && rpcResp == nil {
+		err = errors.New("empty response")
+	}
 	if err != nil {
-		return false
+		r.markSick()
+		return nil, &TransportError{fmt.Errorf("unreadable reply to %s: %v", method, err)}
+	}
+	if len(rpcResp.Error) > 0 && string(rpcResp.Error) != "null" {
+		return nil, parseRPCError(rpcResp.Error)
 	}
-	r.markAlive()
-	return !r.Sick()
+	return rpcResp, nil
 }
 
 func (r *RPCClient) Sick() bool {
@@ -0,0 +1,273 @@
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var errConnClosed = errors.New("connection closed")
+
+// Sends raw JSON-RPC request, id is used to match replies on shared connections
+type transport interface {
+	call(ctx context.Context, id string, data []byte) ([]byte, error)
+}
+
+func newTransport(url string, timeout time.Duration, auth *authenticator) transport {
+	switch {
+	case strings.HasPrefix(url, "ws://"), strings.HasPrefix(url, "wss://"):
+		return newStreamTransport(timeout, func() (streamConn, error) {
+			return dialWebsocket(url, timeout, auth)
+		})
+	case strings.HasPrefix(url, "http://"), strings.HasPrefix(url, "https://"):
+		return &httpTransport{url: url, client: &http.Client{Timeout: timeout}, auth: auth}
+	}
+	// Anything else is a path to node IPC socket
+	path := strings.TrimPrefix(url, "ipc://")
+	return newStreamTransport(timeout, func() (streamConn, error) {
+		return dialIPC(path, timeout)
+	})
+}
+
+type httpTransport struct {
+	url    string
+	client *http.Client
+	auth   *authenticator
+}
+
+func (t *httpTransport) call(ctx context.Context, id string, data []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", t.url, bytes.NewBuffer(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	t.auth.apply(req.Header)
+
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	// JSON-RPC errors may come with any status, let caller parse them
+	if resp.StatusCode/100 != 2 && !json.Valid(body) {
+		return nil, fmt.Errorf("HTTP %s", resp.Status)
+	}
+	return body, nil
+}
+
+type streamConn interface {
+	writeMessage(data []byte) error
+	readMessage() ([]byte, error)
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+	Close() error
+}
+
+// Keeps single connection open and multiplexes requests by id
+type streamTransport struct {
+	sync.Mutex
+	writeMu sync.Mutex
+	dial    func() (streamConn, error)
+	conn    streamConn
+	pending map[string]chan []byte
+	timeout time.Duration
+}
+
+func newStreamTransport(timeout time.Duration, dial func() (streamConn, error)) *streamTransport {
+	return &streamTransport{dial: dial, timeout: timeout, pending: make(map[string]chan []byte)}
+}
+
+func (t *streamTransport) call(ctx context.Context, id string, data []byte) ([]byte, error) {
+	reply := make(chan []byte, 1)
+
+	t.Lock()
+	conn, err := t.connect()
+	if err != nil {
+		t.Unlock()
+		return nil, err
+	}
+	t.pending[id] = reply
+	// Reader fails all pending requests if node goes silent
+	conn.SetReadDeadline(time.Now().Add(t.timeout))
+	t.Unlock()
+
+	t.writeMu.Lock()
+	conn.SetWriteDeadline(time.Now().Add(t.timeout))
+	err = conn.writeMessage(data)
+	t.writeMu.Unlock()
+	if err != nil {
+		t.drop(conn)
+		return nil, err
+	}
+
+	timer := time.NewTimer(t.timeout)
+	defer timer.Stop()
+	select {
+	case resp, ok := <-reply:
+		if !ok {
+			return nil, errConnClosed
+		}
+		return resp, nil
+	case <-timer.C:
+		// Late reply or half-open socket would keep stream stuck, dial again
+		t.drop(conn)
+		return nil, fmt.Errorf("request %s timed out", id)
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			t.drop(conn)
+		} else {
+			t.cancel(id)
+		}
+		return nil, ctx.Err()
+	}
+}
+
+func (t *streamTransport) cancel(id string) {
+	t.Lock()
+	delete(t.pending, id)
+	t.Unlock()
+}
+
+// Must be called with lock held
+func (t *streamTransport) connect() (streamConn, error) {
+	if t.conn != nil {
+		return t.conn, nil
+	}
+	conn, err := t.dial()
+	if err != nil {
+		return nil, err
+	}
+	t.conn = conn
+	go t.read(conn)
+	return conn, nil
+}
+
+func (t *streamTransport) read(conn streamConn) {
+	for {
+		data, err := conn.readMessage()
+		if err != nil {
+			t.drop(conn)
+			return
+		}
+		t.Lock()
+		for _, id := range replyIds(data) {
+			if reply, ok := t.pending[id]; ok {
+				delete(t.pending, id)
+				reply <- data
+				break
+			}
+		}
+		// Idle connection may stay silent
+		if len(t.pending) == 0 {
+			conn.SetReadDeadline(time.Time{})
+		} else {
+			conn.SetReadDeadline(time.Now().Add(t.timeout))
+		}
+		t.Unlock()
+	}
+}
+
+// Fails requests in flight, next call dials again
+func (t *streamTransport) drop(conn streamConn) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.conn != conn {
+		return
+	}
+	conn.Close()
+	t.conn = nil
+	for id, reply := range t.pending {
+		close(reply)
+		delete(t.pending, id)
+	}
+}
+
+type replyHeader struct {
+	Id json.RawMessage `json:"id"`
+}
+
+// Batch replies are matched by any of their ids, order is up to the node
+func replyIds(data []byte) []string {
+	var replies []replyHeader
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && data[0] == '[' {
+		json.Unmarshal(data, &replies)
+	} else {
+		var reply replyHeader
+		if json.Unmarshal(data, &reply) == nil {
+			replies = append(replies, reply)
+		}
+	}
+	var ids []string
+	for _, reply := range replies {
+		if len(reply.Id) > 0 {
+			ids = append(ids, string(reply.Id))
+		}
+	}
+	return ids
+}
+
+type wsConn struct {
+	*websocket.Conn
+}
+
+func dialWebsocket(url string, timeout time.Duration, auth *authenticator) (streamConn, error) {
+	dialer := websocket.Dialer{HandshakeTimeout: timeout}
+	header := make(http.Header)
+	auth.apply(header)
+	conn, _, err := dialer.Dial(url, header)
+	if err != nil {
+		return nil, err
+	}
+	return &wsConn{conn}, nil
+}
+
+func (c *wsConn) writeMessage(data []byte) error {
+	return c.WriteMessage(websocket.TextMessage, data)
+}
+
+func (c *wsConn) readMessage() ([]byte, error) {
+	_, data, err := c.ReadMessage()
+	return data, err
+}
+
+type ipcConn struct {
+	net.Conn
+	dec *json.Decoder
+}
+
+func dialIPC(path string, timeout time.Duration) (streamConn, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &ipcConn{Conn: conn, dec: json.NewDecoder(bufio.NewReader(conn))}, nil
+}
+
+func (c *ipcConn) writeMessage(data []byte) error {
+	_, err := c.Write(data)
+	return err
+}
+
+func (c *ipcConn) readMessage() ([]byte, error) {
+	var msg json.RawMessage
+	err := c.dec.Decode(&msg)
+	return msg, err
+}
@@ -0,0 +1,252 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Replies in reverse order to check requests are matched by id
+func serveIPC(t *testing.T, l net.Listener, batch int) {
+	conn, err := l.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	dec := json.NewDecoder(conn)
+	for {
+		var reqs []map[string]interface{}
+		for i := 0; i < batch; i++ {
+			var req map[string]interface{}
+			if err := dec.Decode(&req); err != nil {
+				return
+			}
+			reqs = append(reqs, req)
+		}
+		for i := len(reqs) - 1; i >= 0; i-- {
+			reply := map[string]interface{}{"jsonrpc": "2.0", "id": reqs[i]["id"], "result": reqs[i]["params"]}
+			data, _ := json.Marshal(reply)
+			conn.Write(data)
+		}
+	}
+}
+
+func TestIPCMultiplexing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rpc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "geth.ipc")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("Unix sockets are not available: %v", err)
+	}
+	defer l.Close()
+
+	n := 4
+	go serveIPC(t, l, n)
+
+	r := NewRPCClient("test", path, "5s", nil)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := r.doCall(context.Background(), "test_echo", []int{i})
+			if err != nil {
+				t.Errorf("Call failed: %v", err)
+				return
+			}
+			var reply []int
+			json.Unmarshal(*resp.Result, &reply)
+			if len(reply) != 1 || reply[0] != i {
+				t.Errorf("Must receive own reply, sent %v got %v", i, reply)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// Node that stops answering must not keep the stream stuck
+func TestStreamRedialsAfterTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "geth.ipc")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("Unix sockets are not available: %v", err)
+	}
+	defer l.Close()
+
+	silent := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		silent <- conn
+		serveIPC(t, l, 1)
+	}()
+
+	tr := newStreamTransport(200*time.Millisecond, func() (streamConn, error) {
+		return dialIPC(path, time.Second)
+	})
+	if _, err := tr.call(context.Background(), "1", []byte(`{"jsonrpc":"2.0","id":1,"method":"test_echo","params":[1]}`)); err == nil {
+		t.Fatal("Call to silent node must time out")
+	}
+	conn := <-silent
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := ioutil.ReadAll(conn); err != nil {
+		t.Errorf("Stuck connection must be closed: %v", err)
+	}
+
+	data, err := tr.call(context.Background(), "2", []byte(`{"jsonrpc":"2.0","id":2,"method":"test_echo","params":[2]}`))
+	if err != nil || !bytes.Contains(data, []byte(`"result":[2]`)) {
+		t.Errorf("Must dial again after timeout, got %s: %v", data, err)
+	}
+}
+
+func TestBatchCall(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var reqs []map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&reqs)
+		var replies []map[string]interface{}
+		for i := len(reqs) - 1; i >= 0; i-- {
+			reply := map[string]interface{}{"jsonrpc": "2.0", "id": reqs[i]["id"]}
+			if i == 1 {
+				reply["error"] = map[string]interface{}{"code": -32000, "message": "unknown block"}
+			} else {
+				reply["result"] = map[string]string{"number": reqs[i]["params"].([]interface{})[0].(string)}
+			}
+			replies = append(replies, reply)
+		}
+		json.NewEncoder(w).Encode(replies)
+	}))
+	defer srv.Close()
+
+	r := NewRPCClient("test", srv.URL, "5s", nil)
+	blocks := make([]*GetBlockReply, 3)
+	batch := make([]BatchElem, 3)
+	for i := range batch {
+		batch[i] = BlockByHeightRequest(int64(i+10), &blocks[i])
+	}
+	if err := r.BatchCall(context.Background(), batch); err != nil {
+		t.Fatalf("Batch failed: %v", err)
+	}
+	if blocks[0].Number != "0xa" || blocks[2].Number != "0xc" {
+		t.Error("Must match replies by id")
+	}
+	if batch[1].Error == nil || blocks[1] != nil {
+		t.Error("Must set error of failed request")
+	}
+}
+
+func TestBatchRefused(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		w.Write([]byte(`{"jsonrpc":"2.0","id":null,"error":{"code":-32600,"message":"batch too large"}}`))
+	}))
+	defer srv.Close()
+
+	r := NewRPCClient("test", srv.URL, "5s", nil)
+	var block *GetBlockReply
+	err := r.BatchCall(context.Background(), []BatchElem{BlockByHeightRequest(10, &block)})
+	if !IsRPCError(err) || IsTemporary(err) || !strings.Contains(err.Error(), "batch too large") {
+		t.Errorf("Must return node error for refused batch: %v", err)
+	}
+	if calls != 1 || r.Sick() {
+		t.Errorf("Refused batch must not be retried or mark node sick, %v calls", calls)
+	}
+}
+
+func TestErrorClassification(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		calls++
+		var body map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&body)
+		switch {
+		case calls == 1:
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+		case body["method"] == "eth_getBalance":
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": body["id"], "result": "0x10"})
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": body["id"], "error": map[string]interface{}{"code": -32000, "message": map[string]string{"x": "y"}}})
+		}
+	}))
+	defer srv.Close()
+
+	r := NewRPCClient("test", srv.URL, "5s", nil)
+	balance, err := r.GetBalance(context.Background(), "0x0")
+	if err != nil || balance.Int64() != 16 {
+		t.Errorf("Must retry idempotent read after transport error: %v", err)
+	}
+
+	_, err = r.SendTransaction(context.Background(), "0x0", "0x1", "0x0", "0x0", "0x1", "", true)
+	if !IsRPCError(err) || IsTemporary(err) {
+		t.Errorf("Must classify node reply as JSON-RPC error: %v", err)
+	}
+	if r.Sick() {
+		t.Error("Must not mark node sick on JSON-RPC errors")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	secret := filepath.Join(t.TempDir(), "jwt.hex")
+	if err := ioutil.WriteFile(secret, []byte("0x"+strings.Repeat("ab", 32)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var headers []http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		headers = append(headers, req.Header)
+		var body map[string]interface{}
+		json.NewDecoder(req.Body).Decode(&body)
+		json.NewEncoder(w).Encode(map[string]interface{}{"id": body["id"], "result": "0x10"})
+	}))
+	defer srv.Close()
+
+	r := NewRPCClient("test", srv.URL, "5s", &Auth{Headers: map[string]string{"X-Api-Key": "key"}, Username: "pool", Password: "pass"})
+	if _, err := r.GetPeerCount(context.Background()); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	if headers[0].Get("X-Api-Key") != "key" {
+		t.Error("Must send custom headers")
+	}
+	if user, pass, ok := (&http.Request{Header: headers[0]}).BasicAuth(); !ok || user != "pool" || pass != "pass" {
+		t.Error("Must send basic auth")
+	}
+
+	r = NewRPCClient("test", srv.URL, "5s", &Auth{JWTSecret: secret})
+	if _, err := r.GetPeerCount(context.Background()); err != nil {
+		t.Fatalf("Call failed: %v", err)
+	}
+	token := strings.TrimPrefix(headers[1].Get("Authorization"), "Bearer ")
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("Malformed token %v", token)
+	}
+	mac := hmac.New(sha256.New, bytes.Repeat([]byte{0xab}, 32))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if parts[2] != base64.RawURLEncoding.EncodeToString(mac.Sum(nil)) {
+		t.Error("Must sign token with secret")
+	}
+	claims, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	var iat map[string]int64
+	if json.Unmarshal(claims, &iat) != nil || time.Now().Unix()-iat["iat"] > 5 {
+		t.Errorf("Must issue fresh token, got %s", claims)
+	}
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"encoding/json"
 	"fmt"
 	"math"
 	"math/big"
@@ -13,6 +14,8 @@ import (
 	"github.com/cyberpoolorg/etc-stratum/util"
 )
 
+const auditLogSize = 1000
+
 type Config struct {
 	Endpoint string `json:"endpoint"`
 	Password string `json:"password"`
@@ -157,6 +160,47 @@ func (r *RedisClient) BgSave() (string, error) {
 	return r.client.BgSave().Result()
 }
 
+// Extends the lease if we already hold it
+var acquireLeaderScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return 1
+end
+return 0`
+
+func (r *RedisClient) AcquireLeader(role, name string, ttl time.Duration) (bool, error) {
+	key := r.formatKey("leader", role)
+	ms := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	n, err := r.client.Eval(acquireLeaderScript, []string{key}, []string{name, ms}).Result()
+	if err != nil {
+		return false, err
+	}
+	return n.(int64) == 1, nil
+}
+
+func (r *RedisClient) Publish(channel, message string) error {
+	return r.client.Publish(r.formatKey("channel", channel), message).Err()
+}
+
+// Blocks and calls handler for every message, returns once subscription fails
+func (r *RedisClient) Subscribe(channel string, handler func(message string)) error {
+	pubsub, err := r.client.Subscribe(r.formatKey("channel", channel))
+	if err != nil {
+		return err
+	}
+	defer pubsub.Close()
+
+	for {
+		msg, err := pubsub.ReceiveMessage()
+		if err != nil {
+			return err
+		}
+		handler(msg.Payload)
+	}
+}
+
 func (r *RedisClient) GetBlacklist() ([]string, error) {
 	cmd := r.client.SMembers(r.formatKey("blacklist"))
 	if cmd.Err() != nil {
@@ -173,6 +217,213 @@ func (r *RedisClient) GetWhitelist() ([]string, error) {
 	return cmd.Val(), nil
 }
 
+// Name is either blacklist or whitelist, manual changes make entry permanent
+func (r *RedisClient) AddToList(name, entry string) (bool, error) {
+	return r.updateList(name, entry, true)
+}
+
+func (r *RedisClient) RemoveFromList(name, entry string) (bool, error) {
+	return r.updateList(name, entry, false)
+}
+
+func (r *RedisClient) updateList(name, entry string, add bool) (bool, error) {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	cmds, err := tx.Exec(func() error {
+		if add {
+			tx.SAdd(r.formatKey(name), entry)
+		} else {
+			tx.SRem(r.formatKey(name), entry)
+		}
+		tx.ZRem(r.formatKey(name, "expiry"), entry)
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return cmds[0].(*redis.IntCmd).Val() > 0, nil
+}
+
+// Blacklists login until expiresAt (ms), see PurgeBlacklist
+func (r *RedisClient) BlacklistLogin(login string, expiresAt int64) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		tx.SAdd(r.formatKey("blacklist"), login)
+		tx.ZAdd(r.formatKey("blacklist", "expiry"), redis.Z{Score: float64(expiresAt), Member: login})
+		return nil
+	})
+	return err
+}
+
+func (r *RedisClient) PurgeBlacklist() ([]string, error) {
+	now := strconv.FormatInt(util.MakeTimestamp(), 10)
+	expired, err := r.client.ZRangeByScore(r.formatKey("blacklist", "expiry"), redis.ZRangeByScore{Min: "-inf", Max: now}).Result()
+	if err != nil || len(expired) == 0 {
+		return nil, err
+	}
+
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err = tx.Exec(func() error {
+		for _, login := range expired {
+			tx.SRem(r.formatKey("blacklist"), login)
+			tx.ZRem(r.formatKey("blacklist", "expiry"), login)
+		}
+		return nil
+	})
+	return expired, err
+}
+
+func (r *RedisClient) WriteAuditLog(entry string) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		tx.LPush(r.formatKey("audit"), entry)
+		tx.LTrim(r.formatKey("audit"), 0, auditLogSize-1)
+		return nil
+	})
+	return err
+}
+
+func (r *RedisClient) GetAuditLog(count int64) ([]string, error) {
+	return r.client.LRange(r.formatKey("audit"), 0, count-1).Result()
+}
+
+type ShareCounts struct {
+	Valid   int64 `json:"valid"`
+	Invalid int64 `json:"invalid"`
+}
+
+func (c *ShareCounts) InvalidRatio() float64 {
+	if total := c.Valid + c.Invalid; total > 0 {
+		return float64(c.Invalid) / float64(total)
+	}
+	return 0
+}
+
+// Kind is either ip or login, each instance reports its own window, readers sum them up
+func (r *RedisClient) WriteShareCounts(instance, kind string, counts map[string]ShareCounts, expire time.Duration) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		for entry, c := range counts {
+			key := r.formatKey("shareRatio", kind, entry)
+			tx.HSet(key, instance, join(c.Valid, c.Invalid))
+			tx.Expire(key, expire)
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *RedisClient) GetShareCounts(kind, entry string) (*ShareCounts, error) {
+	cmd := r.client.HGetAllMap(r.formatKey("shareRatio", kind, entry))
+	if cmd.Err() != nil && cmd.Err() != redis.Nil {
+		return nil, cmd.Err()
+	}
+	result := &ShareCounts{}
+	for _, v := range cmd.Val() {
+		fields := strings.Split(v, ":")
+		if len(fields) != 2 {
+			continue
+		}
+		valid, _ := strconv.ParseInt(fields[0], 10, 64)
+		invalid, _ := strconv.ParseInt(fields[1], 10, 64)
+		result.Valid += valid
+		result.Invalid += invalid
+	}
+	return result, nil
+}
+
+type Ban struct {
+	IP            string `json:"ip"`
+	Reason        string `json:"reason"`
+	Instance      string `json:"instance"`
+	BannedAt      int64  `json:"bannedAt"`
+	ExpiresAt     int64  `json:"expiresAt"`
+	ValidShares   int64  `json:"validShares"`
+	InvalidShares int64  `json:"invalidShares"`
+	Malformed     int64  `json:"malformed"`
+}
+
+func (r *RedisClient) WriteBan(ban *Ban) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	key := r.formatKey("bans", ban.IP)
+	_, err := tx.Exec(func() error {
+		tx.HMSetMap(key, map[string]string{
+			"reason":        ban.Reason,
+			"instance":      ban.Instance,
+			"bannedAt":      strconv.FormatInt(ban.BannedAt, 10),
+			"expiresAt":     strconv.FormatInt(ban.ExpiresAt, 10),
+			"validShares":   strconv.FormatInt(ban.ValidShares, 10),
+			"invalidShares": strconv.FormatInt(ban.InvalidShares, 10),
+			"malformed":     strconv.FormatInt(ban.Malformed, 10),
+		})
+		tx.ExpireAt(key, time.Unix(0, ban.ExpiresAt*int64(time.Millisecond)))
+		tx.ZAdd(r.formatKey("bans"), redis.Z{Score: float64(ban.ExpiresAt), Member: ban.IP})
+		return nil
+	})
+	return err
+}
+
+// Returns active bans, dropping expired index entries
+func (r *RedisClient) GetBans() ([]*Ban, error) {
+	now := strconv.FormatInt(util.MakeTimestamp(), 10)
+	r.client.ZRemRangeByScore(r.formatKey("bans"), "-inf", now)
+	ips, err := r.client.ZRangeByScore(r.formatKey("bans"), redis.ZRangeByScore{Min: now, Max: "+inf"}).Result()
+	if err != nil || len(ips) == 0 {
+		return nil, err
+	}
+
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	cmds, err := tx.Exec(func() error {
+		for _, ip := range ips {
+			tx.HGetAllMap(r.formatKey("bans", ip))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	var result []*Ban
+	for i, cmd := range cmds {
+		m, _ := cmd.(*redis.StringStringMapCmd).Result()
+		if len(m) == 0 {
+			continue
+		}
+		ban := &Ban{IP: ips[i], Reason: m["reason"], Instance: m["instance"]}
+		ban.BannedAt, _ = strconv.ParseInt(m["bannedAt"], 10, 64)
+		ban.ExpiresAt, _ = strconv.ParseInt(m["expiresAt"], 10, 64)
+		ban.ValidShares, _ = strconv.ParseInt(m["validShares"], 10, 64)
+		ban.InvalidShares, _ = strconv.ParseInt(m["invalidShares"], 10, 64)
+		ban.Malformed, _ = strconv.ParseInt(m["malformed"], 10, 64)
+		result = append(result, ban)
+	}
+	return result, nil
+}
+
+func (r *RedisClient) RemoveBan(ip string) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		tx.Del(r.formatKey("bans", ip))
+		tx.ZRem(r.formatKey("bans"), ip)
+		return nil
+	})
+	return err
+}
+
 func (r *RedisClient) WritePoolCharts(time1 int64, time2 string, poolHash string) error {
 	s := join(time1, time2, poolHash)
 	cmd := r.client.ZAdd(r.formatKey("charts", "pool"), redis.Z{Score: float64(time1), Member: s})
@@ -481,14 +732,43 @@ func (r *RedisClient) WriteNodeState(id string, height uint64, diff *big.Int, bl
 	return err
 }
 
+func (r *RedisClient) WriteBroadcastLatency(id string, p50, p90, p99 time.Duration) error {
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err := tx.Exec(func() error {
+		tx.HSet(r.formatKey("nodes"), join(id, "broadcastP50"), strconv.FormatInt(int64(p50/time.Millisecond), 10))
+		tx.HSet(r.formatKey("nodes"), join(id, "broadcastP90"), strconv.FormatInt(int64(p90/time.Millisecond), 10))
+		tx.HSet(r.formatKey("nodes"), join(id, "broadcastP99"), strconv.FormatInt(int64(p99/time.Millisecond), 10))
+		return nil
+	})
+	return err
+}
+
+// Health of each upstream of the instance, stored as JSON list
+func (r *RedisClient) WriteUpstreamHealth(id string, health interface{}) error {
+	data, err := json.Marshal(health)
+	if err != nil {
+		return err
+	}
+	return r.client.HSet(r.formatKey("nodes"), join(id, "upstreams"), string(data)).Err()
+}
+
 func (r *RedisClient) GetNodeStates() ([]map[string]interface{}, error) {
 	cmd := r.client.HGetAllMap(r.formatKey("nodes"))
 	if cmd.Err() != nil {
 		return nil, cmd.Err()
 	}
 	m := make(map[string]map[string]interface{})
-	for key, value := range cmd.Val() {
+	for key, raw := range cmd.Val() {
 		parts := strings.Split(key, ":")
+		var value interface{} = raw
+		if parts[1] == "upstreams" {
+			var health []interface{}
+			if json.Unmarshal([]byte(raw), &health) == nil {
+				value = health
+			}
+		}
 		if val, ok := m[parts[0]]; ok {
 			val[parts[1]] = value
 		} else {
@@ -703,6 +983,36 @@ func (r *RedisClient) LockPayouts(login string, amount int64) error {
 	return nil
 }
 
+var releaseLeaseScript = `
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0`
+
+// Payout run holds the lock as a lease, so one left by a crash expires
+func (r *RedisClient) LeasePayouts(owner string, ttl time.Duration) (bool, error) {
+	key := r.formatKey("payments", "lock")
+	ms := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	n, err := r.client.Eval(acquireLeaderScript, []string{key}, []string{owner, ms}).Result()
+	if err != nil {
+		return false, err
+	}
+	return n.(int64) == 1, nil
+}
+
+func (r *RedisClient) ReleasePayouts(owner string) error {
+	return r.client.Eval(releaseLeaseScript, []string{r.formatKey("payments", "lock")}, []string{owner}).Err()
+}
+
+// Lock without expiry is left by older versions and must be resolved manually
+func (r *RedisClient) IsPayoutsLockPermanent() (bool, error) {
+	ttl, err := r.client.PTTL(r.formatKey("payments", "lock")).Result()
+	if err != nil {
+		return false, err
+	}
+	return ttl == -time.Millisecond, nil
+}
+
 func (r *RedisClient) UnlockPayouts() error {
 	key := r.formatKey("payments", "lock")
 	_, err := r.client.Del(key).Result()
@@ -793,6 +1103,198 @@ func (r *RedisClient) WritePayment(login, txHash string, amount int64) error {
 	return err
 }
 
+// Payment states, confirmed, failed and rolled back ones are final
+const (
+	PaymentQueued     = "queued"
+	PaymentSigned     = "signed"
+	PaymentBroadcast  = "broadcast"
+	PaymentConfirmed  = "confirmed"
+	PaymentFailed     = "failed"
+	PaymentRolledBack = "rolled-back"
+)
+
+type Payment struct {
+	Id     string `json:"id"`
+	Login  string `json:"login"`
+	Amount int64  `json:"amount"`
+	// Payout address set by miner, login if empty
+	Address string `json:"address,omitempty"`
+	State   string `json:"state"`
+	TxHash  string `json:"txHash"`
+	Nonce   uint64 `json:"nonce"`
+	// Signed transaction, sent again if node lost it
+	RawTx    string `json:"rawTx,omitempty"`
+	GasPrice string `json:"gasPrice,omitempty"`
+	// Earlier transactions with the same nonce, replaced by TxHash
+	Replaced []string `json:"replaced,omitempty"`
+	// Chain height when payment was queued
+	Height    int64 `json:"height"`
+	CreatedAt int64 `json:"createdAt"`
+	UpdatedAt int64 `json:"updatedAt"`
+	SentAt    int64 `json:"sentAt"`
+	// Paid by mined transaction, fee is in Shannon
+	GasUsed uint64 `json:"gasUsed,omitempty"`
+	Fee     int64  `json:"fee,omitempty"`
+}
+
+func (p *Payment) Recipient() string {
+	if len(p.Address) > 0 {
+		return p.Address
+	}
+	return p.Login
+}
+
+func (p *Payment) Final() bool {
+	return p.State == PaymentConfirmed || p.State == PaymentFailed || p.State == PaymentRolledBack
+}
+
+// Any of them may be mined
+func (p *Payment) Hashes() []string {
+	if len(p.TxHash) == 0 {
+		return p.Replaced
+	}
+	return append(append([]string(nil), p.Replaced...), p.TxHash)
+}
+
+// Makes mined transaction the one of payment, the rest are replaced
+func (p *Payment) SetMined(hash string) {
+	if hash == p.TxHash {
+		return
+	}
+	replaced := []string{p.TxHash}
+	for _, h := range p.Replaced {
+		if h != hash {
+			replaced = append(replaced, h)
+		}
+	}
+	p.TxHash = hash
+	p.Replaced = replaced
+}
+
+// Moves amount from miner balance to pending and stores payment record
+func (r *RedisClient) QueuePayment(p *Payment) error {
+	p.CreatedAt = util.MakeTimestamp()
+	p.UpdatedAt = p.CreatedAt
+	p.Id = join(p.Login, p.CreatedAt, p.Nonce)
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err = tx.Exec(func() error {
+		tx.HIncrBy(r.formatKey("miners", p.Login), "balance", (p.Amount * -1))
+		tx.HIncrBy(r.formatKey("miners", p.Login), "pending", p.Amount)
+		tx.HIncrBy(r.formatKey("finances"), "balance", (p.Amount * -1))
+		tx.HIncrBy(r.formatKey("finances"), "pending", p.Amount)
+		tx.HSet(r.formatKey("payments", "records"), p.Id, string(data))
+		tx.ZAdd(r.formatKey("payments", "active"), redis.Z{Score: float64(p.CreatedAt), Member: p.Id})
+		return nil
+	})
+	return err
+}
+
+// Saves state change of non-final payment
+func (r *RedisClient) UpdatePayment(p *Payment) error {
+	p.UpdatedAt = util.MakeTimestamp()
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return r.client.HSet(r.formatKey("payments", "records"), p.Id, string(data)).Err()
+}
+
+// Moves amount from pending to paid once transaction is mined
+func (r *RedisClient) ConfirmPayment(p *Payment) error {
+	p.State = PaymentConfirmed
+	p.UpdatedAt = util.MakeTimestamp()
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	ts := p.UpdatedAt / 1000
+
+	_, err = tx.Exec(func() error {
+		tx.HIncrBy(r.formatKey("miners", p.Login), "pending", (p.Amount * -1))
+		tx.HIncrBy(r.formatKey("miners", p.Login), "paid", p.Amount)
+		tx.HIncrBy(r.formatKey("finances"), "pending", (p.Amount * -1))
+		tx.HIncrBy(r.formatKey("finances"), "paid", p.Amount)
+		tx.HIncrBy(r.formatKey("finances"), "fees", p.Fee)
+		tx.ZAdd(r.formatKey("payments", "all"), redis.Z{Score: float64(ts), Member: join(p.TxHash, p.Login, p.Amount)})
+		tx.ZAdd(r.formatKey("payments", p.Login), redis.Z{Score: float64(ts), Member: join(p.TxHash, p.Amount)})
+		tx.HSet(r.formatKey("payments", "records"), p.Id, string(data))
+		tx.ZRem(r.formatKey("payments", "active"), p.Id)
+		return nil
+	})
+	return err
+}
+
+// Returns amount to miner balance, state is either failed or rolled back
+func (r *RedisClient) RollbackPayment(p *Payment, state string) error {
+	p.State = state
+	p.UpdatedAt = util.MakeTimestamp()
+	data, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	tx := r.client.Multi()
+	defer tx.Close()
+
+	_, err = tx.Exec(func() error {
+		tx.HIncrBy(r.formatKey("miners", p.Login), "balance", p.Amount)
+		tx.HIncrBy(r.formatKey("miners", p.Login), "pending", (p.Amount * -1))
+		tx.HIncrBy(r.formatKey("finances"), "balance", p.Amount)
+		tx.HIncrBy(r.formatKey("finances"), "pending", (p.Amount * -1))
+		// Failed transaction pays for gas too
+		tx.HIncrBy(r.formatKey("finances"), "fees", p.Fee)
+		tx.HSet(r.formatKey("payments", "records"), p.Id, string(data))
+		tx.ZRem(r.formatKey("payments", "active"), p.Id)
+		return nil
+	})
+	return err
+}
+
+// Payments not in final state, oldest first
+func (r *RedisClient) GetActivePayments() ([]*Payment, error) {
+	ids, err := r.client.ZRange(r.formatKey("payments", "active"), 0, -1).Result()
+	if err != nil || len(ids) == 0 {
+		return nil, err
+	}
+	return r.getPayments(ids)
+}
+
+func (r *RedisClient) GetPayment(id string) (*Payment, error) {
+	result, err := r.getPayments([]string{id})
+	if err != nil || len(result) == 0 {
+		return nil, err
+	}
+	return result[0], nil
+}
+
+func (r *RedisClient) getPayments(ids []string) ([]*Payment, error) {
+	values, err := r.client.HMGet(r.formatKey("payments", "records"), ids...).Result()
+	if err != nil {
+		return nil, err
+	}
+	var result []*Payment
+	for _, v := range values {
+		raw, ok := v.(string)
+		if !ok {
+			continue
+		}
+		var p Payment
+		if err := json.Unmarshal([]byte(raw), &p); err != nil {
+			return nil, err
+		}
+		result = append(result, &p)
+	}
+	return result, nil
+}
+
 func (r *RedisClient) WriteImmatureBlock(block *BlockData, roundRewards map[string]int64) error {
 	tx := r.client.Multi()
 	defer tx.Close()
@@ -906,6 +1408,41 @@ func (r *RedisClient) writeMaturedBlock(tx *redis.Multi, block *BlockData) {
 	tx.ZAdd(r.formatKey("blocks", "matured"), redis.Z{Score: float64(block.Height), Member: block.key()})
 }
 
+// Set by miner with signed message, kept in miner hash
+type MinerSettings struct {
+	// Pool threshold if zero
+	Threshold int64  `json:"threshold"`
+	Address   string `json:"address"`
+	// Of signed message, older messages are rejected
+	Timestamp int64 `json:"timestamp"`
+}
+
+func (r *RedisClient) GetMinerSettings(login string) (*MinerSettings, error) {
+	values, err := r.client.HMGet(r.formatKey("miners", login), "threshold", "payoutAddress", "settingsAt").Result()
+	if err != nil {
+		return nil, err
+	}
+	var result MinerSettings
+	if v, ok := values[0].(string); ok {
+		result.Threshold, _ = strconv.ParseInt(v, 10, 64)
+	}
+	if v, ok := values[1].(string); ok {
+		result.Address = v
+	}
+	if v, ok := values[2].(string); ok {
+		result.Timestamp, _ = strconv.ParseInt(v, 10, 64)
+	}
+	return &result, nil
+}
+
+func (r *RedisClient) SetMinerSettings(login string, s *MinerSettings) error {
+	return r.client.HMSetMap(r.formatKey("miners", login), map[string]string{
+		"threshold":     strconv.FormatInt(s.Threshold, 10),
+		"payoutAddress": s.Address,
+		"settingsAt":    strconv.FormatInt(s.Timestamp, 10),
+	}).Err()
+}
+
 func (r *RedisClient) IsMinerExists(login string) (bool, error) {
 	return r.client.Exists(r.formatKey("miners", login)).Result()
 }
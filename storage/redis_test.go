@@ -5,8 +5,11 @@ import (
 	"reflect"
 	"strconv"
 	"testing"
+	"time"
 
 	"gopkg.in/redis.v3"
+
+	"github.com/cyberpoolorg/etc-stratum/util"
 )
 
 var r *RedisClient
@@ -123,6 +126,36 @@ func TestIsPayoutsLocked(t *testing.T) {
 	}
 }
 
+func TestLeasePayouts(t *testing.T) {
+	reset()
+
+	if locked, _ := r.LeasePayouts("a", time.Minute); !locked {
+		t.Fatal("Must acquire free lock")
+	}
+	if locked, _ := r.LeasePayouts("b", time.Minute); locked {
+		t.Error("Must not acquire lock held by other owner")
+	}
+	if locked, _ := r.LeasePayouts("a", time.Minute); !locked {
+		t.Error("Must renew own lock")
+	}
+	r.ReleasePayouts("b")
+	if permanent, _ := r.IsPayoutsLockPermanent(); permanent {
+		t.Error("Lease must expire")
+	}
+	if locked, _ := r.IsPayoutsLocked(); !locked {
+		t.Error("Must not release lock of other owner")
+	}
+	r.ReleasePayouts("a")
+	if locked, _ := r.IsPayoutsLocked(); locked {
+		t.Error("Must release own lock")
+	}
+
+	r.LockPayouts("x", 1000)
+	if permanent, _ := r.IsPayoutsLockPermanent(); !permanent {
+		t.Error("Lock of older versions must be permanent")
+	}
+}
+
 func TestUpdateBalance(t *testing.T) {
 	reset()
 
@@ -263,6 +296,47 @@ func TestWritePayment(t *testing.T) {
 	}
 }
 
+func TestPaymentRecords(t *testing.T) {
+	reset()
+
+	r.client.HMSetMap(r.formatKey("miners:x"), map[string]string{"balance": "1000"})
+	r.client.HMSetMap(r.formatKey("finances"), map[string]string{"balance": "10000"})
+
+	paid := &Payment{Login: "x", Amount: 250, State: PaymentQueued, Nonce: 7}
+	if err := r.QueuePayment(paid); err != nil {
+		t.Fatal(err)
+	}
+	refund := &Payment{Login: "x", Amount: 100, State: PaymentQueued, Nonce: 8}
+	r.QueuePayment(refund)
+	if r.client.HGet(r.formatKey("miners:x"), "pending").Val() != "350" {
+		t.Error("Must move queued amount to pending")
+	}
+	paid.TxHash = "0x1"
+	paid.State = PaymentBroadcast
+	r.UpdatePayment(paid)
+	payments, _ := r.GetActivePayments()
+	if len(payments) != 2 || payments[0].TxHash != "0x1" || payments[0].Nonce != 7 {
+		t.Fatalf("Must return active payments, got %+v", payments)
+	}
+
+	r.ConfirmPayment(paid)
+	r.RollbackPayment(refund, PaymentRolledBack)
+	result := r.client.HGetAllMap(r.formatKey("miners:x")).Val()
+	if result["balance"] != "750" || result["pending"] != "0" || result["paid"] != "250" {
+		t.Errorf("Unexpected miner balances %v", result)
+	}
+	result = r.client.HGetAllMap(r.formatKey("finances")).Val()
+	if result["balance"] != "9750" || result["pending"] != "0" || result["paid"] != "250" {
+		t.Errorf("Unexpected pool balances %v", result)
+	}
+	if payments, _ := r.GetActivePayments(); len(payments) != 0 {
+		t.Error("Final payments must not be active")
+	}
+	if p, _ := r.GetPayment(refund.Id); p == nil || p.State != PaymentRolledBack {
+		t.Errorf("Must keep final record, got %+v", p)
+	}
+}
+
 func TestGetPendingPayments(t *testing.T) {
 	reset()
 
@@ -321,6 +395,51 @@ func TestCollectLuckStats(t *testing.T) {
 	}
 }
 
+func TestWriteBan(t *testing.T) {
+	reset()
+
+	now := util.MakeTimestamp()
+	r.WriteBan(&Ban{IP: "1.2.3.4", Reason: "x", Instance: "main", BannedAt: now, ExpiresAt: now + 60000, Malformed: 5})
+	r.WriteBan(&Ban{IP: "1.2.3.5", Reason: "x", BannedAt: now - 60000, ExpiresAt: now - 1})
+
+	bans, err := r.GetBans()
+	if err != nil {
+		t.Errorf("Must not return error: %v", err)
+	}
+	if len(bans) != 1 || bans[0].IP != "1.2.3.4" {
+		t.Fatal("Must return only active bans")
+	}
+	if bans[0].Instance != "main" || bans[0].Malformed != 5 || bans[0].ExpiresAt != now+60000 {
+		t.Error("Must restore ban details")
+	}
+	if r.client.ZCard(r.formatKey("bans")).Val() != 1 {
+		t.Error("Must drop expired bans from index")
+	}
+
+	r.RemoveBan("1.2.3.4")
+	bans, _ = r.GetBans()
+	if len(bans) != 0 {
+		t.Error("Must remove ban")
+	}
+}
+
+func TestShareCounts(t *testing.T) {
+	reset()
+
+	r.WriteShareCounts("main", "ip", map[string]ShareCounts{"1.2.3.4": {Valid: 3, Invalid: 1}}, time.Minute)
+	r.WriteShareCounts("backup", "ip", map[string]ShareCounts{"1.2.3.4": {Valid: 1, Invalid: 3}}, time.Minute)
+	r.WriteShareCounts("main", "login", map[string]ShareCounts{"1.2.3.4": {Valid: 1}}, time.Minute)
+
+	shares, err := r.GetShareCounts("ip", "1.2.3.4")
+	if err != nil || shares.Valid != 4 || shares.Invalid != 4 || shares.InvalidRatio() != 0.5 {
+		t.Errorf("Must sum IP windows of all instances, got %+v: %v", shares, err)
+	}
+	shares, _ = r.GetShareCounts("login", "1.2.3.4")
+	if shares.Valid != 1 || shares.Invalid != 0 {
+		t.Errorf("Must keep login windows apart, got %+v", shares)
+	}
+}
+
 func reset() {
 	keys := r.client.Keys(r.prefix + ":*").Val()
 	for _, k := range keys {
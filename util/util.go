@@ -1,14 +1,20 @@
 package util
 
 import (
+	"crypto/subtle"
+	"errors"
 	"math/big"
+	"net/http"
 	"regexp"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/ethereum/go-ethereum/accounts"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/common/math"
+	"github.com/ethereum/go-ethereum/crypto"
 )
 
 var Ether = math.BigPow(10, 18)
@@ -29,6 +35,26 @@ func IsZeroHash(s string) bool {
 	return zeroHash.MatchString(s)
 }
 
+// Lowercase address that signed message with personal_sign
+func RecoverPersonalSigner(message, signature string) (string, error) {
+	sig, err := hexutil.Decode(signature)
+	if err != nil {
+		return "", err
+	}
+	if len(sig) != crypto.SignatureLength {
+		return "", errors.New("signature must be 65 bytes")
+	}
+	// Wallets set v to 27 or 28
+	if sig[crypto.RecoveryIDOffset] >= 27 {
+		sig[crypto.RecoveryIDOffset] -= 27
+	}
+	pub, err := crypto.SigToPub(accounts.TextHash([]byte(message)), sig)
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(crypto.PubkeyToAddress(*pub).Hex()), nil
+}
+
 func MakeTimestamp() int64 {
 	return time.Now().UnixNano() / int64(time.Millisecond)
 }
@@ -80,3 +106,15 @@ func String2Big(num string) *big.Int {
 	n.SetString(num, 0)
 	return n
 }
+
+func IsAuthorized(r *http.Request, token string) bool {
+	if len(token) == 0 {
+		return false
+	}
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false
+	}
+	given := strings.TrimPrefix(auth, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}